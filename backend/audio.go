@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default max bytes of audio in memory, spill to disk if exceed.
+const defaultAudioMemoryLimit = 1024 * 1024
+
+// The ASR audio is 16kHz mono s16le PCM.
+const asrSampleRate, asrChannels, asrBitsPerSample = 16000, 1, 16
+
+// Set the max bytes of audio in memory by AIT_AUDIO_MEMORY_LIMIT, always use disk to keep files.
+func withAudioConfig(conf *Config) func(buffer *AudioBuffer) {
+	return func(buffer *AudioBuffer) {
+		buffer.limit, buffer.keepFiles = conf.AudioMemoryLimit, conf.KeepFiles
+		if conf.KeepFiles {
+			buffer.limit = 0
+		}
+	}
+}
+
+// The AudioBuffer is the audio in memory, which spills to the file when exceed the limit, to avoid
+// the disk I/O for small audio, but never use too much memory for large audio. The spilled audio is
+// stored in the storage when closed, and it's always stored if the storage is shared by replicas.
+type AudioBuffer struct {
+	// The audio extension, such as aac or wav, for Content-Type.
+	ext string
+	// The key in storage.
+	key string
+	// The max bytes in memory, 0 to always use disk.
+	limit int
+	// Whether keep the files for debugging, never remove the audio in storage.
+	keepFiles bool
+
+	// The audio in memory.
+	buf bytes.Buffer
+	// The temporary file if spilled.
+	file *os.File
+	// Whether spilled to file.
+	spilled bool
+	// Whether stored in storage, then the memory and temporary file are freed.
+	stored bool
+	// The size of audio.
+	size int64
+
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+func NewAudioBuffer(opts ...func(buffer *AudioBuffer)) *AudioBuffer {
+	v := &AudioBuffer{limit: defaultAudioMemoryLimit}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *AudioBuffer) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.stored {
+		return fmt.Sprintf("storage %v, size=%v", v.key, v.size)
+	}
+	return fmt.Sprintf("memory %v, size=%v", v.ext, v.size)
+}
+
+func (v *AudioBuffer) Write(p []byte) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.spilled && v.buf.Len()+len(p) > v.limit {
+		f, err := os.CreateTemp(workDir, fmt.Sprintf("assistant-*.%v", v.ext))
+		if err != nil {
+			return 0, errors.Wrapf(err, "create temp")
+		}
+		if _, err := f.Write(v.buf.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, errors.Wrapf(err, "write %v", f.Name())
+		}
+		v.file, v.spilled = f, true
+		v.buf = bytes.Buffer{}
+	}
+
+	var nn int
+	var err error
+	if v.spilled {
+		nn, err = v.file.Write(p)
+	} else {
+		nn, err = v.buf.Write(p)
+	}
+	v.size += int64(nn)
+	return nn, err
+}
+
+// Close the writing, store the audio to storage if spilled or the storage is shared, then the audio
+// is ready to read.
+func (v *AudioBuffer) Close(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.spilled && !audioStorage.Shared() {
+		return nil
+	}
+
+	var reader io.Reader = bytes.NewReader(v.buf.Bytes())
+	if v.file != nil {
+		defer os.Remove(v.file.Name())
+		defer v.file.Close()
+
+		if _, err := v.file.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "seek %v", v.file.Name())
+		}
+		reader = v.file
+	}
+
+	if err := audioStorage.Put(ctx, v.key, reader, v.size, ttsContentType(v.ext)); err != nil {
+		return errors.Wrapf(err, "store %v", v.key)
+	}
+
+	v.stored, v.file = true, nil
+	v.buf = bytes.Buffer{}
+	return nil
+}
+
+// Open the audio to read, for example, to serve by http.ServeContent.
+func (v *AudioBuffer) Open(ctx context.Context) (io.ReadSeekCloser, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.stored {
+		return &nopReadSeekCloser{bytes.NewReader(v.buf.Bytes())}, nil
+	}
+
+	reader, err := audioStorage.Get(ctx, v.key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %v", v.key)
+	}
+	if r, ok := reader.(io.ReadSeekCloser); ok {
+		return r, nil
+	}
+
+	// The object of shared storage is not seekable, and the audio of sentence is small, so we read it
+	// in memory, to serve the range requests.
+	defer reader.Close()
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", v.key)
+	}
+	return &nopReadSeekCloser{bytes.NewReader(b)}, nil
+}
+
+// Get the pre-signed URL of audio in storage, empty if not stored or not supported.
+func (v *AudioBuffer) PresignURL(ctx context.Context) (string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.stored {
+		return "", nil
+	}
+	return audioStorage.PresignURL(ctx, v.key)
+}
+
+// Remove the audio, and the temporary file or the object in storage.
+func (v *AudioBuffer) Remove(ctx context.Context) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.file != nil {
+		v.file.Close()
+		os.Remove(v.file.Name())
+		v.file = nil
+	}
+	if v.stored && !v.keepFiles {
+		if err := audioStorage.Remove(ctx, v.key); err != nil {
+			logger.Wf(ctx, "Audio: Remove %v failed, err %v", v.key, err)
+		}
+	}
+	v.buf = bytes.Buffer{}
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (v *nopReadSeekCloser) Close() error {
+	return nil
+}
+
+// Transcode audio by FFmpeg with the output args, from the input by stdin to the output by stdout, to
+// avoid temporary files. If failed, for example, the MP4 with moov at the end which requires seeking,
+// fallback to read the input from a temporary file.
+func transcodeAudio(ctx context.Context, input io.ReadSeeker, output io.Writer, outputArgs ...string) error {
+	run := func(inputFile string) error {
+		args := []string{"-loglevel", "error", "-i", inputFile, "-vn"}
+		args = append(args, outputArgs...)
+		args = append(args, "pipe:1")
+
+		// The span of each FFmpeg run, including the fallback.
+		_, span := startSpan(ctx, "transcode")
+		span.SetAttributes("args", strings.Join(args, " "))
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		if inputFile == "pipe:0" {
+			cmd.Stdin = input
+		}
+		cmd.Stdout, cmd.Stderr = output, &stderr
+
+		if err := cmd.Run(); err != nil {
+			return span.End(errors.Wrapf(err, "ffmpeg %v, stderr is %v", args, stderr.String()))
+		}
+		return span.End(nil)
+	}
+
+	// Only retry when nothing written, or the output is corrupt.
+	var counter countWriter
+	output = io.MultiWriter(output, &counter)
+	err := run("pipe:0")
+	if err == nil || counter.n > 0 {
+		return err
+	}
+
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "seek")
+	}
+
+	f, err := os.CreateTemp(workDir, "assistant-*-input.audio")
+	if err != nil {
+		return errors.Wrapf(err, "create temp")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, input); err != nil {
+		return errors.Wrapf(err, "copy to %v", f.Name())
+	}
+	logger.Wf(ctx, "Audio: Transcode by stdin failed, fallback to file %v", f.Name())
+
+	return run(f.Name())
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (v *countWriter) Write(p []byte) (int, error) {
+	v.n += int64(len(p))
+	return len(p), nil
+}
+
+// Transcode the input audio in opus or aac, to 16kHz mono s16le PCM for ASR.
+func transcodeToPCM(ctx context.Context, input []byte) ([]byte, error) {
+	var pcm bytes.Buffer
+	if err := transcodeAudio(ctx, bytes.NewReader(input), &pcm,
+		"-c:a", "pcm_s16le", "-ac", strconv.Itoa(asrChannels), "-ar", strconv.Itoa(asrSampleRate), "-f", "s16le",
+	); err != nil {
+		return nil, errors.Wrapf(err, "transcode")
+	}
+	logger.Tf(ctx, "Convert audio %vB to PCM %vB ok", len(input), pcm.Len())
+	return pcm.Bytes(), nil
+}
+
+// Get the duration of ASR PCM.
+func pcmDuration(pcm []byte) time.Duration {
+	bytesPerSecond := asrSampleRate * asrChannels * asrBitsPerSample / 8
+	return time.Duration(float64(len(pcm)) / float64(bytesPerSecond) * float64(time.Second))
+}
+
+// Write the WAV header for PCM in size, see http://soundfile.sapp.org/doc/WaveFormat/
+func writeWavHeader(w io.Writer, size, sampleRate, channels, bitsPerSample int) error {
+	blockAlign := channels * bitsPerSample / 8
+	header := []interface{}{
+		[]byte("RIFF"), uint32(36 + size), []byte("WAVE"),
+		[]byte("fmt "), uint32(16), uint16(1), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * blockAlign), uint16(blockAlign), uint16(bitsPerSample),
+		[]byte("data"), uint32(size),
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return errors.Wrapf(err, "write wav header")
+		}
+	}
+	return nil
+}
+
+// Wrap the ASR PCM to WAV.
+func pcmToWav(pcm []byte) []byte {
+	var b bytes.Buffer
+	writeWavHeader(&b, len(pcm), asrSampleRate, asrChannels, asrBitsPerSample)
+	b.Write(pcm)
+	return b.Bytes()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type authConfig struct {
+	// The static API tokens, map token to subject.
+	tokens map[string]string
+	// The HMAC secret to verify JWT, HS256 only.
+	jwtSecret string
+	// Whether reject the anonymous request.
+	required bool
+}
+
+// Whether authentication for API is enabled.
+func (v *authConfig) Enabled() bool {
+	return len(v.tokens) > 0 || v.jwtSecret != ""
+}
+
+// Build the auth config, by the getenv which read the env of tenant.
+func authInit(ctx context.Context, getenv func(key string) string) (*authConfig, error) {
+	apiAuthConfig := &authConfig{
+		tokens:    make(map[string]string),
+		jwtSecret: getenv("AIT_JWT_SECRET"),
+		required:  getenv("AIT_AUTH_REQUIRED") == "true",
+	}
+
+	// The tokens is a list of subject:token, for example, alice:xxx,bob:yyy, and the subject is optional.
+	for i, item := range strings.Split(getenv("AIT_API_TOKENS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		subject, token := fmt.Sprintf("token#%v", i), item
+		if pos := strings.Index(item, ":"); pos > 0 {
+			subject, token = item[:pos], item[pos+1:]
+		}
+		if token == "" {
+			return nil, errors.Errorf("empty token for %v", subject)
+		}
+		apiAuthConfig.tokens[token] = subject
+	}
+
+	if apiAuthConfig.required && !apiAuthConfig.Enabled() {
+		return nil, errors.New("AIT_AUTH_REQUIRED requires AIT_API_TOKENS or AIT_JWT_SECRET")
+	}
+
+	logger.Tf(ctx, "Auth config, tokens=%v, jwt=%vB, required=%v",
+		len(apiAuthConfig.tokens), len(apiAuthConfig.jwtSecret), apiAuthConfig.required)
+	return apiAuthConfig, nil
+}
+
+// Find the subject of static API token.
+func (v *authConfig) lookupToken(token string) (string, bool) {
+	for t, subject := range v.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return subject, true
+		}
+	}
+	return "", false
+}
+
+// Get the API token from the bearer token in header, or the auth in query.
+func apiTokenOf(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		return strings.TrimSpace(v[len("Bearer "):])
+	}
+	return r.URL.Query().Get("auth")
+}
+
+// The authError is an error about authentication or authorization, which response with HTTP 401.
+type authError struct {
+	msg string
+}
+
+func newAuthError(format string, a ...interface{}) error {
+	return errors.WithStack(&authError{msg: fmt.Sprintf(format, a...)})
+}
+
+func (v *authError) Error() string {
+	return v.msg
+}
+
+func (v *authError) Status() int {
+	return http.StatusUnauthorized
+}
+
+// Get the HTTP status code for error, default to 500.
+func httpErrorStatus(err error) int {
+	if v, ok := errors.Cause(err).(interface{ Status() int }); ok {
+		return v.Status()
+	}
+	return http.StatusInternalServerError
+}
+
+// The Principal is the identity of API caller.
+type Principal struct {
+	// The subject, the name of static token, or the sub of JWT.
+	subject string
+	// The groups of principal, from the groups claim of JWT.
+	groups []string
+}
+
+func (v *Principal) String() string {
+	if v == nil {
+		return "anonymous"
+	}
+	if len(v.groups) > 0 {
+		return fmt.Sprintf("%v(%v)", v.subject, strings.Join(v.groups, ","))
+	}
+	return v.subject
+}
+
+// Authenticate the API caller by the bearer token in header, or the auth in query. Return nil principal
+// for anonymous request, which is allowed only when AIT_AUTH_REQUIRED is not true.
+func (v *authConfig) authenticate(r *http.Request) (*Principal, error) {
+	if !v.Enabled() {
+		return nil, nil
+	}
+
+	token := apiTokenOf(r)
+	if token == "" {
+		if v.required {
+			return nil, newAuthError("no auth token")
+		}
+		return nil, nil
+	}
+
+	if subject, ok := v.lookupToken(token); ok {
+		return &Principal{subject: subject}, nil
+	}
+
+	if v.jwtSecret != "" && strings.Count(token, ".") == 2 {
+		return verifyJWT(token, v.jwtSecret)
+	}
+
+	return nil, newAuthError("invalid auth token")
+}
+
+// Whether the JWT is signed by the secret, to find the tenant of JWT before verifying the claims.
+func (v *authConfig) signedJWT(token string) bool {
+	if v.jwtSecret == "" || strings.Count(token, ".") != 2 {
+		return false
+	}
+	_, err := verifyJWTSignature(token, v.jwtSecret)
+	return err == nil
+}
+
+// Verify the signature of HS256 signed JWT, return the parts of JWT.
+func verifyJWTSignature(token, secret string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, newAuthError("invalid jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, newAuthError("decode jwt header")
+	} else if err := json.Unmarshal(b, &header); err != nil {
+		return nil, newAuthError("parse jwt header")
+	}
+	if header.Alg != "HS256" {
+		return nil, newAuthError("invalid jwt alg %v", header.Alg)
+	}
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if signature, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, newAuthError("decode jwt signature")
+	} else if !hmac.Equal(signature, h.Sum(nil)) {
+		return nil, newAuthError("invalid jwt signature")
+	}
+	return parts, nil
+}
+
+// Verify the HS256 signed JWT, and parse the claims to principal.
+func verifyJWT(token, secret string) (*Principal, error) {
+	parts, err := verifyJWTSignature(token, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Subject   string   `json:"sub"`
+		Groups    []string `json:"groups"`
+		ExpiresAt int64    `json:"exp"`
+		NotBefore int64    `json:"nbf"`
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, newAuthError("decode jwt claims")
+	} else if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, newAuthError("parse jwt claims")
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, newAuthError("jwt expired at %v", claims.ExpiresAt)
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, newAuthError("jwt not valid before %v", claims.NotBefore)
+	}
+	if claims.Subject == "" {
+		return nil, newAuthError("empty jwt sub")
+	}
+
+	return &Principal{subject: claims.Subject, groups: claims.Groups}, nil
+}
+
+// Create a random access token for stage.
+func newStageToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Verify the stage access token, in the stoken of query or X-Stage-Token header.
+func (v *Stage) Authorize(r *http.Request) error {
+	token := r.URL.Query().Get("stoken")
+	if token == "" {
+		token = r.Header.Get("X-Stage-Token")
+	}
+	if token == "" {
+		return newAuthError("empty stoken for sid %v", v.sid)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(v.token)) != 1 {
+		return newAuthError("invalid stoken for sid %v", v.sid)
+	}
+
+	// Never allow to access the stage from host of other tenant.
+	if tenant := tenantByHost(r.Host); tenant != nil && tenant != v.tenant {
+		return newAuthError("sid %v not in tenant %v", v.sid, tenant.id)
+	}
+	return nil
+}
+
+// Whether the principal is allowed to access the robot. The robot without access list is public, while
+// the private robot only allows the principal whose subject or groups is in the list, or any authenticated
+// principal if the list contains *.
+func (v *Robot) Allow(principal *Principal) bool {
+	if len(v.access) == 0 {
+		return true
+	}
+	if principal == nil {
+		return false
+	}
+
+	for _, allow := range v.access {
+		if allow == "*" || allow == principal.subject {
+			return true
+		}
+		for _, group := range principal.groups {
+			if allow == group {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sign the JWT by the header and claims, in HS256 if alg is HS256.
+func signJWT(alg, secret, claims string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":"%v","typ":"JWT"}`, alg))) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	secret, now := "secret", time.Now().Unix()
+
+	for _, c := range []struct {
+		name    string
+		token   string
+		subject string
+		groups  string
+		err     string
+	}{
+		{"valid", signJWT("HS256", secret, `{"sub":"alice"}`), "alice", "", ""},
+		{"groups", signJWT("HS256", secret, `{"sub":"alice","groups":["admin","dev"]}`), "alice", "admin,dev", ""},
+		{"in time", signJWT("HS256", secret, fmt.Sprintf(`{"sub":"alice","nbf":%v,"exp":%v}`, now-60, now+60)), "alice", "", ""},
+		{"expired", signJWT("HS256", secret, fmt.Sprintf(`{"sub":"alice","exp":%v}`, now-1)), "", "", "expired"},
+		{"not before", signJWT("HS256", secret, fmt.Sprintf(`{"sub":"alice","nbf":%v}`, now+60)), "", "", "not valid before"},
+		{"empty sub", signJWT("HS256", secret, `{"groups":["admin"]}`), "", "", "empty jwt sub"},
+		{"other secret", signJWT("HS256", "other", `{"sub":"alice"}`), "", "", "invalid jwt signature"},
+		{"alg none", strings.TrimRight(signJWT("none", secret, `{"sub":"alice"}`), "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"), "", "", "invalid jwt alg"},
+		{"alg HS512", signJWT("HS512", secret, `{"sub":"alice"}`), "", "", "invalid jwt alg"},
+		{"malformed", "a.b", "", "", "invalid jwt"},
+		{"bad claims", signJWT("HS256", secret, `not json`), "", "", "parse jwt claims"},
+	} {
+		principal, err := verifyJWT(c.token, secret)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%v: err %v, should contain %v", c.name, err, c.err)
+			}
+			if status := httpErrorStatus(err); status != http.StatusUnauthorized {
+				t.Fatalf("%v: status %v, should be 401", c.name, status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: err %v", c.name, err)
+		}
+		if principal.subject != c.subject || strings.Join(principal.groups, ",") != c.groups {
+			t.Fatalf("%v: principal %v, should be %v(%v)", c.name, principal, c.subject, c.groups)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	newAuth := func(envs map[string]string) *authConfig {
+		auth, err := authInit(context.Background(), func(key string) string { return envs[key] })
+		if err != nil {
+			t.Fatalf("auth, err %v", err)
+		}
+		return auth
+	}
+	open := newAuth(nil)
+	optional := newAuth(map[string]string{"AIT_API_TOKENS": "alice:sk-alice,sk-anonymous", "AIT_JWT_SECRET": "secret"})
+	required := newAuth(map[string]string{"AIT_API_TOKENS": "alice:sk-alice", "AIT_AUTH_REQUIRED": "true"})
+
+	for _, c := range []struct {
+		name    string
+		auth    *authConfig
+		header  string
+		query   string
+		subject string
+		err     bool
+	}{
+		{"disabled", open, "Bearer sk-any", "", "", false},
+		{"anonymous", optional, "", "", "", false},
+		{"static token", optional, "Bearer sk-alice", "", "alice", false},
+		{"static token in query", optional, "", "sk-alice", "alice", false},
+		{"token without subject", optional, "Bearer sk-anonymous", "", "token#1", false},
+		{"jwt", optional, "Bearer " + signJWT("HS256", "secret", `{"sub":"bob"}`), "", "bob", false},
+		{"invalid token", optional, "Bearer sk-bad", "", "", true},
+		{"required", required, "", "", "", true},
+		{"required with token", required, "Bearer sk-alice", "", "alice", false},
+	} {
+		u := "/api/ai-talk/start/"
+		if c.query != "" {
+			u = fmt.Sprintf("%v?auth=%v", u, c.query)
+		}
+		r := httptest.NewRequest(http.MethodPost, u, nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+
+		principal, err := c.auth.authenticate(r)
+		if c.err {
+			if err == nil || httpErrorStatus(err) != http.StatusUnauthorized {
+				t.Fatalf("%v: err %v, should be 401", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: err %v", c.name, err)
+		}
+		if c.subject == "" && principal != nil || c.subject != "" && (principal == nil || principal.subject != c.subject) {
+			t.Fatalf("%v: principal %v, should be %v", c.name, principal, c.subject)
+		}
+	}
+
+	if _, err := authInit(context.Background(), func(key string) string {
+		return map[string]string{"AIT_AUTH_REQUIRED": "true"}[key]
+	}); err == nil {
+		t.Fatalf("AIT_AUTH_REQUIRED should require tokens or jwt")
+	}
+}
+
+func TestRobotAllow(t *testing.T) {
+	public := &Robot{uuid: "public"}
+	private := &Robot{uuid: "private", access: []string{"alice", "admin"}}
+	authenticated := &Robot{uuid: "authenticated", access: []string{"*"}}
+	alice, bob := &Principal{subject: "alice"}, &Principal{subject: "bob"}
+	admin := &Principal{subject: "carol", groups: []string{"dev", "admin"}}
+
+	for _, c := range []struct {
+		robot     *Robot
+		principal *Principal
+		allow     bool
+	}{
+		{public, nil, true}, {public, bob, true},
+		{private, nil, false}, {private, alice, true}, {private, bob, false}, {private, admin, true},
+		{authenticated, nil, false}, {authenticated, bob, true},
+	} {
+		if allow := c.robot.Allow(c.principal); allow != c.allow {
+			t.Fatalf("robot %v allow %v, should be %v", c.robot.uuid, c.principal, c.allow)
+		}
+	}
+}
+
+// The private robots are hidden from the principal, and the robots is empty rather than null if all hidden.
+func TestStageStartRobots(t *testing.T) {
+	prices, err := NewPriceTable(func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("prices, err %v", err)
+	}
+	usageAccount = NewUsageAccount(prices)
+	talkServer = NewTalkServer(func(server *TalkServer) {
+		server.conf = &Config{StageTimeout: 300 * time.Second}
+	})
+	auth, err := authInit(context.Background(), func(key string) string {
+		return map[string]string{"AIT_API_TOKENS": "alice:sk-alice,bob:sk-bob"}[key]
+	})
+	if err != nil {
+		t.Fatalf("auth, err %v", err)
+	}
+	defaultTenant = &Tenant{id: "default", auth: auth, robots: []*Robot{
+		{uuid: "private", label: "Private", access: []string{"alice"}},
+	}}
+	defer func() {
+		talkServer, defaultTenant = nil, nil
+	}()
+
+	for _, c := range []struct {
+		token  string
+		robots string
+	}{
+		{"sk-alice", `[{"uuid":"private","label":"Private","voice":""}]`},
+		{"sk-bob", `[]`},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/ai-talk/start/", nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		if err := handleStageStart(context.Background(), w, r); err != nil {
+			t.Fatalf("start %v, err %v", c.token, err)
+		}
+
+		var res struct {
+			Data struct {
+				Robots json.RawMessage `json:"robots"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("parse %v, err %v", w.Body.String(), err)
+		}
+		if string(res.Data.Robots) != c.robots {
+			t.Fatalf("robots of %v is %v, should be %v", c.token, string(res.Data.Robots), c.robots)
+		}
+	}
+}
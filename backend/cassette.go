@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The mode of cassette, record or replay, empty to disable.
+var cassetteMode string
+
+// The directory of cassettes, a cassette for each turn in <dir>/<rid>/
+var cassetteDir string
+
+// Initialize the cassette by AIT_CASSETTE, which records or replays the HTTP traffic of providers, such
+// as ASR, chat and TTS. Note that it requires the work dir.
+func cassetteInit(ctx context.Context, conf *Config) error {
+	cassetteMode = conf.Cassette
+	if cassetteMode == "" {
+		return nil
+	}
+
+	if cassetteDir = conf.CassetteDir; cassetteDir == "" {
+		cassetteDir = path.Join(workDir, "cassettes")
+	}
+	if err := os.MkdirAll(cassetteDir, 0755); err != nil {
+		return errors.Wrapf(err, "create dir %v", cassetteDir)
+	}
+
+	// All providers use the default transport, such as the OpenAI client and http.DefaultClient, and
+	// only the requests with cassette in context are recorded or replayed. Note that the S3 storage uses
+	// its own transport, which is never recorded or replayed.
+	http.DefaultTransport = &cassetteTransport{base: http.DefaultTransport}
+
+	logger.Tf(ctx, "Cassette: mode=%v, dir=%v", cassetteMode, cassetteDir)
+	return nil
+}
+
+// The cassetteInteraction is a request and response of provider.
+type cassetteInteraction struct {
+	// The sequence of request in turn.
+	Seq    int    `json:"seq"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// The file of request body, and the SHA256 of body to match the request when replay.
+	RequestBody string `json:"requestBody"`
+	RequestHash string `json:"requestHash"`
+	// The status, headers and file of response body, the status is 0 if not done.
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	ResponseBody   string      `json:"responseBody,omitempty"`
+	// The error of request, for example, timeout.
+	Error string `json:"error,omitempty"`
+	// The elapsed time in seconds, from request to the end of response body.
+	Elapsed float64 `json:"elapsed"`
+
+	// Whether used when replay.
+	used bool
+}
+
+// The Cassette is the bundle of provider traffic of a turn, in a directory with cassette.json and the
+// files of bodies, and the input audio of user.
+type Cassette struct {
+	RID     string    `json:"rid"`
+	SID     string    `json:"sid"`
+	Robot   string    `json:"robot"`
+	Created time.Time `json:"created"`
+	// The requests and responses, in order of request.
+	Interactions []*cassetteInteraction `json:"interactions"`
+
+	// The directory of cassette.
+	dir string
+	// The lock to protect the interactions.
+	lock sync.Mutex
+}
+
+func NewCassette(opts ...func(*Cassette)) *Cassette {
+	v := &Cassette{Created: time.Now()}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Load the cassette to replay, the name is the rid of recorded turn.
+func LoadCassette(name string) (*Cassette, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, errors.Errorf("invalid cassette %v", name)
+	}
+
+	dir := path.Join(cassetteDir, name)
+	b, err := os.ReadFile(path.Join(dir, "cassette.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read cassette %v", dir)
+	}
+
+	v := NewCassette(func(v *Cassette) {
+		v.dir = dir
+	})
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, errors.Wrapf(err, "parse cassette %v", dir)
+	}
+	return v, nil
+}
+
+// Save the input audio of user, to upload it again when replay.
+func (v *Cassette) SaveInput(input []byte) error {
+	if err := os.MkdirAll(v.dir, 0755); err != nil {
+		return errors.Wrapf(err, "create dir %v", v.dir)
+	}
+	if err := os.WriteFile(path.Join(v.dir, "input.audio"), input, 0644); err != nil {
+		return errors.Wrapf(err, "write input")
+	}
+	return nil
+}
+
+// Begin to record a request, write the request body.
+func (v *Cassette) begin(req *http.Request, body []byte) (*cassetteInteraction, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	hash := sha256.Sum256(body)
+	interaction := &cassetteInteraction{
+		Seq: len(v.Interactions), Method: req.Method, URL: cassetteURL(req.URL),
+		RequestBody: fmt.Sprintf("%03d-request.bin", len(v.Interactions)), RequestHash: hex.EncodeToString(hash[:]),
+	}
+	v.Interactions = append(v.Interactions, interaction)
+
+	if err := os.MkdirAll(v.dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create dir %v", v.dir)
+	}
+	if err := os.WriteFile(path.Join(v.dir, interaction.RequestBody), body, 0644); err != nil {
+		return nil, errors.Wrapf(err, "write request")
+	}
+	return interaction, v.save()
+}
+
+// Finish the request, write the response body, or the error.
+func (v *Cassette) finish(
+	interaction *cassetteInteraction, resp *http.Response, body []byte, err error, start time.Time,
+) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	interaction.Elapsed = time.Since(start).Seconds()
+	if err != nil {
+		interaction.Error = err.Error()
+		return v.save()
+	}
+
+	interaction.Status, interaction.ResponseHeader = resp.StatusCode, resp.Header.Clone()
+	interaction.ResponseBody = fmt.Sprintf("%03d-response.bin", interaction.Seq)
+	if err := os.WriteFile(path.Join(v.dir, interaction.ResponseBody), body, 0644); err != nil {
+		return errors.Wrapf(err, "write response")
+	}
+	return v.save()
+}
+
+// Save the cassette.json, the caller should hold the lock.
+func (v *Cassette) save() error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal")
+	}
+	if err := os.WriteFile(path.Join(v.dir, "cassette.json"), b, 0644); err != nil {
+		return errors.Wrapf(err, "write cassette")
+	}
+	return nil
+}
+
+// Replay the response of request. Match the unused interaction with the same method, URL and request
+// body first, or the first unused one with the same method and URL, because the body might changes, for
+// example, the timestamp in request or the chat history.
+func (v *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	hash := sha256.Sum256(body)
+	u := cassetteURL(req.URL)
+
+	var matched *cassetteInteraction
+	for _, exact := range []bool{true, false} {
+		for _, interaction := range v.Interactions {
+			if interaction.used || interaction.Method != req.Method || interaction.URL != u {
+				continue
+			}
+			if exact && interaction.RequestHash != hex.EncodeToString(hash[:]) {
+				continue
+			}
+			if interaction.Status == 0 && interaction.Error == "" {
+				continue
+			}
+
+			matched = interaction
+			break
+		}
+		if matched != nil {
+			break
+		}
+	}
+	if matched == nil {
+		return nil, errors.Errorf("no interaction of %v %v in cassette %v", req.Method, u, v.RID)
+	}
+	matched.used = true
+
+	if matched.Error != "" {
+		return nil, errors.Errorf("replay %v", matched.Error)
+	}
+
+	b, err := os.ReadFile(path.Join(v.dir, matched.ResponseBody))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read response")
+	}
+
+	return &http.Response{
+		Status: fmt.Sprintf("%v %v", matched.Status, http.StatusText(matched.Status)), StatusCode: matched.Status,
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header: matched.ResponseHeader.Clone(), Body: io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)), Request: req,
+	}, nil
+}
+
+// The URL to match the request, without the query and user info, which might be secret.
+func cassetteURL(u *url.URL) string {
+	return fmt.Sprintf("%v://%v%v", u.Scheme, u.Host, u.Path)
+}
+
+type cassetteKey struct{}
+
+// Create a context with the cassette, the requests of providers in context are recorded or replayed.
+func withCassette(ctx context.Context, cassette *Cassette) context.Context {
+	return context.WithValue(ctx, cassetteKey{}, cassette)
+}
+
+func cassetteFromContext(ctx context.Context) *Cassette {
+	v, _ := ctx.Value(cassetteKey{}).(*Cassette)
+	return v
+}
+
+// The cassetteTransport records or replays the requests with cassette in context.
+type cassetteTransport struct {
+	base http.RoundTripper
+}
+
+func (v *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cassette := cassetteFromContext(req.Context())
+	if cassette == nil {
+		return v.base.RoundTrip(req)
+	}
+
+	// Read the request body, and restore it for the base transport.
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read request")
+		}
+
+		body = b
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if cassetteMode == "replay" {
+		return cassette.replay(req, body)
+	}
+
+	ctx := req.Context()
+	interaction, err := cassette.begin(req, body)
+	if err != nil {
+		logger.Wf(ctx, "Cassette: Record %v %v failed, err %v", req.Method, req.URL.Path, err)
+	}
+
+	start := time.Now()
+	resp, err := v.base.RoundTrip(req)
+	if interaction == nil {
+		return resp, err
+	}
+
+	if err != nil {
+		if r0 := cassette.finish(interaction, nil, nil, err, start); r0 != nil {
+			logger.Wf(ctx, "Cassette: Record %v %v failed, err %v", req.Method, req.URL.Path, r0)
+		}
+		return nil, err
+	}
+
+	// Record the response body when it's read, to never block the stream, such as the chat.
+	resp.Body = &cassetteBody{ReadCloser: resp.Body, onDone: func(b []byte) {
+		if err := cassette.finish(interaction, resp, b, nil, start); err != nil {
+			logger.Wf(ctx, "Cassette: Record %v %v failed, err %v", req.Method, req.URL.Path, err)
+		}
+	}}
+	return resp, nil
+}
+
+// The cassetteBody copies the response body when read, and notify when EOF or closed.
+type cassetteBody struct {
+	io.ReadCloser
+	// The body read.
+	body bytes.Buffer
+	// Notify once when EOF or closed.
+	onDone func(b []byte)
+	once   sync.Once
+}
+
+func (v *cassetteBody) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.body.Write(p[:n])
+	if err == io.EOF {
+		v.once.Do(func() {
+			v.onDone(v.body.Bytes())
+		})
+	}
+	return n, err
+}
+
+func (v *cassetteBody) Close() error {
+	v.once.Do(func() {
+		v.onDone(v.body.Bytes())
+	})
+	return v.ReadCloser.Close()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type ChatService interface {
+	// Request chat for the question of stage, the response is committed to the TTS worker in sentences.
+	RequestChat(ctx context.Context, rid string, stage *Stage, robot *Robot) error
+	// Get the source references of knowledge base for the answer.
+	Sources() []*KnowledgeMatch
+}
+
+// Create the chat service of robot, by the chat provider of robot.
+func NewChatService(stage *Stage, robot *Robot, onFirstResponse func(ctx context.Context, text string)) ChatService {
+	if robot.chatProvider == "ollama" {
+		return NewOllamaChatService(func(service *ollamaChatService) {
+			service.conf = stage.conf
+			service.aiConfig = stage.tenant.ollamaAIConfig
+			service.embeddingAIConfig = stage.tenant.embeddingAIConfig
+			service.onFirstResponse = onFirstResponse
+		})
+	}
+
+	return NewOpenAIChatService(func(service *openaiChatService) {
+		service.conf = stage.conf
+		service.aiConfig = stage.tenant.chatAIConfig
+		service.embeddingAIConfig = stage.tenant.embeddingAIConfig
+		service.onFirstResponse = onFirstResponse
+	})
+}
+
+// The chatTurn is the messages and options of a chat turn, for all chat providers.
+type chatTurn struct {
+	// The chat model.
+	model string
+	// The messages of system prompt, history and user question.
+	messages []openai.ChatCompletionMessage
+	// The max tokens of response.
+	maxTokens int
+	// The temperature.
+	temperature float32
+	// The matched documents of knowledge base.
+	sources []*KnowledgeMatch
+}
+
+// Prepare the chat turn for the question of stage, append the previous turn to history, build the
+// system prompt with summary and knowledge, and trim the history in the context length, 0 to use the
+// AIT_CHAT_CONTEXT_LENGTH or the context length of model. The summaryAIConfig and embeddingAIConfig is
+// the OpenAI compatible config for summary and knowledge.
+func prepareChatTurn(
+	ctx context.Context, conf *Config, rid string, stage *Stage, robot *Robot, contextLength int,
+	summaryAIConfig, embeddingAIConfig openai.ClientConfig,
+) (*chatTurn, error) {
+	question := stage.BeginChatTurn()
+
+	turn := &chatTurn{model: robot.chatModel}
+
+	system := robot.prompt
+	system += fmt.Sprintf(" Keep your reply neat, limiting the reply to %v words.", robot.replyLimit)
+	if conf.ChatSummary {
+		system = stage.summary.BuildSystemPrompt(system)
+	}
+	if robot.knowledge != nil {
+		// Never fail the chat if search failed, the robot could answer without documents.
+		if matches, tokens, err := robot.knowledge.Search(ctx, embeddingAIConfig, question); err != nil {
+			logger.Wf(ctx, "Knowledge: Ignore search err %+v", err)
+		} else {
+			usageAccount.Record(ctx, stage, robot, rid, &Usage{PromptTokens: tokens, model: robot.knowledge.model})
+			system = robot.knowledge.BuildSystemPrompt(system, matches)
+			turn.sources = matches
+		}
+	}
+	logger.Tf(ctx, "AI system prompt: %v", system)
+
+	turn.maxTokens, turn.temperature = conf.MaxTokens, float32(conf.Temperature)
+	if contextLength <= 0 {
+		contextLength = conf.ChatContextLength
+	}
+
+	// Build messages in the token budget of model, keep the pairs of history in chat window.
+	messages, dropped, err := buildChatMessages(
+		ctx, stage.histories, turn.model, system, question, turn.maxTokens, robot.chatWindow,
+		contextLength,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "build messages")
+	}
+	turn.messages = messages
+
+	// Summarize the dropped history into the summary memory, for the next turn.
+	if conf.ChatSummary && len(dropped) > 0 {
+		stage.summary.Summarize(ctx, conf, summaryAIConfig, stage, robot, rid, dropped)
+	}
+
+	return turn, nil
+}
+
+// The chatSentencer splits the streaming response of AI to sentences, and commits each sentence to
+// the TTS worker of stage.
+type chatSentencer struct {
+	ctx             context.Context
+	stage           *Stage
+	robot           *Robot
+	rid             string
+	onFirstResponse func(ctx context.Context, text string)
+
+	// The sentence not committed yet.
+	sentence string
+	// Whether the first sentence.
+	firstSentense bool
+	// Whether got the first token of response.
+	firstToken bool
+	// The time when chat started, and when the last sentence committed, for the spans of tracing.
+	started, lastCommit time.Time
+}
+
+func newChatSentencer(
+	ctx context.Context, stage *Stage, robot *Robot, rid string, onFirstResponse func(ctx context.Context, text string),
+) *chatSentencer {
+	// Measure from the start of chat request, if in the span of chat.
+	started := time.Now()
+	if span := spanFromContext(ctx); span != nil {
+		started = span.start
+	}
+
+	return &chatSentencer{
+		ctx: ctx, stage: stage, robot: robot, rid: rid, onFirstResponse: onFirstResponse, firstSentense: true,
+		started: started, lastCommit: started,
+	}
+}
+
+// Write the words of AI response, commit the sentence if got a new sentence or finished.
+func (v *chatSentencer) Write(words string, finished bool) {
+	if words != "" && !v.firstToken {
+		_, span := startSpan(v.ctx, "chat.first_token", withSpanStart(v.started))
+		span.End(nil)
+		v.firstToken = true
+	}
+
+	filteredStencese := strings.ReplaceAll(words, "\n\n", "\n")
+	filteredStencese = strings.ReplaceAll(filteredStencese, "\n", " ")
+	v.sentence += filteredStencese
+	//logger.Tf(ctx, "AI response: text=%v plus %v", filteredStencese, v.sentence)
+
+	newSentence := gotNewSentence(v.sentence, filteredStencese, v.firstSentense)
+	if !finished && !newSentence {
+		return
+	}
+
+	// Use the sentence for prompt and logging.
+	v.stage.OnAssistantSentence(v.sentence)
+	// Commit the sentense to TTS worker and callbacks.
+	v.commit(v.sentence, v.firstSentense)
+	// Reset the sentence, because we have committed it.
+	v.sentence, v.firstSentense = "", false
+}
+
+func (v *chatSentencer) commit(sentence string, firstSentense bool) {
+	ctx, stage, robot, rid := v.ctx, v.stage, v.robot, v.rid
+
+	filteredSentence := sentence
+	if strings.TrimSpace(sentence) == "" {
+		return
+	}
+
+	if firstSentense {
+		if robot.prefix != "" {
+			filteredSentence = fmt.Sprintf("%v %v", robot.prefix, filteredSentence)
+		}
+		if v.onFirstResponse != nil {
+			v.onFirstResponse(ctx, filteredSentence)
+		}
+	}
+
+	segment := NewAnswerSegment(func(segment *AnswerSegment) {
+		segment.rid = rid
+		segment.text = filteredSentence
+		segment.first = firstSentense
+		segment.robot = robot
+		segment.span = spanFromContext(ctx)
+	})
+	// The span of sentence, from the last sentence to this one.
+	_, span := startSpan(ctx, "chat.sentence", withSpanStart(v.lastCommit))
+	span.SetAttributes("asid", segment.asid, "first", firstSentense, "text.length", len(filteredSentence))
+	span.End(nil)
+	v.lastCommit = time.Now()
+
+	stage.ttsWorker.SubmitSegment(ctx, stage, segment)
+
+	logger.Tf(ctx, "TTS: Commit segment rid=%v, asid=%v, first=%v, sentence is %v",
+		rid, segment.asid, firstSentense, filteredSentence)
+}
+
+// Whether got a new sentence, by the punctuation in last words, and the length of sentence.
+func gotNewSentence(sentence, lastWords string, firstSentense bool) bool {
+	newSentence := false
+
+	isEnglish := func(s string) bool {
+		for _, r := range s {
+			if r > unicode.MaxASCII {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Ignore empty.
+	if sentence == "" {
+		return newSentence
+	}
+
+	// Any ASCII character to split sentence.
+	if strings.ContainsAny(lastWords, ",.?!\n") {
+		newSentence = true
+	}
+
+	// Any Chinese character to split sentence.
+	if strings.ContainsRune(lastWords, '。') ||
+		strings.ContainsRune(lastWords, '？') ||
+		strings.ContainsRune(lastWords, '！') ||
+		strings.ContainsRune(lastWords, '，') {
+		newSentence = true
+	}
+
+	// Badcase, for number such as 1.3, or 1,300,000.
+	var badcase bool
+	if match, _ := regexp.MatchString(`\d+(\.|,)\d*$`, sentence); match {
+		badcase, newSentence = true, false
+	}
+
+	// Determine whether new sentence by length.
+	if isEnglish(sentence) {
+		maxWords, minWords := 30, 3
+		if !firstSentense || badcase {
+			maxWords, minWords = 50, 5
+		}
+
+		if nn := strings.Count(sentence, " "); nn >= maxWords {
+			newSentence = true
+		} else if nn < minWords {
+			newSentence = false
+		}
+	} else {
+		maxWords, minWords := 50, 3
+		if !firstSentense || badcase {
+			maxWords, minWords = 100, 5
+		}
+
+		if nn := utf8.RuneCount([]byte(sentence)); nn >= maxWords {
+			newSentence = true
+		} else if nn < minWords {
+			newSentence = false
+		}
+	}
+
+	return newSentence
+}
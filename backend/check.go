@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The checkResult is the result of a check, such as the FFmpeg.
+type checkResult struct {
+	// The name of check.
+	name string
+	// The detail of check, such as the version of FFmpeg.
+	detail string
+	// The error if failed, nil for OK.
+	err error
+	// Whether only a warning, which never fails the startup, for example, the optional codecs.
+	warn bool
+}
+
+func (v *checkResult) Status() string {
+	if v.err == nil {
+		return "OK"
+	} else if v.warn {
+		return "WARN"
+	}
+	return "FAIL"
+}
+
+// Run the checks of settings, robots, FFmpeg and work dir, which fails at request time if misconfigured,
+// and probe the storage and endpoints of providers if probe.
+func runChecks(ctx context.Context, conf *Config, probe bool) []*checkResult {
+	type check struct {
+		name  string
+		warn  bool
+		check func(ctx context.Context) (string, error)
+	}
+
+	checks := []check{
+		{"settings", false, func(ctx context.Context) (string, error) {
+			return checkSettings(ctx, conf)
+		}},
+		{"workdir", false, checkWorkDir},
+		{"ffmpeg", false, checkFFmpeg},
+		{"ffmpeg.formats", true, checkFFmpegFormats},
+		{"ffprobe", true, checkFFprobe},
+	}
+	for _, tenant := range append([]*Tenant{defaultTenant}, tenants...) {
+		tenant := tenant
+		checks = append(checks, check{fmt.Sprintf("tenant.%v", tenant.id), false, func(ctx context.Context) (string, error) {
+			return checkTenant(ctx, tenant)
+		}})
+	}
+
+	if probe {
+		checks = append(checks, check{"probe.storage", false, probeStorage})
+		for _, tenant := range append([]*Tenant{defaultTenant}, tenants...) {
+			tenant := tenant
+			checks = append(checks, check{fmt.Sprintf("probe.%v", tenant.id), false, func(ctx context.Context) (string, error) {
+				return probeTenant(ctx, tenant)
+			}})
+		}
+	}
+
+	var results []*checkResult
+	for _, c := range checks {
+		detail, err := c.check(ctx)
+		results = append(results, &checkResult{name: c.name, detail: detail, err: err, warn: c.warn})
+	}
+	return results
+}
+
+// The preflight checks at startup by AIT_PREFLIGHT, which is on by default, probe to also probe the
+// providers, or off to disable. Fail if any check failed, and log the warnings.
+func preflight(ctx context.Context, conf *Config) error {
+	mode := conf.Preflight
+	if mode == "off" {
+		return nil
+	}
+
+	var failed []string
+	for _, r := range runChecks(ctx, conf, mode == "probe") {
+		if r.err == nil {
+			logger.Tf(ctx, "Preflight: %v ok, %v", r.name, r.detail)
+		} else if r.warn {
+			logger.Wf(ctx, "Preflight: %v warn, %v", r.name, r.err)
+		} else {
+			logger.Ef(ctx, "Preflight: %v failed, %v", r.name, r.err)
+			failed = append(failed, r.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("failed %v, run the check subcommand for details", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// Check the settings and robots, for example:
+//
+//	go run . check --probe
+func doCheck(ctx context.Context, args []string) error {
+	var probe bool
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.BoolVar(&probe, "probe", false, "Probe the storage and endpoints of providers")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+
+	conf, err := cliInit(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "init")
+	}
+
+	var failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tCHECK\tDETAIL")
+	for _, r := range runChecks(ctx, conf, probe) {
+		detail := r.detail
+		if r.err != nil {
+			detail = r.err.Error()
+		}
+		if r.Status() == "FAIL" {
+			failed++
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", r.Status(), r.name, detail)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("%v checks failed", failed)
+	}
+	return nil
+}
+
+// Check the settings, the config is validated when loaded, including the default settings of tenant.
+func checkSettings(ctx context.Context, conf *Config) (string, error) {
+	if err := conf.Validate(); err != nil {
+		return "", errors.Wrapf(err, "config")
+	}
+
+	return fmt.Sprintf("file=%v, max_tokens=%v, temperature=%v", conf.File, conf.MaxTokens, conf.Temperature), nil
+}
+
+// Check the work dir is writable, for the spilled audio and temporary files.
+func checkWorkDir(ctx context.Context) (string, error) {
+	f, err := os.CreateTemp(workDir, "assistant-*-check")
+	if err != nil {
+		return "", errors.Wrapf(err, "create temp in %v", workDir)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write([]byte("check")); err != nil {
+		return "", errors.Wrapf(err, "write %v", f.Name())
+	}
+	return workDir, nil
+}
+
+// Get the version of FFmpeg or FFprobe, the first line of -version.
+func ffmpegVersion(ctx context.Context, binary string) (string, error) {
+	b, err := exec.CommandContext(ctx, binary, "-version").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "exec %v", binary)
+	}
+	version, _, _ := strings.Cut(string(b), "\n")
+	return strings.TrimSpace(version), nil
+}
+
+// Get the codecs of FFmpeg, the kind is encoders or decoders.
+func ffmpegCodecs(ctx context.Context, kind string) (map[string]bool, error) {
+	b, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", fmt.Sprintf("-%v", kind)).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "exec ffmpeg -%v", kind)
+	}
+
+	// Each line is flags, name and description, for example, " A....D flac    FLAC", after the legend
+	// which ends with a line of dashes.
+	codecs := make(map[string]bool)
+	_, list, _ := strings.Cut(string(b), "------")
+	for _, line := range strings.Split(list, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			codecs[fields[1]] = true
+		}
+	}
+	return codecs, nil
+}
+
+// Check the FFmpeg and the codecs of ASR, which transcodes the input audio in aac or opus to FLAC or PCM.
+func checkFFmpeg(ctx context.Context) (string, error) {
+	version, err := ffmpegVersion(ctx, "ffmpeg")
+	if err != nil {
+		return "", errors.Wrapf(err, "ffmpeg is required to transcode audio")
+	}
+
+	decoders, err := ffmpegCodecs(ctx, "decoders")
+	if err != nil {
+		return "", err
+	}
+	if !decoders["aac"] {
+		return "", errors.Errorf("no aac decoder, %v", version)
+	}
+	if !decoders["opus"] && !decoders["libopus"] {
+		return "", errors.Errorf("no opus decoder, %v", version)
+	}
+
+	encoders, err := ffmpegCodecs(ctx, "encoders")
+	if err != nil {
+		return "", err
+	}
+	for _, codec := range []string{"flac", "pcm_s16le"} {
+		if !encoders[codec] {
+			return "", errors.Errorf("no %v encoder, %v", codec, version)
+		}
+	}
+	return version, nil
+}
+
+// Check the encoders of TTS formats, the format without encoder fails when requested by client.
+func checkFFmpegFormats(ctx context.Context) (string, error) {
+	encoders, err := ffmpegCodecs(ctx, "encoders")
+	if err != nil {
+		return "", err
+	}
+
+	var formats, missing []string
+	for format, f := range ttsFormats {
+		for i := 0; i+1 < len(f.args); i++ {
+			if f.args[i] == "-c:a" && !encoders[f.args[i+1]] {
+				missing = append(missing, fmt.Sprintf("%v(%v)", format, f.args[i+1]))
+			}
+		}
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	sort.Strings(missing)
+
+	if len(missing) > 0 {
+		return "", errors.Errorf("no encoder for formats %v", strings.Join(missing, ","))
+	}
+	return strings.Join(formats, ","), nil
+}
+
+// Check the FFprobe, which is optional for server, but useful to debug the audio.
+func checkFFprobe(ctx context.Context) (string, error) {
+	return ffmpegVersion(ctx, "ffprobe")
+}
+
+// Check the robots and providers of tenant, such as the Tencent AppID and the binaries of local providers.
+func checkTenant(ctx context.Context, tenant *Tenant) (string, error) {
+	if len(tenant.robots) == 0 {
+		return "", errors.Errorf("no robots")
+	}
+
+	robots := make(map[string]bool)
+	for _, robot := range tenant.robots {
+		if robots[robot.uuid] {
+			return "", errors.Errorf("duplicated robot %v", robot.uuid)
+		}
+		robots[robot.uuid] = true
+
+		if robot.chatModel == "" {
+			return "", errors.Errorf("no chat model of robot %v", robot.uuid)
+		}
+		if robot.replyLimit < 0 || robot.chatWindow < unlimitedChatWindow {
+			return "", errors.Errorf("invalid reply limit %v or chat window %v of robot %v",
+				robot.replyLimit, robot.chatWindow, robot.uuid)
+		}
+	}
+
+	if tencent := tenant.tencentAIConfig; tencent.AppID != "" {
+		if _, err := strconv.ParseInt(tencent.AppID, 10, 64); err != nil {
+			return "", errors.Errorf("invalid TENCENT_SPEECH_APPID %v, should be integer", tencent.AppID)
+		}
+		if tencent.SecretID == "" || tencent.SecretKey == "" {
+			return "", errors.Errorf("TENCENT_SECRET_ID and TENCENT_SECRET_KEY are required for Tencent")
+		}
+	}
+
+	var asr, tts string
+	switch service := tenant.asrService.(type) {
+	case *openaiASRService:
+		asr = "openai"
+	case *tencentASRService:
+		asr = "tencent"
+	case *whisperASRService:
+		asr = "whisper"
+		if service.aiConfig.Server == "" {
+			if _, err := exec.LookPath(service.aiConfig.Binary); err != nil {
+				return "", errors.Wrapf(err, "whisper.cpp binary %v", service.aiConfig.Binary)
+			}
+			if _, err := os.Stat(service.aiConfig.Model); err != nil {
+				return "", errors.Wrapf(err, "whisper.cpp model %v", service.aiConfig.Model)
+			}
+		}
+	}
+
+	switch service := tenant.ttsService.(type) {
+	case *openaiTTSService:
+		tts = "openai"
+	case *tencentTTSService:
+		tts = "tencent"
+	case *localTTSService:
+		tts = service.aiConfig.Engine
+		if _, err := exec.LookPath(service.aiConfig.Binary); err != nil {
+			return "", errors.Wrapf(err, "%v binary %v", tts, service.aiConfig.Binary)
+		}
+		if tts == "piper" {
+			if _, err := os.Stat(service.aiConfig.Voice); err != nil {
+				return "", errors.Wrapf(err, "piper model %v", service.aiConfig.Voice)
+			}
+		}
+	}
+
+	return fmt.Sprintf("robots=%v, asr=%v, tts=%v", len(tenant.robots), asr, tts), nil
+}
+
+// Probe the storage, by put, get and remove a small object.
+func probeStorage(ctx context.Context) (string, error) {
+	key := fmt.Sprintf("assistant-%v-check", uuid.NewString())
+	if err := audioStorage.Put(ctx, key, strings.NewReader("check"), 5, "text/plain"); err != nil {
+		return "", errors.Wrapf(err, "put %v", key)
+	}
+	defer audioStorage.Remove(ctx, key)
+
+	reader, err := audioStorage.Get(ctx, key)
+	if err != nil {
+		return "", errors.Wrapf(err, "get %v", key)
+	}
+	defer reader.Close()
+
+	if b, err := io.ReadAll(reader); err != nil {
+		return "", errors.Wrapf(err, "read %v", key)
+	} else if string(b) != "check" {
+		return "", errors.Errorf("corrupt %v, got %v", key, string(b))
+	}
+	return fmt.Sprintf("shared=%v", audioStorage.Shared()), nil
+}
+
+// Probe the endpoints of providers used by tenant, for example, list the models of OpenAI. Note that
+// the Tencent is not probed, because it has no API without cost.
+func probeTenant(ctx context.Context, tenant *Tenant) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// The OpenAI configs to probe, by the base URL.
+	configs := make(map[string]openai.ClientConfig)
+	for _, robot := range tenant.robots {
+		if robot.chatProvider == "openai" {
+			configs[tenant.chatAIConfig.BaseURL] = tenant.chatAIConfig
+		}
+	}
+	if _, ok := tenant.asrService.(*openaiASRService); ok {
+		configs[tenant.asrAIConfig.BaseURL] = tenant.asrAIConfig
+	}
+	if _, ok := tenant.ttsService.(*openaiTTSService); ok {
+		configs[tenant.ttsAIConfig.BaseURL] = tenant.ttsAIConfig
+	}
+
+	var probed []string
+	for base, config := range configs {
+		if _, err := openai.NewClientWithConfig(config).ListModels(ctx); err != nil {
+			return "", errors.Wrapf(err, "list models of %v", base)
+		}
+		probed = append(probed, base)
+	}
+
+	var ollamaModels []string
+	for _, robot := range tenant.robots {
+		if robot.chatProvider == "ollama" {
+			ollamaModels = append(ollamaModels, robot.chatModel)
+		}
+	}
+	if len(ollamaModels) > 0 {
+		if err := tenant.ollamaAIConfig.CheckModels(ctx, ollamaModels); err != nil {
+			return "", errors.Wrapf(err, "ollama")
+		}
+		probed = append(probed, tenant.ollamaAIConfig.Host)
+	}
+
+	if service, ok := tenant.asrService.(*whisperASRService); ok && service.aiConfig.Server != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, service.aiConfig.Server, nil)
+		if err != nil {
+			return "", errors.Wrapf(err, "create request %v", service.aiConfig.Server)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", errors.Wrapf(err, "whisper.cpp server %v", service.aiConfig.Server)
+		}
+		resp.Body.Close()
+		probed = append(probed, service.aiConfig.Server)
+	}
+
+	sort.Strings(probed)
+	return strings.Join(probed, ","), nil
+}
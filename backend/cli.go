@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The commands of CLI, to talk with the robots without browser, for example:
+//
+//	go run . ask --robot default hello.aac
+//	go run . chat --robot default
+//	go run . robots
+//	go run . load --stages 10 example.aac
+//	go run . check --probe
+var cliCommands = map[string]func(ctx context.Context, args []string) error{
+	"ask":    doAsk,
+	"chat":   doChat,
+	"robots": doRobots,
+	"load":   doLoad,
+	"check":  doCheck,
+}
+
+// The formats of reply audio for ask, which could be concatenated sentence by sentence.
+var cliAskFormats = []string{"aac", "aac-low", "mp3", "mp3-low", "ogg"}
+
+// Initialize the config and storage for CLI, like the server. The logs are warn level by default, to
+// keep the output clean, set AIT_LOG_LEVEL to see more.
+func cliInit(ctx context.Context) (*Config, error) {
+	conf, err := doConfig(ctx, nil, map[string]string{"AIT_LOG_LEVEL": "warn"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "config")
+	}
+
+	if pwd, err := os.Getwd(); err != nil {
+		return nil, errors.Wrapf(err, "getwd")
+	} else {
+		workDir = pwd
+	}
+
+	if err := storageInit(ctx, conf); err != nil {
+		return nil, errors.Wrapf(err, "storage")
+	}
+
+	if tracer != nil {
+		go tracer.Run(ctx)
+	}
+	return conf, nil
+}
+
+// Create a stage of CLI for the robot, which is not managed by the talk server.
+func newCLIStage(ctx context.Context, conf *Config, tenantID, robotID string, textOnly bool) (*Stage, *Robot, error) {
+	tenant := tenantByID(tenantID)
+	if tenant == nil {
+		return nil, nil, errors.Errorf("invalid tenant %v", tenantID)
+	}
+
+	robot := tenant.GetRobot(robotID)
+	if robot == nil {
+		return nil, nil, errors.Errorf("invalid robot %v of tenant %v", robotID, tenantID)
+	}
+
+	stage := NewStage(func(stage *Stage) {
+		stage.loggingCtx = withLogFields(logger.WithContext(ctx), "sid", stage.sid, "robot", robot.uuid)
+		stage.tenant, stage.conf = tenant, conf
+		stage.ttsWorker.textOnly = textOnly
+	})
+	stage.OnStartConversation()
+	return stage, robot, nil
+}
+
+// Close the stage of CLI, after cancel the ctx to quit the goroutines of segments, then remove the files
+// of stage and export the remaining spans.
+func closeCLIStage(ctx context.Context, cancel context.CancelFunc, stage *Stage) {
+	cancel()
+	stage.Close()
+
+	closeCtx, closeCancel := context.WithTimeout(withoutCancel(ctx), 10*time.Second)
+	defer closeCancel()
+
+	stage.RemoveFiles(closeCtx)
+	if tracer != nil {
+		tracer.Close(closeCtx)
+	}
+}
+
+// Do the chat of turn, the question is the ASR text of stage, and consume the sentences in order by the
+// onSentence, until all sentences are done.
+func cliChatTurn(
+	ctx context.Context, stage *Stage, robot *Robot, rid string, onSentence func(segment *AnswerSegment) error,
+) error {
+	// Mark generating before chat, so that the query waits for the first sentence, like the dummy sentence
+	// of upload, which is never removed if AI responses nothing.
+	stage.SetGenerating(true)
+
+	chatService := NewChatService(stage, robot, func(ctx context.Context, text string) {
+		stage.OnFirstChat(text)
+	})
+	if err := chatService.RequestChat(ctx, rid, stage, robot); err != nil {
+		stage.SetGenerating(false)
+		return errors.Wrapf(err, "chat")
+	}
+
+	for {
+		segment := stage.ttsWorker.QueryAnyReadySegment(ctx, stage, rid)
+		if segment == nil {
+			return ctx.Err()
+		}
+
+		err := segment.Err()
+		if err == nil {
+			err = onSentence(segment)
+		}
+
+		// Remove the segment and its audio, like the client removes it after played.
+		stage.ttsWorker.RemoveSegment(ctx, stage, segment.asid)
+		select {
+		case segment.removeSignal <- true:
+		default:
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "sentence %v", segment.asid)
+		}
+	}
+}
+
+// Run a turn of the question audio file, write the reply audio and text, for example:
+//
+//	go run . ask --robot default --output reply.aac hello.aac
+func doAsk(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var tenantID, robotID, format, output string
+	fs := flag.NewFlagSet("ask", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "default", "The tenant of robot")
+	fs.StringVar(&robotID, "robot", "default", "The robot to ask")
+	fs.StringVar(&format, "format", "aac", fmt.Sprintf("The format of reply audio, %v", strings.Join(cliAskFormats, ",")))
+	fs.StringVar(&output, "output", "", "The reply audio file, default to reply.<format>, and the text in .txt")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v ask [options] <question audio file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("no question audio file")
+	}
+
+	var ext string
+	for _, f := range cliAskFormats {
+		if f == format {
+			ext = ttsFormats[f].ext
+		}
+	}
+	if ext == "" {
+		return errors.Errorf("invalid format %v, should be %v", format, strings.Join(cliAskFormats, ","))
+	}
+	if output == "" {
+		output = fmt.Sprintf("reply.%v", ext)
+	}
+
+	input, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return errors.Wrapf(err, "read %v", fs.Arg(0))
+	}
+
+	conf, err := cliInit(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "init")
+	}
+
+	stage, robot, err := newCLIStage(ctx, conf, tenantID, robotID, false)
+	if err != nil {
+		return errors.Wrapf(err, "stage")
+	}
+	defer closeCLIStage(ctx, cancel, stage)
+
+	rid := uuid.NewString()
+	ctx = withLogFields(stage.loggingCtx, "rid", rid, "step", "asr")
+	ctx, span := startSpan(ctx, "turn")
+	span.SetAttributes("sid", stage.sid, "rid", rid, "robot", robot.uuid, "tenant", stage.tenant.id)
+	stage.OnUploadAudio()
+
+	resp, err := stage.tenant.asrService.RequestASR(ctx, input, robot.asrLanguage, "", func() {
+		stage.OnExtractAudio()
+	})
+	if err != nil {
+		return span.End(errors.Wrapf(err, "transcription"))
+	}
+	asrText := strings.TrimSpace(resp.Text)
+	if asrText == "" {
+		return span.End(errors.New("empty asr"))
+	}
+	stage.OnASR(asrText, resp.Duration)
+	usageAccount.Record(ctx, stage, robot, rid, &Usage{ASRSeconds: resp.Duration.Seconds()})
+	fmt.Printf("You: %v\n", asrText)
+
+	f, err := os.Create(output)
+	if err != nil {
+		return span.End(errors.Wrapf(err, "create %v", output))
+	}
+	defer f.Close()
+
+	// Write the audio of sentences to the output one by one, which are playable as a whole.
+	var texts []string
+	ctx = withLogFields(ctx, "step", "chat")
+	if err := cliChatTurn(ctx, stage, robot, rid, func(segment *AnswerSegment) error {
+		fmt.Printf("Bot: %v\n", strings.TrimSpace(segment.text))
+		texts = append(texts, strings.TrimSpace(segment.text))
+
+		audio, _, err := segment.TTSAudioOf(ctx, format)
+		if err != nil {
+			return errors.Wrapf(err, "format")
+		}
+
+		reader, err := audio.Open(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "open tts")
+		}
+		defer reader.Close()
+
+		if _, err := io.Copy(f, reader); err != nil {
+			return errors.Wrapf(err, "write %v", output)
+		}
+		return nil
+	}); err != nil {
+		return span.End(errors.Wrapf(err, "turn"))
+	}
+
+	textFile := fmt.Sprintf("%v.txt", strings.TrimSuffix(output, path.Ext(output)))
+	if err := os.WriteFile(textFile, []byte(strings.Join(texts, " ")+"\n"), 0644); err != nil {
+		return span.End(errors.Wrapf(err, "write %v", textFile))
+	}
+
+	fmt.Printf("Reply audio %v, text %v\n", output, textFile)
+	return span.End(nil)
+}
+
+// Chat with the robot in text, line by line from stdin, with the same history and summary of stage. The
+// TTS is never requested.
+func doChat(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var tenantID, robotID string
+	fs := flag.NewFlagSet("chat", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "default", "The tenant of robot")
+	fs.StringVar(&robotID, "robot", "default", "The robot to chat with")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+
+	conf, err := cliInit(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "init")
+	}
+
+	stage, robot, err := newCLIStage(ctx, conf, tenantID, robotID, true)
+	if err != nil {
+		return errors.Wrapf(err, "stage")
+	}
+	defer closeCLIStage(ctx, cancel, stage)
+
+	fmt.Printf("Chat with %v(%v), Ctrl+D to quit.\n", robot.label, robot.uuid)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("You: ")
+		if !scanner.Scan() {
+			break
+		}
+
+		question := strings.TrimSpace(scanner.Text())
+		if question == "" {
+			continue
+		}
+
+		// The question is the ASR text of turn, so the chat pipeline is the same as audio.
+		rid := uuid.NewString()
+		ctx := withLogFields(stage.loggingCtx, "rid", rid, "step", "chat")
+		stage.OnASR(question, 0)
+
+		if err := cliChatTurn(ctx, stage, robot, rid, func(segment *AnswerSegment) error {
+			if segment.first {
+				fmt.Print("Bot: ")
+			}
+			fmt.Printf("%v ", strings.TrimSpace(segment.text))
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "turn")
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "read stdin")
+	}
+	return nil
+}
+
+// List the robots of all tenants.
+func doRobots(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("robots", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+
+	if _, err := cliInit(ctx); err != nil {
+		return errors.Wrapf(err, "init")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tID\tLABEL\tASR\tPROVIDER\tMODEL\tACCESS")
+	for _, tenant := range append([]*Tenant{defaultTenant}, tenants...) {
+		for _, robot := range tenant.robots {
+			access := "public"
+			if len(robot.access) > 0 {
+				access = strings.Join(robot.access, ",")
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", tenant.id, robot.uuid, robot.label,
+				robot.asrLanguage, robot.chatProvider, robot.chatModel, access)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/sashabaranov/go-openai"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Config is the typed settings of server, loaded once at startup by loadConfig from the flags, the
+// env and the config file, in the precedence of flags > env > config file > defaults, and passed to the
+// services when created. Note that the other settings of tenant, such as the robots and the keys of
+// providers, are read by Getenv, see NewTenant.
+type Config struct {
+	// The config file in env format, empty if not used.
+	File string
+	// The env of config file, for the settings which are not typed.
+	env map[string]string
+
+	// The HTTP and HTTPS listen port or address.
+	HTTPListen  string
+	HTTPSListen string
+	// Whether proxy the static files to the React dev server at 3000.
+	ProxyStatic bool
+	// Whether in development, the stage expires in 30s.
+	Development bool
+	// Whether keep the files for debugging, such as the input audio and TTS.
+	KeepFiles bool
+	// The timeout of stage if not kept alive, and the max time to drain the turns when shutdown.
+	StageTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	// The max number of live stages, 0 for unlimited.
+	MaxLiveStages int
+	// The max bytes of audio in memory, spill to disk if exceed.
+	AudioMemoryLimit int
+
+	// The max tokens and temperature of chat.
+	MaxTokens   int
+	Temperature float64
+	// The context length of chat model, 0 to use the context length of model.
+	ChatContextLength int
+	// Whether enable the summary memory, and the model and max tokens of summary.
+	ChatSummary      bool
+	SummaryModel     string
+	SummaryMaxTokens int
+	// The models and voice of OpenAI ASR and TTS.
+	ASRModel string
+	TTSModel string
+	TTSVoice string
+	// The file of HTTP tools.
+	ToolsFile string
+
+	// The settings of default tenant, which are also inherited by tenants if not set.
+	OpenAIAPIKey string
+	OpenAIProxy  string
+	SystemPrompt string
+	ChatModel    string
+	ASRLanguage  string
+	ReplyPrefix  string
+	ReplyLimit   int
+	ChatWindow   int
+	DefaultRobot bool
+	// The directory of tenant env files, empty to disable.
+	TenantsDir string
+
+	// The level and format of logs.
+	LogLevel  string
+	LogFormat string
+	// The preflight check at startup, on, probe or off.
+	Preflight string
+	// The Redis to share stages, empty to disable.
+	Redis string
+	// The mode and directory of cassette, to record or replay the traffic of providers.
+	Cassette    string
+	CassetteDir string
+
+	// The storage of audio, local or s3, and the settings of storage.
+	Storage        string
+	StorageDir     string
+	StoragePrefix  string
+	StorageQuota   int64
+	StoragePresign time.Duration
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3PathStyle    bool
+}
+
+// The configField maps a field of Config to the env, which is also the key of config file, and the flag.
+type configField struct {
+	// The env key, for example, AIT_HTTP_LISTEN, and the flag is http-listen. The key which is not
+	// prefixed by AIT_ is the same, for example, OPENAI_PROXY is openai-proxy.
+	env string
+	// The default value.
+	value string
+	// Whether secret, which has no flag and only the length is printed.
+	secret bool
+	// The usage of flag.
+	usage string
+	// The pointer to field, a string, bool, int, int64, float64 or time.Duration in seconds.
+	field func(v *Config) interface{}
+}
+
+// The flag name of field, for example, http-listen for AIT_HTTP_LISTEN.
+func (v *configField) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(v.env, "AIT_")), "_", "-")
+}
+
+// Parse the value to the field of config.
+func (v *configField) parse(c *Config, value string) error {
+	switch p := v.field(c).(type) {
+	case *string:
+		*p = value
+	case *bool:
+		if value != "true" && value != "false" {
+			return errors.Errorf("should be true or false")
+		}
+		*p = value == "true"
+	case *int:
+		iv, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse int")
+		}
+		*p = int(iv)
+	case *int64:
+		iv, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse int")
+		}
+		*p = iv
+	case *float64:
+		fv, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse float")
+		}
+		*p = fv
+	case *time.Duration:
+		iv, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse seconds")
+		}
+		*p = time.Duration(iv) * time.Second
+	}
+	return nil
+}
+
+// Get the value of field in string, which could be parsed again.
+func (v *configField) get(c *Config) string {
+	var value string
+	switch p := v.field(c).(type) {
+	case *time.Duration:
+		value = strconv.FormatInt(int64(*p/time.Second), 10)
+	case *string:
+		value = *p
+	case *bool:
+		value = strconv.FormatBool(*p)
+	case *int:
+		value = strconv.Itoa(*p)
+	case *int64:
+		value = strconv.FormatInt(*p, 10)
+	case *float64:
+		value = strconv.FormatFloat(*p, 'f', -1, 64)
+	}
+	return value
+}
+
+// Format the field of config, the secret is in length.
+func (v *configField) format(c *Config) string {
+	if v.secret {
+		return fmt.Sprintf("%vB", len(v.get(c)))
+	}
+	return v.get(c)
+}
+
+// The fields of config, in the order of printing.
+var configFields = []*configField{
+	{env: "AIT_HTTP_LISTEN", value: "3001", usage: "The HTTP listen port or address",
+		field: func(v *Config) interface{} { return &v.HTTPListen }},
+	{env: "AIT_HTTPS_LISTEN", value: "3443", usage: "The HTTPS listen port or address",
+		field: func(v *Config) interface{} { return &v.HTTPSListen }},
+	{env: "AIT_PROXY_STATIC", value: "true", usage: "Whether proxy the static files to React dev server",
+		field: func(v *Config) interface{} { return &v.ProxyStatic }},
+	{env: "AIT_DEVELOPMENT", value: "true", usage: "Whether in development, the stage expires in 30s",
+		field: func(v *Config) interface{} { return &v.Development }},
+	{env: "AIT_KEEP_FILES", value: "false", usage: "Whether keep the files for debugging",
+		field: func(v *Config) interface{} { return &v.KeepFiles }},
+	{env: "AIT_STAGE_TIMEOUT", value: "300", usage: "The seconds of stage timeout if not kept alive",
+		field: func(v *Config) interface{} { return &v.StageTimeout }},
+	{env: "AIT_SHUTDOWN_TIMEOUT", value: "30", usage: "The max seconds to wait for turns when shutdown",
+		field: func(v *Config) interface{} { return &v.ShutdownTimeout }},
+	{env: "AIT_MAX_LIVE_STAGES", value: "0", usage: "The max number of live stages, 0 for unlimited",
+		field: func(v *Config) interface{} { return &v.MaxLiveStages }},
+	{env: "AIT_AUDIO_MEMORY_LIMIT", value: strconv.Itoa(defaultAudioMemoryLimit), usage: "The max bytes of audio in memory",
+		field: func(v *Config) interface{} { return &v.AudioMemoryLimit }},
+	{env: "AIT_MAX_TOKENS", value: "1024", usage: "The max tokens of chat",
+		field: func(v *Config) interface{} { return &v.MaxTokens }},
+	{env: "AIT_TEMPERATURE", value: "0.9", usage: "The temperature of chat, 0 to 2",
+		field: func(v *Config) interface{} { return &v.Temperature }},
+	{env: "AIT_CHAT_CONTEXT_LENGTH", value: "0", usage: "The context length of chat model, 0 to use the model's",
+		field: func(v *Config) interface{} { return &v.ChatContextLength }},
+	{env: "AIT_CHAT_SUMMARY", value: "false", usage: "Whether summarize the dropped history",
+		field: func(v *Config) interface{} { return &v.ChatSummary }},
+	{env: "AIT_SUMMARY_MODEL", value: "", usage: "The model of summary, default to the chat model of robot",
+		field: func(v *Config) interface{} { return &v.SummaryModel }},
+	{env: "AIT_SUMMARY_MAX_TOKENS", value: "256", usage: "The max tokens of summary",
+		field: func(v *Config) interface{} { return &v.SummaryMaxTokens }},
+	{env: "AIT_ASR_MODEL", value: openai.Whisper1, usage: "The model of OpenAI ASR",
+		field: func(v *Config) interface{} { return &v.ASRModel }},
+	{env: "AIT_TTS_MODEL", value: string(openai.TTSModel1), usage: "The model of OpenAI TTS",
+		field: func(v *Config) interface{} { return &v.TTSModel }},
+	{env: "AIT_TTS_VOICE", value: string(openai.VoiceNova), usage: "The default voice of OpenAI TTS",
+		field: func(v *Config) interface{} { return &v.TTSVoice }},
+	{env: "AIT_TOOLS_FILE", value: "", usage: "The JSON file of HTTP tools",
+		field: func(v *Config) interface{} { return &v.ToolsFile }},
+	{env: "OPENAI_API_KEY", value: "", secret: true,
+		field: func(v *Config) interface{} { return &v.OpenAIAPIKey }},
+	{env: "OPENAI_PROXY", value: "https://api.openai.com/v1", usage: "The OpenAI API proxy",
+		field: func(v *Config) interface{} { return &v.OpenAIProxy }},
+	{env: "AIT_SYSTEM_PROMPT", value: "You are a helpful assistant.", usage: "The system prompt of default robot",
+		field: func(v *Config) interface{} { return &v.SystemPrompt }},
+	{env: "AIT_CHAT_MODEL", value: openai.GPT4TurboPreview, usage: "The chat model of robots",
+		field: func(v *Config) interface{} { return &v.ChatModel }},
+	{env: "AIT_ASR_LANGUAGE", value: "en", usage: "The ASR language of robots",
+		field: func(v *Config) interface{} { return &v.ASRLanguage }},
+	{env: "AIT_REPLY_PREFIX", value: "", usage: "The prefix of short reply for TTS",
+		field: func(v *Config) interface{} { return &v.ReplyPrefix }},
+	{env: "AIT_REPLY_LIMIT", value: "30", usage: "The reply limit words of robots",
+		field: func(v *Config) interface{} { return &v.ReplyLimit }},
+	{env: "AIT_CHAT_WINDOW", value: "5", usage: "The max pairs of history of robots",
+		field: func(v *Config) interface{} { return &v.ChatWindow }},
+	{env: "AIT_DEFAULT_ROBOT", value: "true", usage: "Whether enable the default robot",
+		field: func(v *Config) interface{} { return &v.DefaultRobot }},
+	{env: "AIT_TENANTS_DIR", value: "", usage: "The directory of tenant env files",
+		field: func(v *Config) interface{} { return &v.TenantsDir }},
+	{env: "AIT_LOG_LEVEL", value: "trace", usage: "The min level of logs, info, trace, warn or error",
+		field: func(v *Config) interface{} { return &v.LogLevel }},
+	{env: "AIT_LOG_FORMAT", value: "text", usage: "The format of logs, text or json",
+		field: func(v *Config) interface{} { return &v.LogFormat }},
+	{env: "AIT_PREFLIGHT", value: "on", usage: "The preflight check at startup, on, probe or off",
+		field: func(v *Config) interface{} { return &v.Preflight }},
+	{env: "AIT_REDIS", value: "", secret: true,
+		field: func(v *Config) interface{} { return &v.Redis }},
+	{env: "AIT_CASSETTE", value: "", usage: "The mode of cassette, record or replay",
+		field: func(v *Config) interface{} { return &v.Cassette }},
+	{env: "AIT_CASSETTE_DIR", value: "", usage: "The directory of cassettes, default to cassettes in work dir",
+		field: func(v *Config) interface{} { return &v.CassetteDir }},
+	{env: "AIT_STORAGE", value: "local", usage: "The storage of audio, local or s3",
+		field: func(v *Config) interface{} { return &v.Storage }},
+	{env: "AIT_STORAGE_DIR", value: "", usage: "The directory of local storage, default to work dir",
+		field: func(v *Config) interface{} { return &v.StorageDir }},
+	{env: "AIT_STORAGE_PREFIX", value: "", usage: "The prefix of keys in storage",
+		field: func(v *Config) interface{} { return &v.StoragePrefix }},
+	{env: "AIT_STORAGE_QUOTA", value: "0", usage: "The max bytes of local storage, 0 for unlimited",
+		field: func(v *Config) interface{} { return &v.StorageQuota }},
+	{env: "AIT_STORAGE_PRESIGN", value: "0", usage: "The seconds of pre-signed URL of S3, 0 to disable",
+		field: func(v *Config) interface{} { return &v.StoragePresign }},
+	{env: "AIT_S3_ENDPOINT", value: "", usage: "The endpoint of S3",
+		field: func(v *Config) interface{} { return &v.S3Endpoint }},
+	{env: "AIT_S3_REGION", value: "", usage: "The region of S3",
+		field: func(v *Config) interface{} { return &v.S3Region }},
+	{env: "AIT_S3_BUCKET", value: "", usage: "The bucket of S3",
+		field: func(v *Config) interface{} { return &v.S3Bucket }},
+	{env: "AIT_S3_ACCESS_KEY", value: "", usage: "The access key of S3",
+		field: func(v *Config) interface{} { return &v.S3AccessKey }},
+	{env: "AIT_S3_SECRET_KEY", value: "", secret: true,
+		field: func(v *Config) interface{} { return &v.S3SecretKey }},
+	{env: "AIT_S3_PATH_STYLE", value: "true", usage: "Whether use the path style URL of S3",
+		field: func(v *Config) interface{} { return &v.S3PathStyle }},
+}
+
+// Load the config from the args of command line, the env and the config file. The config file is set
+// by --config or AIT_CONFIG, default to ../.env if exists. The defaults overwrite the defaults of fields,
+// for example, the CLI logs in warn level by default.
+func loadConfig(ctx context.Context, args []string, defaults map[string]string) (*Config, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("AIT_CONFIG"), "The config file in env format, default to ../.env if exists")
+	flags := make(map[string]*string)
+	for _, field := range configFields {
+		if !field.secret {
+			flags[field.env] = fs.String(field.flagName(), "",
+				fmt.Sprintf("%v, overwrite %v, default to %v", field.usage, field.env, field.value))
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, errors.Wrapf(err, "parse flags")
+	}
+	if fs.NArg() > 0 {
+		return nil, errors.Errorf("invalid args %v", strings.Join(fs.Args(), " "))
+	}
+
+	v := &Config{File: *file, env: make(map[string]string)}
+	if v.File == "" {
+		if _, err := os.Stat("../.env"); err == nil {
+			v.File = "../.env"
+		}
+	}
+	if v.File != "" {
+		env, err := godotenv.Read(v.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load %v", v.File)
+		}
+		v.env = env
+	}
+
+	visited := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+
+	for _, field := range configFields {
+		value := v.lookup(field.env)
+		if visited[field.flagName()] {
+			value = *flags[field.env]
+		}
+		if value == "" {
+			if value = defaults[field.env]; value == "" {
+				value = field.value
+			}
+		}
+		if err := field.parse(v, value); err != nil {
+			return nil, errors.Wrapf(err, "invalid %v %v", field.env, value)
+		}
+	}
+
+	if err := v.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "validate")
+	}
+	return v, nil
+}
+
+// Lookup the env, or the config file if not set. The env which is set to empty also overwrites the config
+// file, for example, AIT_REPLY_PREFIX= to disable the prefix in config file.
+func (v *Config) lookup(key string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return v.env[key]
+}
+
+// Get the setting by env key, the typed value of config, or the env and config file for the settings
+// which are not typed, for example, AIT_ROBOT_0_ID. It's the getenv of default tenant.
+func (v *Config) Getenv(key string) string {
+	for _, field := range configFields {
+		if field.env == key {
+			return field.get(v)
+		}
+	}
+	return v.lookup(key)
+}
+
+// Validate the config, to fail at startup rather than at request.
+func (v *Config) Validate() error {
+	if v.MaxTokens <= 0 {
+		return errors.Errorf("invalid AIT_MAX_TOKENS %v, should be positive", v.MaxTokens)
+	}
+	if v.Temperature < 0 || v.Temperature > 2 {
+		return errors.Errorf("invalid AIT_TEMPERATURE %v, should be 0 to 2", v.Temperature)
+	}
+	if v.StageTimeout <= 0 {
+		return errors.Errorf("invalid AIT_STAGE_TIMEOUT %v, should be positive", v.StageTimeout)
+	}
+	if v.SummaryMaxTokens <= 0 {
+		return errors.Errorf("invalid AIT_SUMMARY_MAX_TOKENS %v, should be positive", v.SummaryMaxTokens)
+	}
+	if v.ReplyLimit <= 0 || v.ChatWindow < unlimitedChatWindow {
+		return errors.Errorf("invalid AIT_REPLY_LIMIT %v or AIT_CHAT_WINDOW %v", v.ReplyLimit, v.ChatWindow)
+	}
+	if v.ShutdownTimeout < 0 || v.MaxLiveStages < 0 || v.AudioMemoryLimit < 0 || v.ChatContextLength < 0 ||
+		v.StorageQuota < 0 || v.StoragePresign < 0 {
+		return errors.Errorf("negative timeout, limit, context length, quota or presign")
+	}
+
+	oneOf := func(key, value string, values ...string) error {
+		for _, allowed := range values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return errors.Errorf("invalid %v %v, should be %v", key, value, strings.Join(values, ","))
+	}
+	if err := oneOf("AIT_LOG_LEVEL", v.LogLevel, logLevels...); err != nil {
+		return err
+	}
+	if err := oneOf("AIT_LOG_FORMAT", v.LogFormat, "text", "json"); err != nil {
+		return err
+	}
+	if err := oneOf("AIT_PREFLIGHT", v.Preflight, "on", "probe", "off"); err != nil {
+		return err
+	}
+	if err := oneOf("AIT_CASSETTE", v.Cassette, "", "record", "replay"); err != nil {
+		return err
+	}
+	if err := oneOf("AIT_STORAGE", v.Storage, "local", "s3"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Print the config, the secrets are in length, for example, AIT_S3_SECRET_KEY=40B.
+func (v *Config) String() string {
+	fields := []string{fmt.Sprintf("file=%v", v.File)}
+	for _, field := range configFields {
+		fields = append(fields, fmt.Sprintf("%v=%v", field.env, field.format(v)))
+	}
+	return strings.Join(fields, ", ")
+}
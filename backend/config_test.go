@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The settings are loaded in the precedence of flags > env > config file > defaults.
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(file, []byte("AIT_HTTP_LISTEN=3011\nAIT_MAX_TOKENS=256\nAIT_TEMPERATURE=0.2\n"+
+		"AIT_REPLY_PREFIX=Hi\nAIT_ROBOT_0_ID=file-robot\nAIT_ROBOT_0_LABEL=File\n"), 0644); err != nil {
+		t.Fatalf("write %v, err %v", file, err)
+	}
+
+	// The HTTP listen is set by all, the max tokens by env and file, the temperature by file only.
+	t.Setenv("AIT_HTTP_LISTEN", "3012")
+	t.Setenv("AIT_MAX_TOKENS", "512")
+	t.Setenv("AIT_ROBOT_0_ID", "env-robot")
+	// The env which is set to empty also overwrites the config file.
+	t.Setenv("AIT_REPLY_PREFIX", "")
+
+	conf, err := loadConfig(context.Background(), []string{"--config", file, "--http-listen", "3013"}, nil)
+	if err != nil {
+		t.Fatalf("load, err %v", err)
+	}
+
+	for _, c := range []struct {
+		key, expect string
+	}{
+		{"AIT_HTTP_LISTEN", "3013"},
+		{"AIT_MAX_TOKENS", "512"},
+		{"AIT_TEMPERATURE", "0.2"},
+		{"AIT_REPLY_PREFIX", ""},
+		{"AIT_CHAT_WINDOW", "5"},
+		{"AIT_ROBOT_0_ID", "env-robot"},
+		{"AIT_ROBOT_0_LABEL", "File"},
+		{"AIT_ROBOT_1_ID", ""},
+	} {
+		if v := conf.Getenv(c.key); v != c.expect {
+			t.Errorf("%v is %v, should be %v", c.key, v, c.expect)
+		}
+	}
+	if conf.HTTPListen != "3013" || conf.MaxTokens != 512 || conf.Temperature != 0.2 || conf.ReplyPrefix != "" {
+		t.Errorf("config %+v", conf)
+	}
+}
+
+// The defaults of caller, for example, in development, are used only if not set.
+func TestLoadConfigDefaults(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(file, []byte("AIT_MAX_TOKENS=256\n"), 0644); err != nil {
+		t.Fatalf("write %v, err %v", file, err)
+	}
+
+	conf, err := loadConfig(context.Background(), []string{"--config", file},
+		map[string]string{"AIT_MAX_TOKENS": "128", "AIT_TEMPERATURE": "1.5"})
+	if err != nil {
+		t.Fatalf("load, err %v", err)
+	}
+	if conf.MaxTokens != 256 || conf.Temperature != 1.5 {
+		t.Errorf("max tokens %v, temperature %v", conf.MaxTokens, conf.Temperature)
+	}
+
+	if _, err := loadConfig(context.Background(), []string{"--config", file, "--temperature", "3"}, nil); err == nil {
+		t.Errorf("temperature 3 should be invalid")
+	}
+}
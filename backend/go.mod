@@ -3,13 +3,16 @@ module server
 go 1.18
 
 require (
-	github.com/go-audio/audio v1.0.0 // indirect
-	github.com/go-audio/riff v1.0.0 // indirect
-	github.com/go-audio/wav v1.1.0 // indirect
-	github.com/google/uuid v1.4.0 // indirect
+	github.com/google/uuid v1.4.0
+	github.com/joho/godotenv v1.5.1
+	github.com/ossrs/go-oryx-lib v0.0.9
+	github.com/pkoukk/tiktoken-go v0.1.6
+	github.com/pkoukk/tiktoken-go-loader v0.0.2
+	github.com/sashabaranov/go-openai v1.26.3
+	github.com/tencentcloud/tencentcloud-speech-sdk-go v1.0.13
+)
+
+require (
+	github.com/dlclark/regexp2 v1.10.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/ossrs/go-oryx-lib v0.0.9 // indirect
-	github.com/sashabaranov/go-openai v1.17.9 // indirect
-	github.com/tencentcloud/tencentcloud-speech-sdk-go v1.0.13 // indirect
 )
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/sashabaranov/go-openai"
+	"strings"
+	"sync"
+)
+
+// The context length of models, the prefix of model is also matched, for example, gpt-4-0613 is gpt-4.
+var modelContextLengths = map[string]int{
+	"gpt-4-1106-preview": 128000, "gpt-4-0125-preview": 128000, "gpt-4-turbo-preview": 128000,
+	"gpt-4-turbo": 128000, "gpt-4o": 128000, "gpt-4-32k": 32768, "gpt-4": 8192,
+	"gpt-3.5-turbo-1106": 16385, "gpt-3.5-turbo-0125": 16385, "gpt-3.5-turbo-16k": 16385,
+	"gpt-3.5-turbo": 16385,
+}
+
+// The default context length for unknown models, which is the minimum of the common models.
+const defaultContextLength = 4096
+
+// Get the context length of model.
+func contextLengthOf(model string) int {
+	if v, ok := modelContextLengths[model]; ok {
+		return v
+	}
+
+	// Match the longest prefix, for example, gpt-4-0613 is gpt-4, but gpt-4-32k-0613 is gpt-4-32k.
+	var matched string
+	for prefix := range modelContextLengths {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(matched) {
+			matched = prefix
+		}
+	}
+	if matched != "" {
+		return modelContextLengths[matched]
+	}
+	return defaultContextLength
+}
+
+func init() {
+	// Use the embedded BPE files, never download from internet.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// The tokenizers for models, map model to *Tokenizer, because it's expensive to create one.
+var tokenizers sync.Map
+
+// The Tokenizer counts the tokens of text and messages for a model.
+type Tokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+// Get the tokenizer for model, use cl100k_base for unknown models, such as models of other providers.
+func NewTokenizer(model string) (*Tokenizer, error) {
+	if v, ok := tokenizers.Load(model); ok {
+		return v.(*Tokenizer), nil
+	}
+
+	encoding, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		if encoding, err = tiktoken.GetEncoding(tiktoken.MODEL_CL100K_BASE); err != nil {
+			return nil, errors.Wrapf(err, "get encoding for %v", model)
+		}
+	}
+
+	v, _ := tokenizers.LoadOrStore(model, &Tokenizer{encoding: encoding})
+	return v.(*Tokenizer), nil
+}
+
+// Count the tokens of text.
+func (v *Tokenizer) Count(text string) int {
+	return len(v.encoding.EncodeOrdinary(text))
+}
+
+// Count the tokens of messages, each message has 3 extra tokens for role and separators, see
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+func (v *Tokenizer) CountMessages(messages ...openai.ChatCompletionMessage) int {
+	var nn int
+	for _, message := range messages {
+		nn += 3 + v.Count(message.Role) + v.Count(message.Content)
+		if message.Name != "" {
+			nn += 1 + v.Count(message.Name)
+		}
+	}
+	return nn
+}
+
+// The ChatHistory is the chat history of stage, in pairs of user and assistant messages, so that we
+// never drop only one message of a pair.
+type ChatHistory struct {
+	pairs [][2]openai.ChatCompletionMessage
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+func NewChatHistory() *ChatHistory {
+	return &ChatHistory{}
+}
+
+// Append a pair of user and assistant messages.
+func (v *ChatHistory) Append(user, assistant string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.pairs = append(v.pairs, [2]openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: user},
+		{Role: openai.ChatMessageRoleAssistant, Content: assistant},
+	})
+}
+
+// Get the number of pairs.
+func (v *ChatHistory) Len() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return len(v.pairs)
+}
+
+// Get the texts of pairs, in user and assistant.
+func (v *ChatHistory) Texts() [][2]string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	texts := make([][2]string, 0, len(v.pairs))
+	for _, pair := range v.pairs {
+		texts = append(texts, [2]string{pair[0].Content, pair[1].Content})
+	}
+	return texts
+}
+
+// Reset the pairs by texts, for example, the history is loaded from other replica.
+func (v *ChatHistory) Reset(texts [][2]string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.pairs = nil
+	for _, text := range texts {
+		v.pairs = append(v.pairs, [2]openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: text[0]},
+			{Role: openai.ChatMessageRoleAssistant, Content: text[1]},
+		})
+	}
+}
+
+// Get all messages in order.
+func (v *ChatHistory) Messages() []openai.ChatCompletionMessage {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	messages := make([]openai.ChatCompletionMessage, 0, len(v.pairs)*2)
+	for _, pair := range v.pairs {
+		messages = append(messages, pair[0], pair[1])
+	}
+	return messages
+}
+
+// The max pairs of chat window for unlimited history, which is only limited by the token budget. Note
+// that the chat window 0 is no history.
+const unlimitedChatWindow = -1
+
+// Trim the oldest pairs, to keep at most maxPairs pairs, and the tokens of messages in budget. The maxPairs
+// is 0 to drop all pairs, or unlimitedChatWindow to keep pairs in budget. Return the dropped pairs, in order.
+func (v *ChatHistory) Trim(tokenizer *Tokenizer, budget, maxPairs int) [][2]openai.ChatCompletionMessage {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Find the oldest pair to keep, from the newest pair.
+	keep, used := len(v.pairs), 0
+	for i := len(v.pairs) - 1; i >= 0; i-- {
+		if maxPairs != unlimitedChatWindow && len(v.pairs)-i > maxPairs {
+			break
+		}
+
+		nn := tokenizer.CountMessages(v.pairs[i][0], v.pairs[i][1])
+		if used+nn > budget {
+			break
+		}
+		keep, used = i, used+nn
+	}
+
+	dropped := v.pairs[:keep]
+	v.pairs = v.pairs[keep:]
+	return dropped
+}
+
+// Build the chat messages of system prompt, history and user question, in the token budget of model.
+// The history is trimmed in pairs, reserving the room for system prompt, user question and max tokens
+// for response. The contextLength is 0 to use the context length of model.
+func buildChatMessages(
+	ctx context.Context, history *ChatHistory, model, system, user string, maxTokens, maxPairs, contextLength int,
+) ([]openai.ChatCompletionMessage, [][2]openai.ChatCompletionMessage, error) {
+	tokenizer, err := NewTokenizer(model)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "tokenizer")
+	}
+
+	systemMessage := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system}
+	userMessage := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: user}
+
+	// Each reply is primed with 3 tokens.
+	if contextLength <= 0 {
+		contextLength = contextLengthOf(model)
+	}
+	reserved := tokenizer.CountMessages(systemMessage, userMessage) + 3 + maxTokens
+	budget := contextLength - reserved
+	if budget < 0 {
+		return nil, nil, errors.Errorf("context length %v of %v is less than reserved %v, max tokens %v",
+			contextLength, model, reserved, maxTokens)
+	}
+
+	dropped := history.Trim(tokenizer, budget, maxPairs)
+
+	messages := []openai.ChatCompletionMessage{systemMessage}
+	messages = append(messages, history.Messages()...)
+	messages = append(messages, userMessage)
+
+	logger.Tf(ctx, "History: model=%v, context=%v, reserved=%v, budget=%v, pairs=%v, dropped=%v, tokens=%v",
+		model, contextLength, reserved, budget, history.Len(), len(dropped),
+		tokenizer.CountMessages(messages...)+3)
+	return messages, dropped, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Create the history with n pairs, the content of pair i is question i and answer i.
+func newHistoryTest(n int) *ChatHistory {
+	history := NewChatHistory()
+	for i := 0; i < n; i++ {
+		history.Append(fmt.Sprintf("question %v", i), fmt.Sprintf("answer %v", i))
+	}
+	return history
+}
+
+func TestChatHistoryTrim(t *testing.T) {
+	tokenizer, err := NewTokenizer("gpt-4")
+	if err != nil {
+		t.Fatalf("tokenizer, err %v", err)
+	}
+	pair := tokenizer.CountMessages(newHistoryTest(1).Messages()...)
+
+	for _, c := range []struct {
+		name     string
+		budget   int
+		maxPairs int
+		keep     int
+	}{
+		{"window", 1000 * pair, 3, 3},
+		{"no history", 1000 * pair, 0, 0},
+		{"unlimited", 1000 * pair, unlimitedChatWindow, 10},
+		{"budget", 4 * pair, unlimitedChatWindow, 4},
+		{"budget less than window", 2*pair + 1, 5, 2},
+		{"window less than budget", 5 * pair, 3, 3},
+		{"no budget", pair - 1, 5, 0},
+	} {
+		history := newHistoryTest(10)
+		dropped := history.Trim(tokenizer, c.budget, c.maxPairs)
+
+		if history.Len() != c.keep || len(dropped) != 10-c.keep {
+			t.Fatalf("%v: keep %v and drop %v, should keep %v", c.name, history.Len(), len(dropped), c.keep)
+		}
+		// The oldest pairs are dropped in order, and the newest pairs are kept.
+		for i, p := range dropped {
+			if p[0].Content != fmt.Sprintf("question %v", i) || p[1].Content != fmt.Sprintf("answer %v", i) {
+				t.Fatalf("%v: dropped %v is %v", c.name, i, p)
+			}
+		}
+		for i, text := range history.Texts() {
+			if text[0] != fmt.Sprintf("question %v", 10-c.keep+i) {
+				t.Fatalf("%v: kept %v is %v", c.name, i, text)
+			}
+		}
+	}
+}
+
+func TestBuildChatMessages(t *testing.T) {
+	ctx := context.Background()
+	tokenizer, err := NewTokenizer("gpt-4")
+	if err != nil {
+		t.Fatalf("tokenizer, err %v", err)
+	}
+
+	system, user, maxTokens := "You are a helpful assistant.", "Hello", 100
+	reserved := tokenizer.CountMessages(
+		openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system},
+		openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: user},
+	) + 3 + maxTokens
+	pair := tokenizer.CountMessages(newHistoryTest(1).Messages()...)
+
+	// The context length is enough for 3 pairs of history.
+	history := newHistoryTest(10)
+	messages, dropped, err := buildChatMessages(
+		ctx, history, "gpt-4", system, user, maxTokens, unlimitedChatWindow, reserved+3*pair+1,
+	)
+	if err != nil {
+		t.Fatalf("build, err %v", err)
+	}
+	if len(dropped) != 7 || len(messages) != 1+3*2+1 {
+		t.Fatalf("dropped %v, messages %v", len(dropped), len(messages))
+	}
+	if messages[0].Role != openai.ChatMessageRoleSystem || messages[1].Content != "question 7" ||
+		messages[len(messages)-1].Content != user {
+		t.Fatalf("messages %v", messages)
+	}
+	if nn := tokenizer.CountMessages(messages...) + 3 + maxTokens; nn > reserved+3*pair+1 {
+		t.Fatalf("tokens %v exceed context length", nn)
+	}
+
+	// No history for chat window 0.
+	messages, _, err = buildChatMessages(ctx, newHistoryTest(10), "gpt-4", system, user, maxTokens, 0, 0)
+	if err != nil {
+		t.Fatalf("build, err %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("messages %v, should be system and user", messages)
+	}
+
+	// Fail if the context length is less than the reserved.
+	if _, _, err = buildChatMessages(ctx, newHistoryTest(1), "gpt-4", system, user, maxTokens, 5, reserved-1); err == nil {
+		t.Fatalf("should fail for context length %v less than reserved %v", reserved-1, reserved)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The max number of inputs for each embeddings request.
+const maxEmbeddingInputs = 64
+
+// The KnowledgeChunk is a chunk of document, with the embedding vector.
+type KnowledgeChunk struct {
+	// The source file, relative to the knowledge dir.
+	Source string `json:"source"`
+	// The index of chunk in source file.
+	Index int `json:"index"`
+	// The text of chunk.
+	Text string `json:"text"`
+	// The embedding vector of text.
+	Embedding []float32 `json:"embedding"`
+}
+
+// The KnowledgeMatch is a chunk matched the question, which is the source reference of answer.
+type KnowledgeMatch struct {
+	// The source file, relative to the knowledge dir.
+	Source string `json:"source"`
+	// The index of chunk in source file.
+	Chunk int `json:"chunk"`
+	// The cosine similarity to the question.
+	Score float64 `json:"score"`
+
+	// The text of chunk.
+	text string
+}
+
+// The knowledgeIndex is the local vector index, which is saved to file to avoid embedding the same
+// documents again, the files map the source to its hash and chunks.
+type knowledgeIndex struct {
+	Model string                         `json:"model"`
+	Files map[string]*knowledgeIndexFile `json:"files"`
+}
+
+type knowledgeIndexFile struct {
+	Hash   string            `json:"hash"`
+	Chunks []*KnowledgeChunk `json:"chunks"`
+}
+
+// The KnowledgeBase is the documents of robot, to answer with retrieval-augmented generation.
+type KnowledgeBase struct {
+	// The dir of documents, the *.md, *.txt and *.pdf files.
+	dir string
+	// The index file, default to .knowledge-index.json in dir.
+	indexFile string
+	// The embedding model.
+	model string
+	// The max characters of chunk.
+	chunkSize int
+	// The number of chunks to inject for each question.
+	topK int
+	// The minimum score of chunk to inject.
+	minScore float64
+
+	// The chunks of all documents.
+	chunks []*KnowledgeChunk
+}
+
+func NewKnowledgeBase(opts ...func(kb *KnowledgeBase)) *KnowledgeBase {
+	v := &KnowledgeBase{
+		model: string(openai.SmallEmbedding3), chunkSize: 1000, topK: 3, minScore: 0.3,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	if v.indexFile == "" {
+		v.indexFile = path.Join(v.dir, ".knowledge-index.json")
+	}
+	return v
+}
+
+// Create the knowledge base of robot by dir, nil if no dir. The options are configured by getenv, which
+// read the env of tenant.
+func newRobotKnowledge(getenv func(key string) string, dir string) (*KnowledgeBase, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	kb := NewKnowledgeBase(func(kb *KnowledgeBase) {
+		kb.dir = dir
+		if model := getenv("AIT_EMBEDDING_MODEL"); model != "" {
+			kb.model = model
+		}
+	})
+
+	for key, pv := range map[string]*int{
+		"AIT_KNOWLEDGE_CHUNK_SIZE": &kb.chunkSize, "AIT_KNOWLEDGE_TOP_K": &kb.topK,
+	} {
+		if s := getenv(key); s != "" {
+			if iv, err := strconv.ParseInt(s, 10, 64); err != nil || iv <= 0 {
+				return nil, errors.Errorf("invalid %v %v", key, s)
+			} else {
+				*pv = int(iv)
+			}
+		}
+	}
+
+	if s := getenv("AIT_KNOWLEDGE_MIN_SCORE"); s != "" {
+		if fv, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, errors.Wrapf(err, "parse AIT_KNOWLEDGE_MIN_SCORE %v", s)
+		} else {
+			kb.minScore = fv
+		}
+	}
+
+	return kb, nil
+}
+
+func (v *KnowledgeBase) String() string {
+	return fmt.Sprintf("dir=%v, model=%v, chunks=%v, topK=%v, minScore=%v",
+		v.dir, v.model, len(v.chunks), v.topK, v.minScore)
+}
+
+// Load the documents, chunk and embed the changed files, and save the index.
+func (v *KnowledgeBase) Load(ctx context.Context, aiConfig openai.ClientConfig) error {
+	index := &knowledgeIndex{Files: make(map[string]*knowledgeIndexFile)}
+	if b, err := os.ReadFile(v.indexFile); err == nil {
+		if err := json.Unmarshal(b, index); err != nil {
+			logger.Wf(ctx, "Knowledge: Ignore invalid index %v, err %v", v.indexFile, err)
+		}
+	}
+
+	// The index of other embedding model is useless.
+	if index.Model != v.model || index.Files == nil {
+		index = &knowledgeIndex{Model: v.model, Files: make(map[string]*knowledgeIndexFile)}
+	}
+
+	var sources []string
+	if err := filepath.WalkDir(v.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != v.dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".md", ".markdown", ".txt", ".pdf":
+			if source, err := filepath.Rel(v.dir, p); err != nil {
+				return errors.Wrapf(err, "rel %v", p)
+			} else {
+				sources = append(sources, source)
+			}
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "walk %v", v.dir)
+	}
+	sort.Strings(sources)
+
+	files, changed := make(map[string]*knowledgeIndexFile), 0
+	for _, source := range sources {
+		text, err := readKnowledgeFile(ctx, path.Join(v.dir, source))
+		if err != nil {
+			return errors.Wrapf(err, "read %v", source)
+		}
+
+		h := sha256.Sum256([]byte(text))
+		hash := hex.EncodeToString(h[:])
+		if file, ok := index.Files[source]; ok && file.Hash == hash {
+			files[source] = file
+			continue
+		}
+
+		var chunks []*KnowledgeChunk
+		for i, chunk := range splitKnowledgeText(text, v.chunkSize) {
+			chunks = append(chunks, &KnowledgeChunk{Source: source, Index: i, Text: chunk})
+		}
+		if err := v.embed(ctx, aiConfig, chunks); err != nil {
+			return errors.Wrapf(err, "embed %v", source)
+		}
+
+		files[source] = &knowledgeIndexFile{Hash: hash, Chunks: chunks}
+		changed++
+		logger.Tf(ctx, "Knowledge: Embed %v, chunks=%v", source, len(chunks))
+	}
+
+	v.chunks = nil
+	for _, source := range sources {
+		v.chunks = append(v.chunks, files[source].Chunks...)
+	}
+
+	// Save the index only when changed, the dir might be readonly.
+	if changed > 0 || len(files) != len(index.Files) {
+		index.Files = files
+		if b, err := json.Marshal(index); err != nil {
+			return errors.Wrapf(err, "marshal index")
+		} else if err := os.WriteFile(v.indexFile, b, 0644); err != nil {
+			logger.Wf(ctx, "Knowledge: Ignore save index %v, err %v", v.indexFile, err)
+		}
+	}
+
+	logger.Tf(ctx, "Knowledge: Load %v, files=%v, changed=%v", v.String(), len(sources), changed)
+	return nil
+}
+
+// Embed the text of chunks, in batches.
+func (v *KnowledgeBase) embed(ctx context.Context, aiConfig openai.ClientConfig, chunks []*KnowledgeChunk) error {
+	client := openai.NewClientWithConfig(aiConfig)
+	for i := 0; i < len(chunks); i += maxEmbeddingInputs {
+		batch := chunks[i:]
+		if len(batch) > maxEmbeddingInputs {
+			batch = batch[:maxEmbeddingInputs]
+		}
+
+		var inputs []string
+		for _, chunk := range batch {
+			inputs = append(inputs, chunk.Text)
+		}
+
+		resp, err := client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+			Input: inputs, Model: openai.EmbeddingModel(v.model),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "create embeddings by %v", v.model)
+		}
+		if len(resp.Data) != len(batch) {
+			return errors.Errorf("embeddings %v of %v inputs", len(resp.Data), len(batch))
+		}
+
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= len(batch) {
+				return errors.Errorf("invalid embedding index %v", data.Index)
+			}
+			batch[data.Index].Embedding = data.Embedding
+		}
+	}
+	return nil
+}
+
+// Search the top matches of question, return the matches and the tokens of question for usage.
+func (v *KnowledgeBase) Search(
+	ctx context.Context, aiConfig openai.ClientConfig, question string,
+) ([]*KnowledgeMatch, int, error) {
+	if len(v.chunks) == 0 || strings.TrimSpace(question) == "" {
+		return nil, 0, nil
+	}
+
+	client := openai.NewClientWithConfig(aiConfig)
+	resp, err := client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: []string{question}, Model: openai.EmbeddingModel(v.model),
+	})
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "create embeddings by %v", v.model)
+	}
+	if len(resp.Data) == 0 {
+		return nil, 0, errors.Errorf("no embedding by %v", v.model)
+	}
+	query := resp.Data[0].Embedding
+
+	var matches []*KnowledgeMatch
+	for _, chunk := range v.chunks {
+		if score := cosineSimilarity(query, chunk.Embedding); score >= v.minScore {
+			matches = append(matches, &KnowledgeMatch{
+				Source: chunk.Source, Chunk: chunk.Index, Score: score, text: chunk.Text,
+			})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if len(matches) > v.topK {
+		matches = matches[:v.topK]
+	}
+
+	return matches, resp.Usage.PromptTokens, nil
+}
+
+// Build the system prompt with the matched documents.
+func (v *KnowledgeBase) BuildSystemPrompt(system string, matches []*KnowledgeMatch) string {
+	if len(matches) == 0 {
+		return system
+	}
+
+	var sb strings.Builder
+	sb.WriteString(system)
+	sb.WriteString(" Answer the question based on the following documents. If the documents don't contain " +
+		"the answer, say you don't know.")
+	for i, match := range matches {
+		sb.WriteString(fmt.Sprintf("\n\nDocument %v (%v):\n%v", i+1, match.Source, match.text))
+	}
+	return sb.String()
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// Read the text of document, the PDF is converted by pdftotext of poppler.
+func readKnowledgeFile(ctx context.Context, filename string) (string, error) {
+	if strings.ToLower(filepath.Ext(filename)) != ".pdf" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return "", errors.Wrapf(err, "read %v", filename)
+		}
+		return string(b), nil
+	}
+
+	b, err := exec.CommandContext(ctx, "pdftotext", "-enc", "UTF-8", filename, "-").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "pdftotext %v", filename)
+	}
+	return string(b), nil
+}
+
+// Split the text to chunks by paragraphs, each chunk is at most size characters. The long paragraph is
+// split by characters.
+func splitKnowledgeText(text string, size int) []string {
+	var chunks []string
+	var current []rune
+	flush := func() {
+		if s := strings.TrimSpace(string(current)); s != "" {
+			chunks = append(chunks, s)
+		}
+		current = nil
+	}
+
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		p := []rune(strings.TrimSpace(paragraph))
+		if len(p) == 0 {
+			continue
+		}
+
+		if len(current) > 0 && len(current)+2+len(p) > size {
+			flush()
+		}
+
+		for len(p) > size {
+			current = p[:size]
+			flush()
+			p = p[size:]
+		}
+
+		if len(current) > 0 {
+			current = append(current, '\n', '\n')
+		}
+		current = append(current, p...)
+	}
+	flush()
+
+	return chunks
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// The steps of turn to report, in order. The first is from upload to the first TTS downloaded, which is
+// the latency user feels, and the turn is from upload to all TTS removed.
+var loadSteps = []string{"start", "upload", "query", "tts", "remove", "first", "turn"}
+
+// Create stages and talk like the web client, then report the latency of steps, for example:
+//
+//	go run . load --server http://127.0.0.1:3001 --stages 10 --turns 3 --rate 2 example.aac
+func doLoad(ctx context.Context, args []string) error {
+	var server, auth, robot, format, mock string
+	var stages, turns int
+	var rate float64
+	var mockDelay time.Duration
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	fs.StringVar(&server, "server", "http://127.0.0.1:3001", "The URL of server")
+	fs.StringVar(&auth, "auth", "", "The API token to create stage, if authentication is enabled")
+	fs.StringVar(&robot, "robot", "default", "The robot to talk with")
+	fs.StringVar(&format, "format", "", "The format of TTS audio, empty for the native format")
+	fs.IntVar(&stages, "stages", 10, "The number of concurrent stages, 0 to only run the mock providers")
+	fs.IntVar(&turns, "turns", 3, "The number of turns of each stage")
+	fs.Float64Var(&rate, "rate", 1, "The uploads per second of all stages, 0 for no limit")
+	fs.StringVar(&mock, "mock", "", "The listen address of mock providers, for example, :3080, empty to disable")
+	fs.DurationVar(&mockDelay, "mock-delay", 50*time.Millisecond, "The delay of each mock response or chat chunk")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v load [options] [question audio file]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+
+	file := "example.aac"
+	if fs.NArg() > 0 {
+		file = fs.Arg(0)
+	}
+	input, err := os.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", file)
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Start the mock providers, so that the server could run offline by OPENAI_PROXY.
+	if mock != "" {
+		mockServer, err := startMockProviders(mock, mockDelay)
+		if err != nil {
+			return errors.Wrapf(err, "mock")
+		}
+		defer mockServer.Close()
+		fmt.Printf("Mock providers at %v, set OPENAI_PROXY=http://127.0.0.1%v/v1 for server\n",
+			mock, strings.TrimPrefix(mock, "0.0.0.0"))
+
+		// Only run the mock providers for server, until quit.
+		if stages == 0 {
+			<-ctx.Done()
+			return nil
+		}
+	}
+
+	tester := NewLoadTester(func(v *loadTester) {
+		v.server, v.auth, v.robot, v.format = strings.TrimSuffix(server, "/"), auth, robot, format
+		v.stages, v.turns, v.rate, v.input = stages, turns, rate, input
+	})
+	fmt.Printf("Load %v with stages=%v, turns=%v, rate=%v/s, robot=%v, input=%v %vB\n",
+		tester.server, stages, turns, rate, robot, file, len(input))
+
+	start := time.Now()
+	tester.Run(ctx)
+	tester.Report(os.Stdout, time.Since(start))
+	return nil
+}
+
+// The loadTester creates stages and talks like the web client, and records the latency of steps.
+type loadTester struct {
+	// The URL of server, for example, http://127.0.0.1:3001
+	server string
+	// The API token to create stage.
+	auth string
+	// The robot to talk with.
+	robot string
+	// The format of TTS audio.
+	format string
+	// The number of stages, turns of each stage and the uploads per second.
+	stages int
+	turns  int
+	rate   float64
+	// The question audio to upload.
+	input []byte
+	// The HTTP client.
+	client *http.Client
+
+	// The durations of each step.
+	durations map[string][]time.Duration
+	// The errors of each step, and a sample error message.
+	errors  map[string]int
+	samples map[string]string
+	// The number of badcases, which is filtered by server, such as empty ASR.
+	badcases int
+	// The number of turns done.
+	done int
+	// The lock to protect the stats.
+	lock sync.Mutex
+}
+
+func NewLoadTester(opts ...func(*loadTester)) *loadTester {
+	v := &loadTester{
+		client:    &http.Client{Timeout: 60 * time.Second},
+		durations: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+		samples:   make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Run all stages concurrently, until all turns are done or ctx is done.
+func (v *loadTester) Run(ctx context.Context) {
+	// The tokens to upload, which limits the rate of uploads of all stages.
+	var tokens chan bool
+	if v.rate > 0 {
+		tokens = make(chan bool)
+		go func() {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / v.rate))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case tokens <- true:
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < v.stages; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var stage struct {
+				SID    string `json:"sid"`
+				SToken string `json:"stoken"`
+			}
+			q := url.Values{}
+			if v.auth != "" {
+				q.Set("auth", v.auth)
+			}
+			if _, err := v.call(ctx, "start", "/api/ai-talk/start/", q, nil, "", &stage); err != nil {
+				return
+			}
+
+			for j := 0; j < v.turns && ctx.Err() == nil; j++ {
+				if tokens != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tokens:
+					}
+				}
+				v.talk(ctx, stage.SID, stage.SToken)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Talk a turn, upload the question, then query, download and remove each sentence, like the web client.
+func (v *loadTester) talk(ctx context.Context, sid, stoken string) {
+	starttime := time.Now()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if fw, err := mw.CreateFormFile("file", "input.audio"); err != nil {
+		v.record("upload", 0, errors.Wrapf(err, "create form"))
+		return
+	} else {
+		fw.Write(v.input)
+	}
+	mw.Close()
+
+	var upload struct {
+		RID string `json:"rid"`
+	}
+	q := url.Values{"sid": {sid}, "stoken": {stoken}, "robot": {v.robot}, "umi": {"0"}}
+	badcase, err := v.call(ctx, "upload", "/api/ai-talk/upload/", q, &body, mw.FormDataContentType(), &upload)
+	if badcase || err != nil {
+		return
+	}
+
+	first := true
+	for ctx.Err() == nil {
+		q := url.Values{"sid": {sid}, "stoken": {stoken}, "rid": {upload.RID}}
+
+		var segment struct {
+			Processing bool   `json:"processing"`
+			ASID       string `json:"asid"`
+		}
+		if _, err := v.call(ctx, "query", "/api/ai-talk/query/", q, nil, "", &segment); err != nil {
+			return
+		}
+
+		// All sentences are played.
+		if segment.ASID == "" {
+			break
+		}
+		if segment.Processing {
+			time.Sleep(300 * time.Millisecond)
+			continue
+		}
+
+		q.Set("asid", segment.ASID)
+		if v.format != "" {
+			q.Set("format", v.format)
+		}
+		if _, err := v.call(ctx, "tts", "/api/ai-talk/tts/", q, nil, "", nil); err != nil {
+			return
+		}
+		if first {
+			v.record("first", time.Since(starttime), nil)
+			first = false
+		}
+
+		q.Del("format")
+		if _, err := v.call(ctx, "remove", "/api/ai-talk/remove/", q, nil, "", nil); err != nil {
+			return
+		}
+	}
+
+	if ctx.Err() == nil {
+		v.record("turn", time.Since(starttime), nil)
+	}
+}
+
+// Call the API of step and parse the data of response, nil data to discard the body, such as the TTS
+// audio. Return whether the turn is a badcase, which is not an error.
+func (v *loadTester) call(
+	ctx context.Context, step, api string, q url.Values, body io.Reader, contentType string, data interface{},
+) (badcase bool, err error) {
+	starttime := time.Now()
+	defer func() {
+		if !badcase && ctx.Err() == nil {
+			v.record(step, time.Since(starttime), err)
+		}
+	}()
+
+	method := http.MethodPost
+	if step == "tts" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%v%v?%v", v.server, api, q.Encode()), body)
+	if err != nil {
+		return false, errors.Wrapf(err, "create request")
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "request")
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, errors.Wrapf(err, "read")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// The badcase of ASR, see the filter of upload.
+		if step == "upload" && (strings.Contains(string(b), "badcase") || strings.Contains(string(b), "empty asr")) {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			v.badcases++
+			return true, nil
+		}
+		return false, errors.Errorf("status %v, body is %v", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	if data == nil {
+		return false, nil
+	}
+
+	res := struct {
+		Code int         `json:"code"`
+		Data interface{} `json:"data"`
+	}{Data: data}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return false, errors.Wrapf(err, "parse %v", string(b))
+	}
+	if res.Code != 0 {
+		return false, errors.Errorf("code %v, body is %v", res.Code, string(b))
+	}
+	return false, nil
+}
+
+func (v *loadTester) record(step string, d time.Duration, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err != nil {
+		v.errors[step]++
+		v.samples[step] = err.Error()
+		return
+	}
+
+	v.durations[step] = append(v.durations[step], d)
+	if step == "turn" {
+		v.done++
+	}
+}
+
+// Write the report of latency percentiles and errors of each step.
+func (v *loadTester) Report(w io.Writer, elapsed time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// The nearest-rank percentile of sorted durations.
+	percentile := func(durations []time.Duration, p float64) time.Duration {
+		if len(durations) == 0 {
+			return 0
+		}
+		i := int(math.Ceil(p/100*float64(len(durations)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return durations[i]
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tCOUNT\tERRORS\tERROR%\tP50\tP90\tP99\tMAX")
+	for _, step := range loadSteps {
+		durations := append([]time.Duration{}, v.durations[step]...)
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+
+		count := len(durations) + v.errors[step]
+		var ratio float64
+		if count > 0 {
+			ratio = float64(v.errors[step]) * 100 / float64(count)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.1f\t%v\t%v\t%v\t%v\n", step, count, v.errors[step], ratio,
+			percentile(durations, 50).Round(time.Millisecond), percentile(durations, 90).Round(time.Millisecond),
+			percentile(durations, 99).Round(time.Millisecond), percentile(durations, 100).Round(time.Millisecond))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "Turns: done=%v/%v, badcases=%v, elapsed=%v, %.2f turns/s\n",
+		v.done, v.stages*v.turns, v.badcases, elapsed.Round(time.Millisecond), float64(v.done)/elapsed.Seconds())
+	for _, step := range loadSteps {
+		if sample, ok := v.samples[step]; ok {
+			fmt.Fprintf(w, "Error: %v %v\n", step, sample)
+		}
+	}
+}
+
+// Start the mock providers of OpenAI API, for ASR, chat and TTS, with the delay of each response or chat
+// chunk. The TTS audio is the silent.aac in work dir.
+func startMockProviders(listen string, delay time.Duration) (*http.Server, error) {
+	silent, err := os.ReadFile("silent.aac")
+	if err != nil {
+		return nil, errors.Wrapf(err, "read silent.aac")
+	}
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/v1/audio/transcriptions", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"task":"transcribe","language":"english","duration":2.0,"text":"Hello, how are you?"}`))
+	})
+
+	handler.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		answer := "This is a mock answer for load testing. It is split to sentences by server. " +
+			"And each sentence is converted to speech."
+		for _, word := range strings.SplitAfter(answer, " ") {
+			time.Sleep(delay)
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"id": "mock", "object": "chat.completion.chunk", "model": "mock",
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": map[string]string{"content": word}}},
+			})
+			fmt.Fprintf(w, "data: %v\n\n", string(chunk))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+	})
+
+	handler.HandleFunc("/v1/audio/speech", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "audio/aac")
+		w.Write(silent)
+	})
+
+	server := &http.Server{Addr: listen, Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "Mock providers error: %v\n", err)
+		}
+	}()
+	return server, nil
+}
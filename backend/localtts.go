@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type localTTSConfig struct {
+	// The engine, piper or espeak.
+	Engine string
+	// The binary of engine, default to piper or espeak-ng.
+	Binary string
+	// The default voice, the model file for piper, or the voice name for espeak-ng.
+	Voice string
+	// The output format, wav or aac.
+	Format string
+}
+
+// Build the local TTS config for engine, by the getenv which read the env of tenant.
+func localTTSInit(ctx context.Context, engine string, getenv func(key string) string) (localAIConfig localTTSConfig, err error) {
+	localAIConfig.Engine = engine
+	switch engine {
+	case "piper":
+		localAIConfig.Binary = getenv("PIPER_BIN")
+		if localAIConfig.Binary == "" {
+			localAIConfig.Binary = "piper"
+		}
+		localAIConfig.Voice = getenv("PIPER_MODEL")
+	case "espeak":
+		localAIConfig.Binary = getenv("ESPEAK_BIN")
+		if localAIConfig.Binary == "" {
+			localAIConfig.Binary = "espeak-ng"
+		}
+		localAIConfig.Voice = getenv("ESPEAK_VOICE")
+		if localAIConfig.Voice == "" {
+			localAIConfig.Voice = "en"
+		}
+	default:
+		return localAIConfig, errors.Errorf("invalid local TTS engine %v", engine)
+	}
+
+	localAIConfig.Format = getenv("AIT_LOCAL_TTS_FORMAT")
+	if localAIConfig.Format == "" {
+		localAIConfig.Format = "wav"
+	}
+	if localAIConfig.Format != "wav" && localAIConfig.Format != "aac" {
+		return localAIConfig, errors.Errorf("invalid AIT_LOCAL_TTS_FORMAT %v", localAIConfig.Format)
+	}
+
+	logger.Tf(ctx, "Local TTS config, engine=%v, bin=%v, voice=%v, format=%v",
+		localAIConfig.Engine, localAIConfig.Binary, localAIConfig.Voice, localAIConfig.Format)
+	return
+}
+
+type localTTSService struct {
+	// The local TTS config.
+	aiConfig localTTSConfig
+}
+
+func NewLocalTTSService(opts ...func(service *localTTSService)) TTSService {
+	v := &localTTSService{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *localTTSService) RequestTTS(ctx context.Context, buildOutput func(ext string) io.Writer, text, voice string) error {
+	if voice == "" {
+		voice = v.aiConfig.Voice
+	}
+
+	// The engines require the WAV file, so we read it to the output, then remove it.
+	f, err := os.CreateTemp(workDir, "assistant-*-tts.wav")
+	if err != nil {
+		return errors.Wrapf(err, "create temp")
+	}
+	wavFile := f.Name()
+	f.Close()
+	defer os.Remove(wavFile)
+
+	// Feed the text by stdin, never as argument, which might be parsed as options.
+	var cmd *exec.Cmd
+	if v.aiConfig.Engine == "piper" {
+		if voice == "" {
+			return errors.New("PIPER_MODEL is required")
+		}
+		cmd = exec.CommandContext(ctx, v.aiConfig.Binary, "--model", voice, "--output_file", wavFile)
+	} else {
+		cmd = exec.CommandContext(ctx, v.aiConfig.Binary, "-v", voice, "-w", wavFile, "--stdin")
+	}
+	cmd.Stdin = strings.NewReader(text)
+
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "run %v, output is %v", v.aiConfig.Binary, string(b))
+	}
+
+	wav, err := os.Open(wavFile)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", wavFile)
+	}
+	defer wav.Close()
+
+	if v.aiConfig.Format == "aac" {
+		if err := transcodeAudio(ctx, wav, buildOutput("aac"),
+			"-c:a", "aac", "-ac", "1", "-b:a", "64k", "-f", "adts",
+		); err != nil {
+			return errors.Wrapf(err, "transcode")
+		}
+		return nil
+	}
+
+	if _, err := io.Copy(buildOutput("wav"), wav); err != nil {
+		return errors.Wrapf(err, "copy %v", wavFile)
+	}
+	return nil
+}
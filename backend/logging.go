@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The levels of logger, from verbose to critical.
+var logLevels = []string{"info", "trace", "warn", "error"}
+
+// Initialize the logger by AIT_LOG_FORMAT and AIT_LOG_LEVEL, which replaces the loggers of go-oryx-lib,
+// so all logs of logger.Tf and others are in the same format.
+func loggingInit(ctx context.Context, conf *Config) error {
+	level, format := conf.LogLevel, conf.LogFormat
+
+	enabled := -1
+	for i, l := range logLevels {
+		if l == level {
+			enabled = i
+		}
+	}
+	if enabled < 0 {
+		return errors.Errorf("invalid AIT_LOG_LEVEL %v, should be %v", level, strings.Join(logLevels, ","))
+	}
+
+	// Build the logger for each level, discard it if lower than the enabled level.
+	loggers := make([]logger.Logger, len(logLevels))
+	for i, l := range logLevels {
+		if i < enabled {
+			loggers[i] = logger.NewLoggerPlus(log.New(ioutil.Discard, "", 0))
+		} else if format == "json" {
+			loggers[i] = NewJSONLogger(func(v *jsonLogger) {
+				v.level, v.w = l, os.Stdout
+			})
+		} else {
+			var w io.Writer = os.Stdout
+			if l == "warn" || l == "error" {
+				w = os.Stderr
+			}
+			loggers[i] = logger.NewLoggerPlus(log.New(w, fmt.Sprintf("[%v] ", l), log.Ldate|log.Ltime|log.Lmicroseconds))
+		}
+	}
+	logger.Info, logger.Trace, logger.Warn, logger.Error = loggers[0], loggers[1], loggers[2], loggers[3]
+
+	logger.Tf(ctx, "Logging: format=%v, level=%v", format, level)
+	return nil
+}
+
+// The logFields are the fields of context, to identify the stage, request and segment.
+type logFields struct {
+	SID   string `json:"sid,omitempty"`
+	RID   string `json:"rid,omitempty"`
+	ASID  string `json:"asid,omitempty"`
+	Robot string `json:"robot,omitempty"`
+	Step  string `json:"step,omitempty"`
+}
+
+type logFieldsKey struct{}
+
+// Create a context with the fields in key and value pairs, inherit the fields of parent. The key is
+// sid, rid, asid, robot or step. For example:
+//
+//	ctx = withLogFields(ctx, "rid", rid, "step", "asr")
+func withLogFields(ctx context.Context, kvs ...string) context.Context {
+	var fields logFields
+	if parent, ok := ctx.Value(logFieldsKey{}).(*logFields); ok {
+		fields = *parent
+	}
+
+	for i := 0; i+1 < len(kvs); i += 2 {
+		switch kvs[i] {
+		case "sid":
+			fields.SID = kvs[i+1]
+		case "rid":
+			fields.RID = kvs[i+1]
+		case "asid":
+			fields.ASID = kvs[i+1]
+		case "robot":
+			fields.Robot = kvs[i+1]
+		case "step":
+			fields.Step = kvs[i+1]
+		}
+	}
+
+	return context.WithValue(ctx, logFieldsKey{}, &fields)
+}
+
+// The jsonLogger writes a JSON object for each line, with the fields of context, see withLogFields.
+type jsonLogger struct {
+	// The level of logger, such as trace.
+	level string
+	// The writer of logs.
+	w io.Writer
+	// The lock to write lines in order.
+	lock sync.Mutex
+}
+
+func NewJSONLogger(opts ...func(*jsonLogger)) *jsonLogger {
+	v := &jsonLogger{w: os.Stdout}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *jsonLogger) Println(ctx logger.Context, a ...interface{}) {
+	v.write(ctx, strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+}
+
+func (v *jsonLogger) Printf(ctx logger.Context, format string, a ...interface{}) {
+	v.write(ctx, fmt.Sprintf(format, a...))
+}
+
+func (v *jsonLogger) write(ctx logger.Context, msg string) {
+	line := struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		PID   int    `json:"pid"`
+		*logFields
+		Message string `json:"msg"`
+	}{
+		Time: time.Now().Format(time.RFC3339Nano), Level: v.level, PID: os.Getpid(), Message: msg,
+	}
+	if ctx, ok := ctx.(context.Context); ok && ctx != nil {
+		line.logFields, _ = ctx.Value(logFieldsKey{}).(*logFields)
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.w.Write(append(b, '\n'))
+}
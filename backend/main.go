@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -9,13 +10,12 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"flag"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
 	"github.com/ossrs/go-oryx-lib/errors"
 	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
-	"github.com/sashabaranov/go-openai"
 	"io"
 	"math/big"
 	"net/http"
@@ -24,18 +24,17 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 var talkServer *TalkServer
 var workDir string
-var robots []*Robot
-var asrService ASRService
-var ttsService TTSService
 
 type ASRResult struct {
 	Text     string
@@ -43,11 +42,14 @@ type ASRResult struct {
 }
 
 type ASRService interface {
-	RequestASR(ctx context.Context, filepath, language, prompt string, onBeforeRequest func()) (*ASRResult, error)
+	// Request ASR of the input audio in opus or aac.
+	RequestASR(ctx context.Context, input []byte, language, prompt string, onBeforeRequest func()) (*ASRResult, error)
 }
 
 type TTSService interface {
-	RequestTTS(ctx context.Context, buildFilepath func(ext string) string, text string) error
+	// Request TTS of text, by the voice of robot, or the default voice of service if empty.
+	// The audio is written to the output built by the extension, such as aac or wav.
+	RequestTTS(ctx context.Context, buildOutput func(ext string) io.Writer, text, voice string) error
 }
 
 // The Robot is a robot that user can talk with.
@@ -70,16 +72,18 @@ type Robot struct {
 	chatModel string
 	// AI Chat message window.
 	chatWindow int
-}
-
-// Get the robot by uuid.
-func GetRobot(uuid string) *Robot {
-	for _, robot := range robots {
-		if robot.uuid == uuid {
-			return robot
-		}
-	}
-	return nil
+	// AI Chat provider, openai or ollama.
+	chatProvider string
+	// AI Chat model options, such as num_ctx, temperature and stop for Ollama.
+	chatOptions map[string]interface{}
+	// The access list of subjects or groups, empty for public robot.
+	access []string
+	// The names of tools which can be called by AI chat.
+	tools []string
+	// The knowledge base of documents, nil if not set.
+	knowledge *KnowledgeBase
+	// The TTS voice, empty to use the default voice of TTS service.
+	ttsVoice string
 }
 
 func (v Robot) String() string {
@@ -88,8 +92,23 @@ func (v Robot) String() string {
 	if v.prefix != "" {
 		sb.WriteString(fmt.Sprintf(",prefix:%v", v.prefix))
 	}
-	sb.WriteString(fmt.Sprintf(",voice=%v,limit=%v,model=%v,window=%v,prompt:%v",
-		v.voice, v.replyLimit, v.chatModel, v.chatWindow, v.prompt))
+	sb.WriteString(fmt.Sprintf(",voice=%v,limit=%v,provider=%v,model=%v,window=%v,prompt:%v",
+		v.voice, v.replyLimit, v.chatProvider, v.chatModel, v.chatWindow, v.prompt))
+	if len(v.chatOptions) > 0 {
+		sb.WriteString(fmt.Sprintf(",options=%v", v.chatOptions))
+	}
+	if len(v.access) > 0 {
+		sb.WriteString(fmt.Sprintf(",access=%v", strings.Join(v.access, "|")))
+	}
+	if len(v.tools) > 0 {
+		sb.WriteString(fmt.Sprintf(",tools=%v", strings.Join(v.tools, "|")))
+	}
+	if v.knowledge != nil {
+		sb.WriteString(fmt.Sprintf(",knowledge=%v", v.knowledge.dir))
+	}
+	if v.ttsVoice != "" {
+		sb.WriteString(fmt.Sprintf(",ttsVoice=%v", v.ttsVoice))
+	}
 	return sb.String()
 }
 
@@ -98,6 +117,14 @@ func (v Robot) String() string {
 type Stage struct {
 	// Stage UUID
 	sid string
+	// The access token of stage, required by all requests of this stage.
+	token string
+	// The principal who created this stage, nil for anonymous.
+	principal *Principal
+	// The tenant of stage.
+	tenant *Tenant
+	// The config of stage, for the timeout and files.
+	conf *Config
 	// Last update of stage.
 	update time.Time
 	// The TTS worker for this stage.
@@ -109,7 +136,9 @@ type Stage struct {
 	// Previous chat text, to use as prompt for next chat.
 	previousUser, previousAssitant string
 	// The chat history, to use as prompt for next chat.
-	histories []openai.ChatCompletionMessage
+	histories *ChatHistory
+	// The rolling summary of dropped chat history.
+	summary *ChatSummary
 	// Whether the stage is generating more sentences.
 	generating bool
 
@@ -133,16 +162,26 @@ type Stage struct {
 	lastRequestTTS time.Time
 	// The time for last download the TTS result, the first segment.
 	lastDownloadAudio time.Time
+
+	// The lock to protect the state of turns, which is written by handlers, chat and TTS goroutines,
+	// such as the update, generating, previous texts and timestamps.
+	lock sync.Mutex
 }
 
 func NewStage(opts ...func(*Stage)) *Stage {
 	v := &Stage{
 		// Create new UUID.
 		sid: uuid.NewString(),
+		// The stage access token.
+		token: newStageToken(),
 		// Update time.
 		update: time.Now(),
 		// The TTS worker.
 		ttsWorker: NewTTSWorker(),
+		// The chat history.
+		histories: NewChatHistory(),
+		// The chat summary.
+		summary: NewChatSummary(),
 	}
 
 	for _, opt := range opts {
@@ -155,22 +194,214 @@ func (v *Stage) Close() error {
 	return v.ttsWorker.Close()
 }
 
-func (v *Stage) Expired() bool {
-	if os.Getenv("AIT_DEVELOPMENT") == "true" {
-		return time.Since(v.update) > 30*time.Second
+// Whether the stage is busy, generating the answer or doing TTS.
+func (v *Stage) Busy() bool {
+	return v.Generating() || v.ttsWorker.Busy()
+}
+
+// Whether the stage is generating more sentences.
+func (v *Stage) Generating() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.generating
+}
+
+// Set whether generating, which is shared with other replicas, and the turn is saved when done.
+func (v *Stage) SetGenerating(generating bool) {
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		v.generating = generating
+	}()
+
+	ctx := v.loggingCtx
+	if err := stageStore.SetGenerating(ctx, v, generating); err != nil {
+		logger.Wf(ctx, "Stage: Share generating of %v failed, err %v", v.sid, err)
+	}
+	if !generating {
+		if err := stageStore.SaveStage(ctx, v); err != nil {
+			logger.Wf(ctx, "Stage: Save %v failed, err %v", v.sid, err)
+		}
+	}
+}
+
+// Whether the stage is generating on this or any other replica.
+func (v *Stage) GeneratingOnAnyReplica(ctx context.Context) bool {
+	return v.Generating() || stageStore.Generating(ctx, v.sid)
+}
+
+// Get the state of turns, the previous texts and the history.
+func (v *Stage) TurnState() (user, assistant, asr string, histories [][2]string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.previousUser, v.previousAssitant, v.previousAsrText, v.histories.Texts()
+}
+
+// Set the state of turns, for example, the turn is done by other replica.
+func (v *Stage) SetTurnState(user, assistant, asr string, histories [][2]string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.previousUser, v.previousAssitant, v.previousAsrText = user, assistant, asr
+	v.histories.Reset(histories)
+}
+
+// Get the previous ASR text, the prompt for next ASR.
+func (v *Stage) PreviousAsrText() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.previousAsrText
+}
+
+// Begin a chat turn, append the previous turn to history, and return the question of this turn.
+func (v *Stage) BeginChatTurn() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.previousUser != "" && v.previousAssitant != "" {
+		v.histories.Append(v.previousUser, v.previousAssitant)
+	}
+
+	v.previousUser = v.previousAsrText
+	v.previousAssitant = ""
+	return v.previousAsrText
+}
+
+// When got a sentence of assistant, use it for the history of chat, and the prompt of next ASR.
+func (v *Stage) OnAssistantSentence(sentence string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.previousAssitant += sentence + " "
+	// We utilize user ASR and AI responses as prompts for the subsequent ASR, given that this is
+	// a chat-based scenario where the user converses with the AI, and the following audio should pertain to both user and AI text.
+	v.previousAsrText += " " + sentence
+}
+
+// When user start a conversation, a sentence to ask.
+func (v *Stage) OnStartConversation() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lastSentence = time.Now()
+}
+
+func (v *Stage) OnUploadAudio() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lastUploadAudio = time.Now()
+}
+
+func (v *Stage) OnExtractAudio() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lastExtractAudio = time.Now()
+}
+
+// When got the ASR text, use it as prompt for next ASR.
+func (v *Stage) OnASR(text string, duration time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.previousAsrText = text
+	v.lastRequestASR = time.Now()
+	v.lastAsrDuration = duration
+	v.lastRequestAsrText = text
+}
+
+// When got the first response of chat.
+func (v *Stage) OnFirstChat(text string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lastRequestChat = time.Now()
+	v.lastRobotFirstText = text
+}
+
+// When the TTS of first segment is done.
+func (v *Stage) OnFirstTTS() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lastRequestTTS = time.Now()
+}
+
+// When user download the first segment, return the elapsed cost of all steps for logging.
+func (v *Stage) OnFirstDownload() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lastDownloadAudio = time.Now()
+	speech := float64(v.lastAsrDuration) / float64(time.Second)
+	return fmt.Sprintf("total=%.1fs, steps=[upload=%.1fs,exta=%.1fs,asr=%.1fs,chat=%.1fs,tts=%.1fs,download=%.1fs], ask=%v, speech=%.1fs, answer=%v",
+		v.total(), v.upload(), v.exta(), v.asr(), v.chat(), v.tts(), v.download(),
+		v.lastRequestAsrText, speech, v.lastRobotFirstText)
+}
+
+// Remove all files of stage in storage.
+func (v *Stage) RemoveFiles(ctx context.Context) {
+	if v.conf.KeepFiles {
+		return
 	}
+	// The stage is still alive on other replica, which removes the files when expired.
+	if stageStore.Alive(ctx, v.sid) {
+		logger.Tf(ctx, "Stage: Keep files of %v for alive on other replica", v.sid)
+		return
+	}
+	if err := audioStorage.RemoveAll(ctx, v.StorageKey("")); err != nil {
+		logger.Wf(ctx, "Stage: Remove files of %v failed, err %v", v.sid, err)
+	}
+}
 
-	if to, err := strconv.ParseInt(os.Getenv("AIT_STAGE_TIMEOUT"), 10, 64); err == nil {
-		return time.Since(v.update) > time.Duration(to)*time.Second
+func (v *Stage) Expired() bool {
+	return time.Now().After(v.ExpireAt())
+}
+
+// Get the time when stage expires, if not kept alive.
+func (v *Stage) ExpireAt() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.conf.Development {
+		return v.update.Add(30 * time.Second)
 	}
 
-	return time.Since(v.update) > 300*time.Second
+	return v.update.Add(v.conf.StageTimeout)
 }
 
 func (v *Stage) KeepAlive() {
-	v.update = time.Now()
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		v.update = time.Now()
+	}()
+
+	if err := stageStore.Touch(v.loggingCtx, v); err != nil {
+		logger.Wf(v.loggingCtx, "Stage: Touch %v failed, err %v", v.sid, err)
+	}
 }
 
+// Get the last update time of stage.
+func (v *Stage) LastUpdate() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.update
+}
+
+// Get the key in storage of file, all files of stage are in the prefix of stage.
+func (v *Stage) StorageKey(name string) string {
+	return fmt.Sprintf("%v/%v", v.sid, name)
+}
+
+// The elapsed cost of steps, the caller should hold the lock.
 func (v *Stage) total() float64 {
 	if v.lastDownloadAudio.After(v.lastSentence) {
 		return float64(v.lastDownloadAudio.Sub(v.lastSentence)) / float64(time.Second)
@@ -228,8 +459,8 @@ type AnswerSegment struct {
 	asid string
 	// The text of this answer segment.
 	text string
-	// The TTS file path.
-	ttsFile string
+	// The TTS audio, in memory or file.
+	tts *AudioBuffer
 	// Whether TTS is done, ready to play.
 	ready bool
 	// Whether TTS is error, failed.
@@ -238,10 +469,29 @@ type AnswerSegment struct {
 	dummy bool
 	// Signal to remove the TTS file immediately.
 	removeSignal chan bool
+	// Closed when TTS is finished, ready or failed.
+	done chan bool
 	// Whether we have logged this segment.
 	logged bool
 	// Whether the segment is the first response.
 	first bool
+	// The robot which generates this segment.
+	robot *Robot
+	// The created time, to order the segments of request.
+	created time.Time
+	// Whether the segment is loaded from other replica, which is not notified when TTS is done.
+	remote bool
+	// The span of chat which generates this segment, the parent of TTS and download spans, nil if
+	// tracing is disabled.
+	span *Span
+	// The transcoded TTS audios, map format to audio.
+	transcoded map[string]*AudioBuffer
+	// The lock to transcode the TTS file.
+	transcodeLock sync.Mutex
+
+	// The lock to protect the status, which is written by TTS goroutine and read by handlers, such
+	// as the tts, ready, err and logged.
+	lock sync.Mutex
 }
 
 func NewAnswerSegment(opts ...func(segment *AnswerSegment)) *AnswerSegment {
@@ -252,6 +502,10 @@ func NewAnswerSegment(opts ...func(segment *AnswerSegment)) *AnswerSegment {
 		asid: uuid.NewString(),
 		// Signal to remove the TTS file.
 		removeSignal: make(chan bool, 1),
+		// Signal when TTS is finished.
+		done: make(chan bool),
+		// Created time.
+		created: time.Now(),
 	}
 
 	for _, opt := range opts {
@@ -260,10 +514,79 @@ func NewAnswerSegment(opts ...func(segment *AnswerSegment)) *AnswerSegment {
 	return v
 }
 
+// The shutdownError is an error when server is shutting down, which response with HTTP 503.
+type shutdownError struct {
+	msg string
+}
+
+func newShutdownError(format string, a ...interface{}) error {
+	return errors.WithStack(&shutdownError{msg: fmt.Sprintf(format, a...)})
+}
+
+func (v *shutdownError) Error() string {
+	return v.msg
+}
+
+func (v *shutdownError) Status() int {
+	return http.StatusServiceUnavailable
+}
+
+// Finish the TTS of segment, ready if no error, and notify the waiters.
+func (v *AnswerSegment) Finish(tts *AudioBuffer, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err != nil {
+		v.err = err
+	} else {
+		v.tts, v.ready = tts, true
+	}
+	close(v.done)
+}
+
+// Get the TTS audio, nil if not ready.
+func (v *AnswerSegment) TTS() *AudioBuffer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.tts
+}
+
+// Get the error of TTS.
+func (v *AnswerSegment) Err() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.err
+}
+
+// Whether the segment is processing, the dummy segment or TTS is not finished.
+func (v *AnswerSegment) Processing() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.dummy || (!v.ready && v.err == nil)
+}
+
+// Mark the segment as logged, return false if already logged, because the browser may request
+// multiple times.
+func (v *AnswerSegment) MarkLogged() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.logged {
+		return false
+	}
+	v.logged = true
+	return true
+}
+
 // The TalkServer is the AI talk server, manage stages.
 type TalkServer struct {
 	// All stages created by user.
-	stages []*Stage
+	stages *StageRegistry
+	// The config of server, for the stages.
+	conf *Config
 
 	// Total conversations.
 	conversations uint64
@@ -272,83 +595,202 @@ type TalkServer struct {
 	// Total badcases.
 	badcases uint64
 
+	// Whether server is shutting down, which rejects new stages and turns.
+	closing bool
+	// The in-flight turns, which are uploading questions.
+	turns int
+	// The lock to load the stages from other replica.
+	loadLock sync.Mutex
+
 	// The lock to protect fields.
 	lock sync.Mutex
 }
 
-func NewTalkServer() *TalkServer {
-	return &TalkServer{
-		stages: []*Stage{},
+func NewTalkServer(opts ...func(server *TalkServer)) *TalkServer {
+	v := &TalkServer{}
+	for _, opt := range opts {
+		opt(v)
 	}
+
+	v.stages = NewStageRegistry(func(registry *StageRegistry) {
+		registry.maxStages = v.conf.MaxLiveStages
+	})
+	return v
 }
 
-func (v *TalkServer) Close() error {
+// Close all stages and their TTS workers, and remove the files of stages. Note that the ctx should be
+// cancelled before close, to quit the expiry scheduler and the TTS workers.
+func (v *TalkServer) Close(ctx context.Context) error {
+	nn := v.stages.Close(ctx)
+	logger.Tf(ctx, "Shutdown: Close %v stages ok", nn)
 	return nil
 }
 
-func (v *TalkServer) NewBadcase() {
+// Run the expiry scheduler of stages, until ctx is done.
+func (v *TalkServer) Run(ctx context.Context) {
+	v.stages.Run(ctx)
+}
+
+// Start to shutdown, reject the new stages and turns.
+func (v *TalkServer) Shutdown() {
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	v.badcases++
+	v.closing = true
 }
 
-func (v *TalkServer) NewError() {
+// Wait for the in-flight turns to finish, until all stages are idle, or ctx is done.
+func (v *TalkServer) Drain(ctx context.Context) error {
+	for {
+		var busy int
+		func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			busy = v.turns
+		}()
+
+		for _, stage := range v.stages.Stages() {
+			if stage.Busy() {
+				busy++
+			}
+		}
+
+		if busy == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "drain, busy=%v", busy)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Check whether server is available for new stages.
+func (v *TalkServer) Available() error {
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	v.errors++
+	if v.closing {
+		return newShutdownError("server is shutting down")
+	}
+	return nil
 }
 
-func (v *TalkServer) NewConversation() {
+// Start a turn, which is rejected if server is shutting down.
+func (v *TalkServer) StartTurn() error {
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	v.conversations++
+	if v.closing {
+		return newShutdownError("server is shutting down")
+	}
+	v.turns++
+	return nil
 }
 
-func (v *TalkServer) AddStage(stage *Stage) {
+func (v *TalkServer) EndTurn() {
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	v.stages = append(v.stages, stage)
+	v.turns--
 }
 
-func (v *TalkServer) RemoveStage(stage *Stage) {
+func (v *TalkServer) String() string {
+	stages := v.CountStage()
+
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	for i, s := range v.stages {
-		if s.sid == stage.sid {
-			v.stages = append(v.stages[:i], v.stages[i+1:]...)
-			return
-		}
-	}
+	return fmt.Sprintf("stages=%v, chats=%v, errors=%v, badcases=%v",
+		stages, v.conversations, v.errors, v.badcases)
 }
 
-func (v *TalkServer) CountStage() int {
+func (v *TalkServer) NewBadcase(tenant *Tenant) {
+	tenant.NewBadcase()
+
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	return len(v.stages)
+	v.badcases++
 }
 
-func (v *TalkServer) QueryStage(rid string) *Stage {
+func (v *TalkServer) NewError(tenant *Tenant) {
+	tenant.NewError()
+
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	for _, s := range v.stages {
-		if s.sid == rid {
-			return s
-		}
+	v.errors++
+}
+
+func (v *TalkServer) NewConversation(tenant *Tenant) error {
+	if err := tenant.NewConversation(); err != nil {
+		return err
 	}
 
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.conversations++
 	return nil
 }
 
+func (v *TalkServer) AddStage(stage *Stage) error {
+	return v.stages.Add(stage)
+}
+
+func (v *TalkServer) CountStage() int {
+	return v.stages.Count()
+}
+
+// Query the stage by sid, or load it from Redis if created by other replica.
+func (v *TalkServer) QueryStage(ctx context.Context, sid string) *Stage {
+	if stage := v.stages.Query(sid); stage != nil || stageStore == nil {
+		return stage
+	}
+
+	// Load the stages one by one, to never load a stage for multiple times.
+	v.loadLock.Lock()
+	defer v.loadLock.Unlock()
+
+	if stage := v.stages.Query(sid); stage != nil {
+		return stage
+	}
+
+	stage, err := stageStore.LoadStage(ctx, sid)
+	if err != nil {
+		logger.Wf(ctx, "Stage: Load %v failed, err %v", sid, err)
+		return nil
+	}
+	if stage == nil {
+		return nil
+	}
+
+	if err := stage.tenant.AcquireStage(); err != nil {
+		logger.Wf(ctx, "Stage: Load %v failed, err %v", sid, err)
+		return nil
+	}
+
+	if err := v.stages.Add(stage); err != nil {
+		stage.tenant.ReleaseStage()
+		logger.Wf(ctx, "Stage: Load %v failed, err %v", sid, err)
+		return nil
+	}
+	logger.Tf(stage.loggingCtx, "Stage: Load stage sid=%v from other replica, tenant=%v, principal=%v, all=%v",
+		stage.sid, stage.tenant.id, stage.principal, v.CountStage())
+	return stage
+}
+
 // The TTSWorker is a worker to convert answers from text to audio.
 type TTSWorker struct {
 	segments []*AnswerSegment
+	// Whether closed, which rejects new segments.
+	closed bool
+	// Whether text only, the segment is ready without TTS, for example, the chat of CLI.
+	textOnly bool
 	lock     sync.Mutex
 	wg       sync.WaitGroup
 }
@@ -360,11 +802,45 @@ func NewTTSWorker() *TTSWorker {
 }
 
 func (v *TTSWorker) Close() error {
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		v.closed = true
+	}()
+
 	v.wg.Wait()
 	return nil
 }
 
-func (v *TTSWorker) QuerySegment(rid, asid string) *AnswerSegment {
+// Whether there is any segment doing TTS.
+func (v *TTSWorker) Busy() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, s := range v.segments {
+		if !s.dummy && s.Processing() {
+			return true
+		}
+	}
+	return false
+}
+
+// Query the segment, or load it from Redis if processed by other replica.
+func (v *TTSWorker) QuerySegment(ctx context.Context, stage *Stage, rid, asid string) *AnswerSegment {
+	if s := v.find(rid, asid); s != nil {
+		return s
+	}
+
+	s, err := stageStore.QuerySegment(ctx, stage, rid, asid)
+	if err != nil {
+		logger.Wf(ctx, "TTS: Load segment %v failed, err %v", asid, err)
+		return nil
+	}
+	return s
+}
+
+func (v *TTSWorker) find(rid, asid string) *AnswerSegment {
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
@@ -388,8 +864,8 @@ func (v *TTSWorker) QueryAnyReadySegment(ctx context.Context, stage *Stage, rid
 		// if the first sentence is very short, maybe we got it quickly, but the second sentence is very
 		// long so that the AI need more time to generate it.
 		var s *AnswerSegment
-		for ctx.Err() == nil && s == nil && stage.generating {
-			if s = v.query(rid); s == nil {
+		for ctx.Err() == nil && s == nil && stage.GeneratingOnAnyReplica(ctx) {
+			if s = v.queryShared(ctx, stage, rid); s == nil {
 				select {
 				case <-ctx.Done():
 				case <-time.After(100 * time.Millisecond):
@@ -398,7 +874,7 @@ func (v *TTSWorker) QueryAnyReadySegment(ctx context.Context, stage *Stage, rid
 		}
 
 		// Try to fetch one again, because maybe there is new segment.
-		s = v.query(rid)
+		s = v.queryShared(ctx, stage, rid)
 
 		// All segments are consumed, we return nil.
 		if s == nil {
@@ -410,8 +886,15 @@ func (v *TTSWorker) QueryAnyReadySegment(ctx context.Context, stage *Stage, rid
 			continue
 		}
 
+		// The segment of other replica is never notified, so we query it again.
+		if s.remote && s.Processing() {
+			continue
+		}
+
 		// When segment is finished(ready or error), we return it.
-		if s.ready || s.err != nil {
+		select {
+		case <-ctx.Done():
+		case <-s.done:
 			return s
 		}
 	}
@@ -432,26 +915,75 @@ func (v *TTSWorker) query(rid string) *AnswerSegment {
 	return nil
 }
 
-func (v *TTSWorker) RemoveSegment(asid string) {
-	v.lock.Lock()
-	defer v.lock.Unlock()
+// Query the first segment of request. The index in Redis is the source of truth, because the segment
+// might be removed by other replica, but we prefer the local segment which is notified when TTS is done.
+func (v *TTSWorker) queryShared(ctx context.Context, stage *Stage, rid string) *AnswerSegment {
+	if stageStore == nil {
+		return v.query(rid)
+	}
 
-	for i, s := range v.segments {
-		if s.asid == asid {
-			v.segments = append(v.segments[:i], v.segments[i+1:]...)
-			return
+	s, err := stageStore.FirstSegment(ctx, stage, rid)
+	if err != nil {
+		logger.Wf(ctx, "TTS: Load segments of %v failed, err %v", rid, err)
+		return v.query(rid)
+	}
+	if s == nil {
+		return nil
+	}
+
+	if local := v.find(rid, s.asid); local != nil {
+		return local
+	}
+	return s
+}
+
+// Remove the segment, and from the index in Redis.
+func (v *TTSWorker) RemoveSegment(ctx context.Context, stage *Stage, asid string) {
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		for i, s := range v.segments {
+			if s.asid == asid {
+				v.segments = append(v.segments[:i], v.segments[i+1:]...)
+				return
+			}
 		}
+	}()
+
+	if err := stageStore.RemoveSegment(ctx, stage.sid, asid); err != nil {
+		logger.Wf(ctx, "TTS: Remove segment %v failed, err %v", asid, err)
 	}
 }
 
 func (v *TTSWorker) SubmitSegment(ctx context.Context, stage *Stage, segment *AnswerSegment) {
-	// Append the sentence to queue.
-	func() {
+	// The TTS task is also waited by the turn, which submits the segment.
+	tasks := turnTasksFromContext(ctx)
+
+	// Append the sentence to queue, and reserve the goroutine of TTS task, which is waited by Close.
+	if closed := func() bool {
 		v.lock.Lock()
 		defer v.lock.Unlock()
 
+		if v.closed {
+			return true
+		}
+
 		v.segments = append(v.segments, segment)
-	}()
+		if !segment.dummy {
+			v.wg.Add(1)
+			tasks.Add()
+		}
+		return false
+	}(); closed {
+		logger.Wf(ctx, "TTS: Ignore segment %v for worker closed", segment.asid)
+		return
+	}
+
+	// Share the segment with other replicas, before removing the dummy sentence.
+	if err := stageStore.SaveSegment(ctx, stage, segment); err != nil {
+		logger.Wf(ctx, "TTS: Save segment %v failed, err %v", segment.asid, err)
+	}
 
 	// Ignore the dummy sentence.
 	if segment.dummy {
@@ -460,27 +992,69 @@ func (v *TTSWorker) SubmitSegment(ctx context.Context, stage *Stage, segment *An
 
 	// Now that we have a real sentence, we should remove the dummy sentence.
 	if dummy := v.query(segment.rid); dummy != nil && dummy.dummy {
-		v.RemoveSegment(dummy.asid)
+		v.RemoveSegment(ctx, stage, dummy.asid)
 	}
 
 	// Start a goroutine to do TTS task.
-	v.wg.Add(1)
 	go func() {
 		defer v.wg.Done()
+		defer tasks.Done()
+
+		if v.textOnly {
+			segment.Finish(nil, nil)
+			return
+		}
+
+		ctx := withLogFields(ctx, "asid", segment.asid, "step", "tts")
+		ctx, span := startSpan(ctx, "tts", withSpanKind(spanKindClient))
+		span.SetAttributes("asid", segment.asid, "first", segment.first, "text.length", len(segment.text))
+
+		var voice string
+		if segment.robot != nil {
+			voice = segment.robot.ttsVoice
+		}
+
+		var tts *AudioBuffer
+		err := stage.tenant.ttsService.RequestTTS(ctx, func(ext string) io.Writer {
+			tts = NewAudioBuffer(withAudioConfig(stage.conf), func(buffer *AudioBuffer) {
+				buffer.ext = ext
+				buffer.key = stage.StorageKey(
+					fmt.Sprintf("assistant-%v-sentence-%v-tts.%v", segment.rid, segment.asid, ext),
+				)
+			})
+			return tts
+		}, segment.text, voice)
+		if err == nil && tts == nil {
+			err = errors.New("no tts output")
+		}
+		if tts != nil {
+			if r0 := tts.Close(ctx); r0 != nil && err == nil {
+				err = errors.Wrapf(r0, "close tts")
+			}
+		}
+
+		span.End(err)
 
-		if err := ttsService.RequestTTS(ctx, func(ext string) string {
-			segment.ttsFile = path.Join(workDir,
-				fmt.Sprintf("assistant-%v-sentence-%v-tts.%v", segment.rid, segment.asid, ext),
-			)
-			return segment.ttsFile
-		}, segment.text); err != nil {
-			segment.err = err
+		if err != nil {
+			segment.Finish(nil, err)
+			if tts != nil {
+				tts.Remove(ctx)
+			}
 		} else {
-			segment.ready = true
+			segment.Finish(tts, nil)
 			if segment.first {
-				stage.lastRequestTTS = time.Now()
+				stage.OnFirstTTS()
 			}
-			logger.Tf(ctx, "File saved to %v, %v", segment.ttsFile, segment.text)
+			logger.Tf(ctx, "TTS saved to %v, %v", tts, segment.text)
+
+			usageAccount.Record(ctx, stage, segment.robot, segment.rid, &Usage{
+				TTSChars: utf8.RuneCountInString(segment.text),
+			})
+		}
+
+		// Share the TTS result, so that any replica can serve it from storage.
+		if err := stageStore.SaveSegment(ctx, stage, segment); err != nil {
+			logger.Wf(ctx, "TTS: Save segment %v failed, err %v", segment.asid, err)
 		}
 
 		// Start a goroutine to remove the sentence.
@@ -490,17 +1064,25 @@ func (v *TTSWorker) SubmitSegment(ctx context.Context, stage *Stage, segment *An
 
 			select {
 			case <-ctx.Done():
+				// Keep the shared segment for other replicas, which is removed with the stage.
+				if stageStore != nil {
+					return
+				}
 			case <-time.After(300 * time.Second):
 			case <-segment.removeSignal:
 			}
 
-			logger.Tf(ctx, "Remove %v %v", segment.asid, segment.ttsFile)
+			logger.Tf(ctx, "Remove %v %v", segment.asid, segment.TTS())
+
+			// Use a new context to remove the segment and stored audio, because the ctx might be cancelled.
+			removeCtx, removeCancel := context.WithTimeout(withoutCancel(ctx), 10*time.Second)
+			defer removeCancel()
 
-			stage.ttsWorker.RemoveSegment(segment.asid)
+			stage.ttsWorker.RemoveSegment(removeCtx, stage, segment.asid)
 
-			if segment.ttsFile != "" && os.Getenv("AIT_KEEP_FILES") != "true" {
-				if _, err := os.Stat(segment.ttsFile); err == nil {
-					os.Remove(segment.ttsFile)
+			if tts := segment.TTS(); tts != nil {
+				for _, tts := range append(segment.TranscodedAudios(), tts) {
+					tts.Remove(removeCtx)
 				}
 			}
 		}()
@@ -509,30 +1091,41 @@ func (v *TTSWorker) SubmitSegment(ctx context.Context, stage *Stage, segment *An
 
 // When user start a scenario or stage, response a stage object, which identified by sid or stage id.
 func handleStageStart(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	ctx = logger.WithContext(ctx)
+	tenant := resolveTenant(r)
+	principal, err := tenant.auth.authenticate(r)
+	if err != nil {
+		return errors.Wrapf(err, "auth")
+	}
+
+	if err := talkServer.Available(); err != nil {
+		return errors.Wrapf(err, "shutdown")
+	}
+
+	if err := tenant.AcquireStage(); err != nil {
+		return errors.Wrapf(err, "quota")
+	}
+
 	stage := NewStage(func(stage *Stage) {
-		stage.loggingCtx = ctx
+		stage.loggingCtx = withLogFields(logger.WithContext(ctx), "sid", stage.sid)
+		stage.principal = principal
+		stage.tenant = tenant
+		stage.conf = talkServer.conf
 	})
+	ctx = stage.loggingCtx
 
-	talkServer.AddStage(stage)
-	logger.Tf(ctx, "Stage: Create new stage sid=%v, all=%v", stage.sid, talkServer.CountStage())
-
-	go func() {
-		defer stage.Close()
+	// Share the stage with other replicas, before response it.
+	if err := stageStore.SaveStage(ctx, stage); err != nil {
+		tenant.ReleaseStage()
+		return errors.Wrapf(err, "save stage")
+	}
 
-		for ctx.Err() == nil {
-			select {
-			case <-ctx.Done():
-			case <-time.After(3 * time.Second):
-				if stage.Expired() {
-					logger.Tf(ctx, "Stage: Remove %v for expired, update=%v",
-						stage.sid, stage.update.Format(time.RFC3339))
-					talkServer.RemoveStage(stage)
-					return
-				}
-			}
-		}
-	}()
+	// Note that the shared stage in Redis expires by TTL, if failed to add it.
+	if err := talkServer.AddStage(stage); err != nil {
+		tenant.ReleaseStage()
+		return errors.Wrapf(err, "add stage")
+	}
+	logger.Tf(ctx, "Stage: Create new stage sid=%v, tenant=%v, principal=%v, all=%v",
+		stage.sid, tenant.id, principal, talkServer.CountStage())
 
 	type StageRobotResult struct {
 		UUID  string `json:"uuid"`
@@ -540,13 +1133,22 @@ func handleStageStart(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		Voice string `json:"voice"`
 	}
 	type StageResult struct {
-		StageID string             `json:"sid"`
-		Robots  []StageRobotResult `json:"robots"`
+		StageID    string             `json:"sid"`
+		StageToken string             `json:"stoken"`
+		Robots     []StageRobotResult `json:"robots"`
 	}
+	// Response empty robots rather than null, if all robots are hidden.
 	r0 := &StageResult{
-		StageID: stage.sid,
+		StageID:    stage.sid,
+		StageToken: stage.token,
+		Robots:     []StageRobotResult{},
 	}
-	for _, robot := range robots {
+	for _, robot := range tenant.robots {
+		// Hide the private robots which principal is not allowed to access.
+		if !robot.Allow(principal) {
+			continue
+		}
+
 		r0.Robots = append(r0.Robots, StageRobotResult{
 			UUID:  robot.uuid,
 			Label: robot.label,
@@ -566,21 +1168,64 @@ func handleStartConversation(ctx context.Context, w http.ResponseWriter, r *http
 		return errors.Errorf("empty sid")
 	}
 
-	stage := talkServer.QueryStage(sid)
+	stage := talkServer.QueryStage(ctx, sid)
 	if stage == nil {
 		return errors.Errorf("invalid sid %v", sid)
 	}
 
+	// Verify the stage access token.
+	if err := stage.Authorize(r); err != nil {
+		return errors.Wrapf(err, "auth")
+	}
+
 	// Keep alive the stage.
 	stage.KeepAlive()
-	stage.lastSentence = time.Now()
+	stage.OnStartConversation()
 
-	talkServer.NewConversation()
+	if err := talkServer.NewConversation(stage.tenant); err != nil {
+		return errors.Wrapf(err, "quota")
+	}
 
 	ohttp.WriteData(ctx, w, r, nil)
 	return nil
 }
 
+// The turnTasks waits for the chat and TTS tasks of a turn, which run after the upload responsed, to end
+// the span of turn when all done. All methods are no-op for nil, for example, the turns of CLI.
+type turnTasks struct {
+	wg sync.WaitGroup
+}
+
+func (v *turnTasks) Add() {
+	if v != nil {
+		v.wg.Add(1)
+	}
+}
+
+func (v *turnTasks) Done() {
+	if v != nil {
+		v.wg.Done()
+	}
+}
+
+func (v *turnTasks) Wait() {
+	if v != nil {
+		v.wg.Wait()
+	}
+}
+
+type turnTasksKey struct{}
+
+// Create a context with the tasks of turn, the chat and TTS in context are waited by the turn.
+func withTurnTasks(ctx context.Context, tasks *turnTasks) context.Context {
+	return context.WithValue(ctx, turnTasksKey{}, tasks)
+}
+
+func turnTasksFromContext(ctx context.Context) *turnTasks {
+	v, _ := ctx.Value(turnTasksKey{}).(*turnTasks)
+	return v
+}
+
 // When user ask a question, which is a request with audio, which is identified by rid (request id).
 func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	// The stage uuid, user must create it before upload question audio.
@@ -590,16 +1235,37 @@ func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *ht
 		return errors.Errorf("empty sid")
 	}
 
-	stage := talkServer.QueryStage(sid)
+	stage := talkServer.QueryStage(ctx, sid)
 	if stage == nil {
 		return errors.Errorf("invalid sid %v", sid)
 	}
 
+	// Verify the stage access token.
+	if err := stage.Authorize(r); err != nil {
+		return errors.Wrapf(err, "auth")
+	}
+
+	// Start a turn, which is drained when shutdown.
+	if err := talkServer.StartTurn(); err != nil {
+		return errors.Wrapf(err, "shutdown")
+	}
+	defer talkServer.EndTurn()
+
 	// Keep alive the stage.
 	stage.KeepAlive()
 	// Switch to the context of stage.
 	ctx = stage.loggingCtx
 
+	// Load the state of turns, because the previous turn might be done by other replica.
+	if err := stageStore.LoadTurn(ctx, stage); err != nil {
+		return errors.Wrapf(err, "load turn")
+	}
+
+	// The span of turn, from upload to the last TTS, the download is also in this trace.
+	var turnSpan *Span
+	// The chat and TTS tasks of turn, to end the span of turn when done.
+	tasks := &turnTasks{}
+
 	// Handle request and log with error.
 	if err := func() error {
 		// Get the robot to talk with.
@@ -608,22 +1274,45 @@ func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *ht
 			return errors.Errorf("empty robot")
 		}
 
-		robot := GetRobot(robotUUID)
+		robot := stage.tenant.GetRobot(robotUUID)
 		if robot == nil {
 			return errors.Errorf("invalid robot %v", robotUUID)
 		}
+		if !robot.Allow(stage.principal) {
+			return newAuthError("robot %v not allowed for %v", robotUUID, stage.principal)
+		}
 
 		// The rid is the request id, which identify this request, generally a question.
 		rid := uuid.NewString()
-		inputFile := path.Join(workDir, fmt.Sprintf("assistant-%v-input.audio", rid))
-		logger.Tf(ctx, "Stage: Got question sid=%v, umi=%v, robot=%v(%v), rid=%v, input=%v",
-			sid, q.Get("umi"), robot.uuid, robot.label, rid, inputFile)
-
-		// We save the input audio to *.audio file, it can be aac or opus codec.
-		if os.Getenv("AIT_KEEP_FILES") != "true" {
-			defer os.Remove(inputFile)
+		ctx = withLogFields(ctx, "rid", rid, "robot", robot.uuid, "step", "upload")
+		ctx, turnSpan = startSpan(ctx, "turn", withSpanKind(spanKindServer), withTraceParent(r.Header.Get("traceparent")))
+		turnSpan.SetAttributes("sid", sid, "rid", rid, "robot", robot.uuid, "tenant", stage.tenant.id)
+		ctx = withTurnTasks(ctx, tasks)
+
+		// Record the traffic of providers to the cassette of turn, or replay the recorded cassette.
+		var cassette *Cassette
+		if cassetteMode == "record" {
+			cassette = NewCassette(func(v *Cassette) {
+				v.RID, v.SID, v.Robot, v.dir = rid, sid, robot.uuid, path.Join(cassetteDir, rid)
+			})
+			ctx = withCassette(ctx, cassette)
+		} else if cassetteMode == "replay" {
+			var err error
+			if cassette, err = LoadCassette(q.Get("cassette")); err != nil {
+				return errors.Wrapf(err, "cassette")
+			}
+			ctx = withCassette(ctx, cassette)
+			logger.Tf(ctx, "Cassette: Replay %v for rid=%v", cassette.RID, rid)
 		}
+		logger.Tf(ctx, "Stage: Got question sid=%v, umi=%v, robot=%v(%v), rid=%v",
+			sid, q.Get("umi"), robot.uuid, robot.label, rid)
+
+		// We read the input audio in memory, it can be aac or opus codec, and transcode it by pipes.
+		var input []byte
 		if err := func() error {
+			_, span := startSpan(ctx, "upload")
+			defer span.End(nil)
+
 			r.ParseMultipartForm(20 * 1024 * 1024)
 			file, _, err := r.FormFile("file")
 			if err != nil {
@@ -631,39 +1320,53 @@ func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *ht
 			}
 			defer file.Close()
 
-			out, err := os.Create(inputFile)
-			if err != nil {
-				return errors.Errorf("Unable to create the file for writing")
+			if input, err = io.ReadAll(io.LimitReader(file, 20*1024*1024)); err != nil {
+				return errors.Errorf("Error reading the file")
 			}
-			defer out.Close()
+			logger.Tf(ctx, "File read, size: %v", len(input))
 
-			nn, err := io.Copy(out, file)
-			if err != nil {
-				return errors.Errorf("Error writing the file")
+			// Keep the input audio in cassette, to upload it again when replay.
+			if cassetteMode == "record" {
+				if err := cassette.SaveInput(input); err != nil {
+					return errors.Wrapf(err, "cassette")
+				}
+			}
+
+			// Keep the input audio in storage for debugging.
+			if stage.conf.KeepFiles {
+				key := stage.StorageKey(fmt.Sprintf("assistant-%v-input.audio", rid))
+				if err := audioStorage.Put(ctx, key, bytes.NewReader(input), int64(len(input)),
+					"application/octet-stream"); err != nil {
+					return errors.Wrapf(err, "store %v", key)
+				}
 			}
-			logger.Tf(ctx, "File saved to %v, size: %v", inputFile, nn)
 
 			return nil
 		}(); err != nil {
-			return errors.Wrapf(err, "copy %v", inputFile)
+			return errors.Wrapf(err, "read input")
 		}
-		stage.lastUploadAudio = time.Now()
+		stage.OnUploadAudio()
 
 		// Do ASR, convert to text.
+		ctx = withLogFields(ctx, "step", "asr")
 		var asrText string
-		if resp, err := asrService.RequestASR(ctx, inputFile, robot.asrLanguage, stage.previousAsrText, func() {
-			stage.lastExtractAudio = time.Now()
+		var asrDuration time.Duration
+		prompt := stage.PreviousAsrText()
+		asrCtx, asrSpan := startSpan(ctx, "asr", withSpanKind(spanKindClient))
+		asrSpan.SetAttributes("language", robot.asrLanguage, "input.size", len(input))
+		if resp, err := stage.tenant.asrService.RequestASR(asrCtx, input, robot.asrLanguage, prompt, func() {
+			stage.OnExtractAudio()
 		}); err != nil {
-			return errors.Wrapf(err, "transcription")
+			return asrSpan.End(errors.Wrapf(err, "transcription"))
 		} else {
-			asrText = strings.TrimSpace(resp.Text)
-			stage.previousAsrText = asrText
-			stage.lastRequestASR = time.Now()
-			stage.lastAsrDuration = resp.Duration
-			stage.lastRequestAsrText = asrText
+			asrSpan.SetAttributes("speech.seconds", resp.Duration.Seconds(), "text.length", len(resp.Text))
+			asrSpan.End(nil)
+			asrText, asrDuration = strings.TrimSpace(resp.Text), resp.Duration
+			stage.OnASR(asrText, asrDuration)
+			usageAccount.Record(ctx, stage, robot, rid, &Usage{ASRSeconds: resp.Duration.Seconds()})
 		}
 		logger.Tf(ctx, "ASR ok, robot=%v(%v), lang=%v, speech=%v, prompt=<%v>, resp is <%v>",
-			robot.uuid, robot.label, robot.asrLanguage, stage.lastAsrDuration, stage.previousAsrText, asrText)
+			robot.uuid, robot.label, robot.asrLanguage, asrDuration, prompt, asrText)
 
 		// Important trace log.
 		logger.Tf(ctx, "You: %v", asrText)
@@ -693,7 +1396,7 @@ func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *ht
 
 			return nil
 		}(); err != nil {
-			talkServer.NewBadcase()
+			talkServer.NewBadcase(stage.tenant)
 			return err
 		}
 
@@ -707,12 +1410,10 @@ func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *ht
 		}))
 
 		// Do chat, get the response in stream.
-		chatService := &openaiChatService{
-			onFirstResponse: func(ctx context.Context, text string) {
-				stage.lastRequestChat = time.Now()
-				stage.lastRobotFirstText = text
-			},
-		}
+		ctx = withLogFields(ctx, "step", "chat")
+		chatService := NewChatService(stage, robot, func(ctx context.Context, text string) {
+			stage.OnFirstChat(text)
+		})
 		if err := chatService.RequestChat(ctx, rid, stage, robot); err != nil {
 			return errors.Wrapf(err, "chat")
 		}
@@ -721,16 +1422,26 @@ func handleUploadQuestionAudio(ctx context.Context, w http.ResponseWriter, r *ht
 		ohttp.WriteData(ctx, w, r, struct {
 			RequestUUID string `json:"rid"`
 			ASR         string `json:"asr"`
+			// The source references of knowledge base.
+			Sources []*KnowledgeMatch `json:"sources,omitempty"`
 		}{
 			RequestUUID: rid,
 			ASR:         asrText,
+			Sources:     chatService.Sources(),
 		})
 		return nil
 	}(); err != nil {
-		talkServer.NewError()
+		turnSpan.End(err)
+		talkServer.NewError(stage.tenant)
 		logger.Wf(ctx, "Stage: Upload err %v", err.Error())
 		return err
 	}
+
+	// End the span of turn when the chat is done and the last sentence is converted by TTS.
+	go func() {
+		tasks.Wait()
+		turnSpan.End(nil)
+	}()
 	return nil
 }
 
@@ -743,11 +1454,16 @@ func handleQueryQuestionState(ctx context.Context, w http.ResponseWriter, r *htt
 		return errors.Errorf("empty sid")
 	}
 
-	stage := talkServer.QueryStage(sid)
+	stage := talkServer.QueryStage(ctx, sid)
 	if stage == nil {
 		return errors.Errorf("invalid sid %v", sid)
 	}
 
+	// Verify the stage access token.
+	if err := stage.Authorize(r); err != nil {
+		return errors.Wrapf(err, "auth")
+	}
+
 	// Keep alive the stage.
 	stage.KeepAlive()
 	// Switch to the context of stage.
@@ -760,6 +1476,7 @@ func handleQueryQuestionState(ctx context.Context, w http.ResponseWriter, r *htt
 		if rid == "" {
 			return errors.Errorf("empty rid")
 		}
+		ctx = withLogFields(ctx, "rid", rid, "step", "query")
 		logger.Tf(ctx, "Stage: Query sid=%v, rid=%v", sid, rid)
 
 		segment := stage.ttsWorker.QueryAnyReadySegment(ctx, stage, rid)
@@ -780,7 +1497,7 @@ func handleQueryQuestionState(ctx context.Context, w http.ResponseWriter, r *htt
 			TTS string `json:"tts"`
 		}{
 			// Whether is processing.
-			Processing: segment.dummy || (!segment.ready && segment.err == nil),
+			Processing: segment.Processing(),
 			// The UUID for this answer segment.
 			AnswerSegmentUUID: segment.asid,
 			// The TTS text.
@@ -788,7 +1505,7 @@ func handleQueryQuestionState(ctx context.Context, w http.ResponseWriter, r *htt
 		})
 		return nil
 	}(); err != nil {
-		talkServer.NewError()
+		talkServer.NewError(stage.tenant)
 		logger.Wf(ctx, "Stage: Query err %v", err.Error())
 		return err
 	}
@@ -804,11 +1521,16 @@ func handleDownloadAnswerTTS(ctx context.Context, w http.ResponseWriter, r *http
 		return errors.Errorf("empty sid")
 	}
 
-	stage := talkServer.QueryStage(sid)
+	stage := talkServer.QueryStage(ctx, sid)
 	if stage == nil {
 		return errors.Errorf("invalid sid %v", sid)
 	}
 
+	// Verify the stage access token.
+	if err := stage.Authorize(r); err != nil {
+		return errors.Wrapf(err, "auth")
+	}
+
 	// Keep alive the stage.
 	stage.KeepAlive()
 	// Switch to the context of stage.
@@ -826,42 +1548,57 @@ func handleDownloadAnswerTTS(ctx context.Context, w http.ResponseWriter, r *http
 		if asid == "" {
 			return errors.Errorf("empty asid")
 		}
+		ctx = withLogFields(ctx, "rid", rid, "asid", asid, "step", "download")
 		logger.Tf(ctx, "Stage: Download sid=%v, rid=%v, asid=%v", sid, rid, asid)
 
 		// Get the segment and response it.
-		segment := stage.ttsWorker.QuerySegment(rid, asid)
+		segment := stage.ttsWorker.QuerySegment(ctx, stage, rid, asid)
 		if segment == nil {
 			return errors.Errorf("no segment for %v %v", rid, asid)
 		}
-		logger.Tf(ctx, "Query segment rid=%v, asid=%v, dummy=%v, segment=%v, err=%v",
-			rid, asid, segment.dummy, segment.text, segment.err)
 
-		if !segment.logged && segment.first {
-			stage.lastDownloadAudio = time.Now()
-			speech := float64(stage.lastAsrDuration) / float64(time.Second)
-			logger.Tf(ctx, "Elapsed cost total=%.1fs, steps=[upload=%.1fs,exta=%.1fs,asr=%.1fs,chat=%.1fs,tts=%.1fs,download=%.1fs], ask=%v, speech=%.1fs, answer=%v",
-				stage.total(), stage.upload(), stage.exta(), stage.asr(), stage.chat(), stage.tts(), stage.download(),
-				stage.lastRequestAsrText, speech, stage.lastRobotFirstText)
-		}
+		// The span of download, in the trace of turn.
+		ctx, span := startSpan(ctx, "download", withSpanKind(spanKindServer), withParentSpan(segment.span))
+		span.SetAttributes("asid", asid, "format", q.Get("format"), "remote", segment.remote)
+		defer span.End(nil)
+		logger.Tf(ctx, "Query segment rid=%v, asid=%v, dummy=%v, segment=%v, err=%v",
+			rid, asid, segment.dummy, segment.text, segment.Err())
 
 		// Important trace log. Note that browser may request multiple times, so we only log for the first
 		// request to reduce logs.
-		if !segment.logged {
-			segment.logged = true
+		if segment.MarkLogged() {
+			if segment.first {
+				logger.Tf(ctx, "Elapsed cost %v", stage.OnFirstDownload())
+			}
 			logger.Tf(ctx, "Bot: %v", segment.text)
 		}
 
-		// Read the ttsFile and response it as opus audio.
-		if strings.HasSuffix(segment.ttsFile, ".wav") {
-			w.Header().Set("Content-Type", "audio/wav")
-		} else {
-			w.Header().Set("Content-Type", "audio/aac")
+		// Read the TTS audio, transcoded to the format of client, and response it.
+		tts, contentType, err := segment.TTSAudioOf(ctx, q.Get("format"))
+		if err != nil {
+			return errors.Wrapf(err, "format")
+		}
+
+		// Redirect to the pre-signed URL if supported, to download from storage directly.
+		if u, err := tts.PresignURL(ctx); err != nil {
+			return errors.Wrapf(err, "presign")
+		} else if u != "" {
+			http.Redirect(w, r, u, http.StatusFound)
+			return nil
+		}
+
+		reader, err := tts.Open(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "open tts")
 		}
-		http.ServeFile(w, r, segment.ttsFile)
+		defer reader.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", time.Time{}, reader)
 
 		return nil
 	}(); err != nil {
-		talkServer.NewError()
+		talkServer.NewError(stage.tenant)
 		logger.Wf(ctx, "Stage: Query err %v", err.Error())
 		return err
 	}
@@ -877,11 +1614,16 @@ func handleRemoveAnswerTTS(ctx context.Context, w http.ResponseWriter, r *http.R
 		return errors.Errorf("empty sid")
 	}
 
-	stage := talkServer.QueryStage(sid)
+	stage := talkServer.QueryStage(ctx, sid)
 	if stage == nil {
 		return errors.Errorf("invalid sid %v", sid)
 	}
 
+	// Verify the stage access token.
+	if err := stage.Authorize(r); err != nil {
+		return errors.Wrapf(err, "auth")
+	}
+
 	// Keep alive the stage.
 	stage.KeepAlive()
 	// Switch to the context of stage.
@@ -898,16 +1640,26 @@ func handleRemoveAnswerTTS(ctx context.Context, w http.ResponseWriter, r *http.R
 		if asid == "" {
 			return errors.Errorf("empty asid")
 		}
+		ctx = withLogFields(ctx, "rid", rid, "asid", asid, "step", "remove")
 		logger.Tf(ctx, "Stage: Remove sid=%v, rid=%v, asid=%v", sid, rid, asid)
 
 		// Notify to remove the segment.
-		segment := stage.ttsWorker.QuerySegment(rid, asid)
+		segment := stage.ttsWorker.QuerySegment(ctx, stage, rid, asid)
 		if segment == nil {
 			return errors.Errorf("no segment for %v %v", rid, asid)
 		}
 
 		// Remove it.
-		stage.ttsWorker.RemoveSegment(asid)
+		stage.ttsWorker.RemoveSegment(ctx, stage, asid)
+
+		// The segment of other replica has no goroutine to remove it, so we remove the stored audio.
+		if segment.remote {
+			if tts := segment.TTS(); tts != nil {
+				tts.Remove(ctx)
+			}
+			ohttp.WriteData(ctx, w, r, nil)
+			return nil
+		}
 
 		select {
 		case <-ctx.Done():
@@ -917,7 +1669,7 @@ func handleRemoveAnswerTTS(ctx context.Context, w http.ResponseWriter, r *http.R
 		ohttp.WriteData(ctx, w, r, nil)
 		return nil
 	}(); err != nil {
-		talkServer.NewError()
+		talkServer.NewError(stage.tenant)
 		logger.Wf(ctx, "Stage: Query err %v", err.Error())
 		return err
 	}
@@ -934,7 +1686,7 @@ func handleStaticFiles(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	// If there is an optional stage id, we will use the logging context of stage.
 	q := r.URL.Query()
 	if sid := q.Get("sid"); sid != "" {
-		if stage := talkServer.QueryStage(sid); stage != nil {
+		if stage := talkServer.QueryStage(ctx, sid); stage != nil {
 			ctx = stage.loggingCtx
 		}
 	}
@@ -948,43 +1700,36 @@ func handleStaticFiles(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	return nil
 }
 
-func doMain(ctx context.Context) error {
+func doMain(ctx context.Context, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	if err := doConfig(ctx); err != nil {
+	conf, err := doConfig(ctx, args, nil)
+	if err != nil {
 		return errors.Wrapf(err, "config")
 	}
 
-	// Create services.
-	if os.Getenv("TENCENT_SPEECH_APPID") != "" {
-		asrService = NewTencentASRService()
-		ttsService = NewTencentTTSService()
-		logger.Tf(ctx, "Use Tencent ASR and TTS.")
-	} else {
-		asrService = NewOpenAIASRService()
-		ttsService = NewOpenAITTSService()
-		logger.Tf(ctx, "Use OpenAI ASR and TTS.")
-	}
-
 	// Create the talk server.
-	talkServer = NewTalkServer()
-	defer talkServer.Close()
+	talkServer = NewTalkServer(func(server *TalkServer) {
+		server.conf = conf
+	})
+	go talkServer.Run(ctx)
+
+	// Export the spans in batch.
+	if tracer != nil {
+		go tracer.Run(ctx)
+	}
 
-	// Signal handler.
+	// Signal handler, to shutdown gracefully.
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		sig := <-sigs
-		logger.Tf(ctx, "Got signal %v", sig)
-		cancel()
-	}()
-
 	go func() {
 		for {
-			logger.Tf(ctx, "Timer: Current stages=%v, chats=%v, errors=%v, badcases=%v",
-				talkServer.CountStage(), talkServer.conversations, talkServer.errors, talkServer.badcases)
+			logger.Tf(ctx, "Timer: Current %v", talkServer.String())
+			for _, tenant := range append([]*Tenant{defaultTenant}, tenants...) {
+				logger.Tf(ctx, "Timer: Tenant %v", tenant.String())
+			}
 			time.Sleep(10 * time.Second)
 		}
 	}()
@@ -995,42 +1740,49 @@ func doMain(ctx context.Context) error {
 	handler.HandleFunc("/api/ai-talk/start/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleStageStart(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle start failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
 	handler.HandleFunc("/api/ai-talk/conversation/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleStartConversation(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle audio failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
 	handler.HandleFunc("/api/ai-talk/upload/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleUploadQuestionAudio(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle audio failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
 	handler.HandleFunc("/api/ai-talk/query/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleQueryQuestionState(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle query failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
 	handler.HandleFunc("/api/ai-talk/tts/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleDownloadAnswerTTS(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle tts failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
 	handler.HandleFunc("/api/ai-talk/remove/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleRemoveAnswerTTS(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle remove failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
+		}
+	})
+
+	handler.HandleFunc("/api/ai-talk/usage/", func(w http.ResponseWriter, r *http.Request) {
+		if err := handleQueryUsage(ctx, w, r); err != nil {
+			logger.Ef(ctx, "Handle usage failed, err %+v", err)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
@@ -1041,7 +1793,7 @@ func doMain(ctx context.Context) error {
 	handler.HandleFunc("/api/ai-talk/examples/", func(w http.ResponseWriter, r *http.Request) {
 		if err := handleStaticFiles(ctx, w, r); err != nil {
 			logger.Ef(ctx, "Handle static files failed, err %+v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpErrorStatus(err))
 		}
 	})
 
@@ -1081,7 +1833,7 @@ func doMain(ctx context.Context) error {
 		return err
 	}
 	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if os.Getenv("AIT_PROXY_STATIC") == "true" {
+		if conf.ProxyStatic {
 			proxy3000.ServeHTTP(w, r)
 		} else {
 			static.ServeHTTP(w, r)
@@ -1095,8 +1847,31 @@ func doMain(ctx context.Context) error {
 		workDir = pwd
 	}
 
-	// Start HTTPS server.
-	runHttpsServer := func() error {
+	// Initialize the storage of audio, which might use the work dir.
+	if err := storageInit(ctx, conf); err != nil {
+		return errors.Wrapf(err, "storage")
+	}
+
+	// Initialize the cassette to record or replay the traffic of providers.
+	if err := cassetteInit(ctx, conf); err != nil {
+		return errors.Wrapf(err, "cassette")
+	}
+
+	// Initialize the shared stages in Redis, which requires shared storage.
+	if err := redisInit(ctx, conf); err != nil {
+		return errors.Wrapf(err, "redis")
+	}
+
+	// Check the settings, robots and FFmpeg, to fail at startup rather than at request.
+	if err := preflight(ctx, conf); err != nil {
+		return errors.Wrapf(err, "preflight")
+	}
+
+	// Sweep the leftover files of last run.
+	sweepFiles(ctx, conf)
+
+	// Create HTTPS server.
+	createHttpsServer := func() (*http.Server, error) {
 		keyFile := path.Join(workDir, "../server.key")
 		crtFile := path.Join(workDir, "../server.crt")
 
@@ -1149,23 +1924,23 @@ func doMain(ctx context.Context) error {
 
 		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
 			if err := generateCert(); err != nil {
-				return errors.Wrapf(err, "cert: create self-signed certificate failed")
+				return nil, errors.Wrapf(err, "cert: create self-signed certificate failed")
 			}
 
 			if err := os.WriteFile(keyFile, []byte(key), 0644); err != nil {
-				return errors.Wrapf(err, "cert: write key file failed")
+				return nil, errors.Wrapf(err, "cert: write key file failed")
 			}
 			if err := os.WriteFile(crtFile, []byte(crt), 0644); err != nil {
-				return errors.Wrapf(err, "cert: write crt file failed")
+				return nil, errors.Wrapf(err, "cert: write crt file failed")
 			}
 		}
 
 		cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
 		if err != nil {
-			return errors.Wrapf(err, "cert: ignore load cert %v, key %v failed", crtFile, keyFile)
+			return nil, errors.Wrapf(err, "cert: ignore load cert %v, key %v failed", crtFile, keyFile)
 		}
 
-		addr := os.Getenv("AIT_HTTPS_LISTEN")
+		addr := conf.HTTPSListen
 		if !strings.HasPrefix(addr, ":") {
 			addr = fmt.Sprintf(":%v", addr)
 		}
@@ -1180,115 +1955,233 @@ func doMain(ctx context.Context) error {
 				},
 			},
 		}
-		if err := server.ListenAndServeTLS("", ""); err != nil {
-			return errors.Wrapf(err, "HTTPS Server error")
-		}
+		return server, nil
+	}
 
-		return nil
+	// Start HTTPS server, which is optional, so we only log the error.
+	httpsServer, err := createHttpsServer()
+	if err != nil {
+		logger.Ef(ctx, "HTTPS Server error: %+v", err)
+	} else {
+		go func() {
+			if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				logger.Ef(ctx, "HTTPS Server error: %+v", errors.Wrapf(err, "HTTPS Server error"))
+			}
+		}()
 	}
-	go func() {
-		if err := runHttpsServer(); err != nil {
-			logger.Ef(ctx, "HTTPS Server error: %+v", err)
-		}
-	}()
 
 	// Start HTTP server.
-	listen := os.Getenv("AIT_HTTP_LISTEN")
+	listen := conf.HTTPListen
 	if !strings.HasPrefix(listen, ":") {
 		listen = fmt.Sprintf(":%v", listen)
 	}
 	logger.Tf(ctx, "Listen at %v, workDir=%v", listen, workDir)
 	server := &http.Server{Addr: listen, Handler: handler}
 
+	serverErrors := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		server.Shutdown(ctx)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErrors <- errors.Wrapf(err, "listen and serve")
+		}
+	}()
+
+	select {
+	case err := <-serverErrors:
+		return err
+	case sig := <-sigs:
+		logger.Tf(ctx, "Got signal %v", sig)
+	}
+
+	// Shutdown gracefully, stop accepting new stages and turns, wait for in-flight turns to finish,
+	// then stop the servers, close all stages, and sweep the leftover files.
+	timeout := conf.ShutdownTimeout
+	logger.Tf(ctx, "Shutdown: Start, stages=%v, timeout=%v", talkServer.CountStage(), timeout)
+
+	talkServer.Shutdown()
+	func() {
+		drainCtx, drainCancel := context.WithTimeout(ctx, timeout)
+		defer drainCancel()
+
+		if err := talkServer.Drain(drainCtx); err != nil {
+			logger.Wf(ctx, "Shutdown: Drain failed, err %v", err)
+		}
+	}()
+
+	// Stop the servers first, so that no handler uses the stages which are being closed.
+	func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(withoutCancel(ctx), 10*time.Second)
+		defer shutdownCancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Wf(ctx, "Shutdown: HTTP Server failed, err %v", err)
+		}
+		if httpsServer != nil {
+			if err := httpsServer.Shutdown(shutdownCtx); err != nil {
+				logger.Wf(ctx, "Shutdown: HTTPS Server failed, err %v", err)
+			}
+		}
 	}()
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return errors.Wrapf(err, "listen and serve")
+	// Cancel the ctx, to abort the remaining work and quit the goroutines of stages.
+	cancel()
+
+	closeCtx, closeCancel := context.WithTimeout(withoutCancel(ctx), 10*time.Second)
+	defer closeCancel()
+
+	// Close the stages after the servers, then sweep the files which are left by stages.
+	talkServer.Close(closeCtx)
+	sweepFiles(closeCtx, conf)
+
+	// Export the remaining spans, after all stages closed.
+	if tracer != nil {
+		tracer.Close(closeCtx)
 	}
-	logger.Tf(ctx, "HTTP Server closed")
+	logger.Tf(closeCtx, "Shutdown: Done")
 	return nil
 }
 
-func doConfig(ctx context.Context) error {
-	// setEnvDefault set env key=value if not set.
-	setEnvDefault := func(key, value string) {
-		if os.Getenv(key) == "" {
-			os.Setenv(key, value)
-		}
-	}
-
-	setEnvDefault("OPENAI_API_KEY", "")
-	setEnvDefault("OPENAI_PROXY", "https://api.openai.com/v1")
-	setEnvDefault("AIT_HTTP_LISTEN", "3001")
-	setEnvDefault("AIT_HTTPS_LISTEN", "3443")
-	setEnvDefault("AIT_PROXY_STATIC", "true")
-	setEnvDefault("AIT_REPLY_PREFIX", "")
-	setEnvDefault("AIT_SYSTEM_PROMPT", "You are a helpful assistant.")
-	setEnvDefault("AIT_CHAT_MODEL", openai.GPT4TurboPreview)
-	setEnvDefault("AIT_MAX_TOKENS", "1024")
-	setEnvDefault("AIT_TEMPERATURE", "0.9")
-	setEnvDefault("AIT_KEEP_FILES", "false")
-	setEnvDefault("AIT_ASR_LANGUAGE", "en")
-	setEnvDefault("AIT_REPLY_LIMIT", "30")
-	setEnvDefault("AIT_DEVELOPMENT", "true")
-	setEnvDefault("AIT_CHAT_WINDOW", "5")
-	setEnvDefault("AIT_DEFAULT_ROBOT", "true")
-	setEnvDefault("AIT_STAGE_TIMEOUT", "300")
-	setEnvDefault("AIT_TTS_VOICE", string(openai.VoiceNova))
-	setEnvDefault("AIT_TTS_MODEL", string(openai.TTSModel1))
-	setEnvDefault("AIT_ASR_MODEL", openai.Whisper1)
-
-	// Load env variables from file.
-	if _, err := os.Stat("../.env"); err == nil {
-		if err := godotenv.Overload("../.env"); err != nil {
-			return errors.Wrapf(err, "load env")
-		}
-	}
-	if os.Getenv("OPENAI_API_KEY") == "" {
-		return errors.New("OPENAI_API_KEY is required")
-	}
-
-	logger.Tf(ctx, "OPENAI_API_KEY=%vB, OPENAI_PROXY=%v, AIT_HTTP_LISTEN=%v, AIT_HTTPS_LISTEN=%v, "+
-		"AIT_PROXY_STATIC=%v, AIT_REPLY_PREFIX=%v, AIT_SYSTEM_PROMPT=%v, AIT_CHAT_MODEL=%v, AIT_MAX_TOKENS=%v, "+
-		"AIT_TEMPERATURE=%v, AIT_KEEP_FILES=%v, AIT_ASR_LANGUAGE=%v, AIT_REPLY_LIMIT=%v, AIT_CHAT_WINDOW=%v, "+
-		"AIT_DEFAULT_ROBOT=%v, AIT_STAGE_TIMEOUT=%v, AIT_TTS_VOICE=%v, AIT_TTS_MODEL=%v, "+
-		"AIT_ASR_MODEL=%v",
-		len(os.Getenv("OPENAI_API_KEY")), os.Getenv("OPENAI_PROXY"), os.Getenv("AIT_HTTP_LISTEN"),
-		os.Getenv("AIT_HTTPS_LISTEN"), os.Getenv("AIT_PROXY_STATIC"), os.Getenv("AIT_REPLY_PREFIX"),
-		os.Getenv("AIT_SYSTEM_PROMPT"), os.Getenv("AIT_CHAT_MODEL"), os.Getenv("AIT_MAX_TOKENS"),
-		os.Getenv("AIT_TEMPERATURE"), os.Getenv("AIT_KEEP_FILES"), os.Getenv("AIT_ASR_LANGUAGE"),
-		os.Getenv("AIT_REPLY_LIMIT"), os.Getenv("AIT_CHAT_WINDOW"),
-		os.Getenv("AIT_DEFAULT_ROBOT"), os.Getenv("AIT_STAGE_TIMEOUT"), os.Getenv("AIT_TTS_VOICE"),
-		os.Getenv("AIT_TTS_MODEL"), os.Getenv("AIT_ASR_MODEL"),
-	)
-
-	// Config all robots.
-	globalReplylimit, err := strconv.ParseInt(os.Getenv("AIT_REPLY_LIMIT"), 10, 64)
+// Sweep the leftover temporary files in work dir, such as the spilled audio and the files of local TTS
+// or whisper.cpp, and the files of stages in local storage, which are left when process crashed.
+func sweepFiles(ctx context.Context, conf *Config) {
+	if conf.KeepFiles {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(workDir, "assistant-*"))
+	if err != nil {
+		logger.Wf(ctx, "Sweep: Glob failed, err %v", err)
+		return
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			logger.Wf(ctx, "Sweep: Remove %v failed, err %v", file, err)
+		}
+	}
+	logger.Tf(ctx, "Sweep: Remove %v files in %v", len(files), workDir)
+
+	if nn, err := audioStorage.Sweep(ctx); err != nil {
+		logger.Wf(ctx, "Sweep: Storage failed, err %v", err)
+	} else if nn > 0 {
+		logger.Tf(ctx, "Sweep: Remove %v stages in storage", nn)
+	}
+}
+
+// Load the config by the args of command line and the defaults, and initialize the logger, tools and
+// tenants by the config.
+func doConfig(ctx context.Context, args []string, defaults map[string]string) (*Config, error) {
+	// Load the config of server, from the flags, env and config file.
+	conf, err := loadConfig(ctx, args, defaults)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load config")
+	}
+
+	// Initialize the logger, before any other logs.
+	if err := loggingInit(ctx, conf); err != nil {
+		return nil, errors.Wrapf(err, "logging")
+	}
+
+	// Initialize the tracing, export the spans of turns to OpenTelemetry collector.
+	if err := tracingInit(ctx, conf); err != nil {
+		return nil, errors.Wrapf(err, "tracing")
+	}
+
+	logger.Tf(ctx, "Config: %v", conf)
+
+	// Initialize the tools for AI chat.
+	if err := toolsInit(ctx, conf); err != nil {
+		return nil, errors.Wrapf(err, "tools")
+	}
+
+	// Create the default tenant, by the config.
+	if tenant, err := NewTenant(ctx, conf, "default", conf.Getenv); err != nil {
+		return nil, errors.Wrapf(err, "default tenant")
+	} else {
+		defaultTenant = tenant
+	}
+
+	// Initialize the usage accounting.
+	if err := usageInit(ctx, conf); err != nil {
+		return nil, errors.Wrapf(err, "usage")
+	}
+
+	// Load the extra tenants, by the env files.
+	if conf.TenantsDir != "" {
+		if all, err := loadTenants(ctx, conf, conf.TenantsDir); err != nil {
+			return nil, errors.Wrapf(err, "tenants")
+		} else {
+			tenants = all
+		}
+	}
+
+	return conf, nil
+}
+
+// Load the robots, by the getenv which read the env of tenant.
+func loadRobots(ctx context.Context, getenv func(key string) string) ([]*Robot, error) {
+	var robots []*Robot
+
+	globalReplylimit, err := strconv.ParseInt(getenv("AIT_REPLY_LIMIT"), 10, 64)
 	if err != nil {
-		return errors.Wrapf(err, "parse AIT_REPLY_LIMIT %v", os.Getenv("AIT_REPLY_LIMIT"))
+		return nil, errors.Wrapf(err, "parse AIT_REPLY_LIMIT %v", getenv("AIT_REPLY_LIMIT"))
+	}
+
+	globalChatWindow, err := strconv.ParseInt(getenv("AIT_CHAT_WINDOW"), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse AIT_CHAT_WINDOW %v", getenv("AIT_CHAT_WINDOW"))
+	}
+
+	// Parse the chat provider and options, default to the global setting.
+	parseChatProvider := func(provider, defaultProvider string) (string, error) {
+		if provider == "" {
+			provider = defaultProvider
+		}
+		if provider == "" {
+			provider = "openai"
+		}
+		if provider != "openai" && provider != "ollama" {
+			return "", errors.Errorf("invalid chat provider %v", provider)
+		}
+		return provider, nil
 	}
 
-	globalChatWindow, err := strconv.ParseInt(os.Getenv("AIT_CHAT_WINDOW"), 10, 64)
+	globalChatOptions, err := parseChatOptions(getenv("AIT_CHAT_OPTIONS"))
 	if err != nil {
-		return errors.Wrapf(err, "parse AIT_CHAT_WINDOW %v", os.Getenv("AIT_CHAT_WINDOW"))
+		return nil, errors.Wrapf(err, "parse AIT_CHAT_OPTIONS %v", getenv("AIT_CHAT_OPTIONS"))
 	}
 
-	if os.Getenv("AIT_DEFAULT_ROBOT") == "true" {
+	if getenv("AIT_DEFAULT_ROBOT") == "true" {
+		chatProvider, err := parseChatProvider(getenv("AIT_CHAT_PROVIDER"), "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse AIT_CHAT_PROVIDER %v", getenv("AIT_CHAT_PROVIDER"))
+		}
+
+		tools, err := parseToolNames(getenv("AIT_TOOLS"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse AIT_TOOLS %v", getenv("AIT_TOOLS"))
+		}
+		if chatProvider == "ollama" && len(tools) > 0 {
+			return nil, errors.Errorf("AIT_TOOLS %v is not supported by ollama", getenv("AIT_TOOLS"))
+		}
+
+		knowledge, err := newRobotKnowledge(getenv, getenv("AIT_KNOWLEDGE"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "knowledge %v", getenv("AIT_KNOWLEDGE"))
+		}
+
 		robots = append(robots, &Robot{
-			uuid: "default", label: "Default", prompt: os.Getenv("AIT_SYSTEM_PROMPT"),
-			asrLanguage: os.Getenv("AIT_ASR_LANGUAGE"), prefix: os.Getenv("AIT_REPLY_PREFIX"),
+			uuid: "default", label: "Default", prompt: getenv("AIT_SYSTEM_PROMPT"),
+			asrLanguage: getenv("AIT_ASR_LANGUAGE"), prefix: getenv("AIT_REPLY_PREFIX"),
 			voice: "hello-english.aac", replyLimit: int(globalReplylimit),
-			chatModel: os.Getenv("AIT_CHAT_MODEL"), chatWindow: int(globalChatWindow),
+			chatModel: getenv("AIT_CHAT_MODEL"), chatWindow: int(globalChatWindow),
+			chatProvider: chatProvider, chatOptions: globalChatOptions, tools: tools, knowledge: knowledge,
 		})
 	}
 
 	for i := 0; i < 100; i++ {
-		uuid := os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_ID", i))
-		label := os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_LABEL", i))
-		prompt := os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_PROMPT", i))
+		uuid := getenv(fmt.Sprintf("AIT_ROBOT_%v_ID", i))
+		label := getenv(fmt.Sprintf("AIT_ROBOT_%v_LABEL", i))
+		prompt := getenv(fmt.Sprintf("AIT_ROBOT_%v_PROMPT", i))
 		if uuid == "" || label == "" || prompt == "" {
 			if uuid != "" || label != "" || prompt != "" {
 				logger.Wf(ctx, "Ignore uuid=%v, label=%v, prompt=%v", uuid, label, prompt)
@@ -1296,43 +2189,81 @@ func doConfig(ctx context.Context) error {
 			continue
 		}
 
-		setEnvDefault(fmt.Sprintf("AIT_ROBOT_%v_ASR_LANGUAGE", i), os.Getenv("AIT_ASR_LANGUAGE"))
-		setEnvDefault(fmt.Sprintf("AIT_ROBOT_%v_REPLY_PREFIX", i), os.Getenv("AIT_REPLY_PREFIX"))
+		asrLanguage := getenv(fmt.Sprintf("AIT_ROBOT_%v_ASR_LANGUAGE", i))
+		if asrLanguage == "" {
+			asrLanguage = getenv("AIT_ASR_LANGUAGE")
+		}
+
+		prefix := getenv(fmt.Sprintf("AIT_ROBOT_%v_REPLY_PREFIX", i))
+		if prefix == "" {
+			prefix = getenv("AIT_REPLY_PREFIX")
+		}
 
 		voice := "hello-english.aac"
-		if os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_ASR_LANGUAGE", i)) == "zh" {
+		if asrLanguage == "zh" {
 			voice = "hello-chinese.aac"
 		}
 
 		replyLimit := int(globalReplylimit)
-		if os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_REPLY_LIMIT", i)) != "" {
-			if iv, err := strconv.ParseInt(os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_REPLY_LIMIT", i)), 10, 64); err != nil {
-				return errors.Wrapf(err, "parse AIT_REPLY_LIMIT %v", os.Getenv("AIT_REPLY_LIMIT"))
+		if getenv(fmt.Sprintf("AIT_ROBOT_%v_REPLY_LIMIT", i)) != "" {
+			if iv, err := strconv.ParseInt(getenv(fmt.Sprintf("AIT_ROBOT_%v_REPLY_LIMIT", i)), 10, 64); err != nil {
+				return nil, errors.Wrapf(err, "parse AIT_REPLY_LIMIT %v", getenv("AIT_REPLY_LIMIT"))
 			} else {
 				replyLimit = int(iv)
 			}
 		}
 
-		chatModel := os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_MODEL", i))
+		chatModel := getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_MODEL", i))
 		if chatModel == "" {
-			chatModel = os.Getenv("AIT_CHAT_MODEL")
+			chatModel = getenv("AIT_CHAT_MODEL")
 		}
 
 		chatWindow := int(globalChatWindow)
-		if os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_WINDOW", i)) != "" {
-			if iv, err := strconv.ParseInt(os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_WINDOW", i)), 10, 64); err != nil {
-				return errors.Wrapf(err, "parse AIT_CHAT_WINDOW %v", os.Getenv("AIT_CHAT_WINDOW"))
+		if getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_WINDOW", i)) != "" {
+			if iv, err := strconv.ParseInt(getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_WINDOW", i)), 10, 64); err != nil {
+				return nil, errors.Wrapf(err, "parse AIT_CHAT_WINDOW %v", getenv("AIT_CHAT_WINDOW"))
 			} else {
 				chatWindow = int(iv)
 			}
 		}
 
-		prefix := os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_REPLY_PREFIX", i))
-		asrLanguage := os.Getenv(fmt.Sprintf("AIT_ROBOT_%v_ASR_LANGUAGE", i))
+		chatProvider, err := parseChatProvider(getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_PROVIDER", i)), getenv("AIT_CHAT_PROVIDER"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse AIT_ROBOT_%v_CHAT_PROVIDER", i)
+		}
+
+		chatOptions := globalChatOptions
+		if s := getenv(fmt.Sprintf("AIT_ROBOT_%v_CHAT_OPTIONS", i)); s != "" {
+			if chatOptions, err = parseChatOptions(s); err != nil {
+				return nil, errors.Wrapf(err, "parse AIT_ROBOT_%v_CHAT_OPTIONS %v", i, s)
+			}
+		}
+
+		var access []string
+		for _, v := range strings.Split(getenv(fmt.Sprintf("AIT_ROBOT_%v_ACCESS", i)), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				access = append(access, v)
+			}
+		}
+
+		tools, err := parseToolNames(getenv(fmt.Sprintf("AIT_ROBOT_%v_TOOLS", i)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse AIT_ROBOT_%v_TOOLS %v", i, getenv(fmt.Sprintf("AIT_ROBOT_%v_TOOLS", i)))
+		}
+		if chatProvider == "ollama" && len(tools) > 0 {
+			return nil, errors.Errorf("AIT_ROBOT_%v_TOOLS %v is not supported by ollama", i, getenv(fmt.Sprintf("AIT_ROBOT_%v_TOOLS", i)))
+		}
+
+		knowledge, err := newRobotKnowledge(getenv, getenv(fmt.Sprintf("AIT_ROBOT_%v_KNOWLEDGE", i)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "knowledge %v", getenv(fmt.Sprintf("AIT_ROBOT_%v_KNOWLEDGE", i)))
+		}
 
 		robots = append(robots, &Robot{
 			uuid: uuid, label: label, prompt: prompt, asrLanguage: asrLanguage, prefix: prefix,
 			voice: voice, replyLimit: replyLimit, chatModel: chatModel, chatWindow: chatWindow,
+			chatProvider: chatProvider, chatOptions: chatOptions, access: access, tools: tools, knowledge: knowledge,
+			ttsVoice: getenv(fmt.Sprintf("AIT_ROBOT_%v_TTS_VOICE", i)),
 		})
 	}
 
@@ -1342,16 +2273,25 @@ func doConfig(ctx context.Context) error {
 	}
 	logger.Tf(ctx, "Robots: total=%v, %v", len(robots), strings.Join(sb, ", "))
 
-	// Initialize OpenAI client config.
-	openaiInit(ctx)
-	tencentInit(ctx)
-
-	return nil
+	return robots, nil
 }
 
 func main() {
 	ctx := context.Background()
-	if err := doMain(ctx); err != nil {
+
+	// Run the command of CLI if specified, or the server by default.
+	run, args := doMain, os.Args[1:]
+	if len(os.Args) > 1 {
+		if command, ok := cliCommands[os.Args[1]]; ok {
+			run, args = command, os.Args[2:]
+		}
+	}
+
+	if err := run(ctx, args); err != nil {
+		// The usage is printed by flags, quit normally for help.
+		if errors.Cause(err) == flag.ErrHelp {
+			return
+		}
 		logger.Ef(ctx, "Main error: %+v", err)
 		os.Exit(-1)
 	}
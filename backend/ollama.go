@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The default context length of Ollama, if no num_ctx option.
+const ollamaDefaultContextLength = 2048
+
+type ollamaConfig struct {
+	// The Ollama server, default to http://127.0.0.1:11434.
+	Host string
+	// How long the model stays loaded after request, such as 5m, or -1 to keep forever.
+	KeepAlive string
+}
+
+// Build the Ollama config, by the getenv which read the env of tenant.
+func ollamaInit(ctx context.Context, getenv func(key string) string) (ollamaAIConfig ollamaConfig) {
+	ollamaAIConfig.Host = strings.TrimSuffix(getenv("OLLAMA_HOST"), "/")
+	if ollamaAIConfig.Host == "" {
+		ollamaAIConfig.Host = "http://127.0.0.1:11434"
+	}
+	if !strings.Contains(ollamaAIConfig.Host, "://") {
+		ollamaAIConfig.Host = fmt.Sprintf("http://%v", ollamaAIConfig.Host)
+	}
+	ollamaAIConfig.KeepAlive = getenv("OLLAMA_KEEP_ALIVE")
+	logger.Tf(ctx, "Ollama config, host=%v, keepAlive=%v", ollamaAIConfig.Host, ollamaAIConfig.KeepAlive)
+	return
+}
+
+// The OpenAI compatible config of Ollama, for summary.
+func (v ollamaConfig) OpenAIConfig() openai.ClientConfig {
+	aiConfig := openai.DefaultConfig("ollama")
+	aiConfig.BaseURL = fmt.Sprintf("%v/v1", v.Host)
+	return aiConfig
+}
+
+// Check the models are present in Ollama server, by the /api/tags API.
+func (v ollamaConfig) CheckModels(ctx context.Context, models []string) error {
+	api := fmt.Sprintf("%v/api/tags", v.Host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", api)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", api)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request %v status %v, body is %v", api, resp.StatusCode, string(b))
+	}
+
+	var res struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return errors.Wrapf(err, "parse %v", string(b))
+	}
+
+	// The model without tag is the latest, for example, llama3 is llama3:latest.
+	present := make(map[string]bool)
+	for _, model := range res.Models {
+		present[model.Name] = true
+		if name, tag, ok := strings.Cut(model.Name, ":"); ok && tag == "latest" {
+			present[name] = true
+		}
+	}
+
+	for _, model := range models {
+		if !present[model] {
+			return errors.Errorf("model %v not found in Ollama %v, please run ollama pull %v", model, v.Host, model)
+		}
+	}
+
+	logger.Tf(ctx, "Ollama: Check models=%v ok, total=%v", strings.Join(models, ","), len(res.Models))
+	return nil
+}
+
+// Parse the chat options, in key=value separated by comma, for example, num_ctx=8192,temperature=0.7,
+// and the values of stop are separated by |, for example, stop=User:|Human:.
+func parseChatOptions(s string) (map[string]interface{}, error) {
+	options := make(map[string]interface{})
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid option %v", item)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if key == "stop" {
+			options[key] = strings.Split(value, "|")
+		} else if iv, err := strconv.ParseInt(value, 10, 64); err == nil {
+			options[key] = iv
+		} else if fv, err := strconv.ParseFloat(value, 64); err == nil {
+			options[key] = fv
+		} else if bv, err := strconv.ParseBool(value); err == nil {
+			options[key] = bv
+		} else {
+			options[key] = value
+		}
+	}
+	return options, nil
+}
+
+type ollamaChatService struct {
+	// The config of server, for the max tokens, temperature and summary.
+	conf *Config
+	// The Ollama config for chat.
+	aiConfig        ollamaConfig
+	onFirstResponse func(ctx context.Context, text string)
+	// The OpenAI client config for embedding, to search the knowledge base of robot.
+	embeddingAIConfig openai.ClientConfig
+	// The matched documents of knowledge base, the source references of answer.
+	sources []*KnowledgeMatch
+}
+
+func NewOllamaChatService(opts ...func(service *ollamaChatService)) ChatService {
+	v := &ollamaChatService{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *ollamaChatService) Sources() []*KnowledgeMatch {
+	return v.sources
+}
+
+func (v *ollamaChatService) RequestChat(ctx context.Context, rid string, stage *Stage, robot *Robot) error {
+	// The options of robot, the temperature and num_predict is default to AIT_TEMPERATURE and AIT_MAX_TOKENS.
+	options := make(map[string]interface{})
+	for k, ov := range robot.chatOptions {
+		options[k] = ov
+	}
+
+	contextLength := ollamaDefaultContextLength
+	if iv, ok := options["num_ctx"].(int64); ok && iv > 0 {
+		contextLength = int(iv)
+	}
+
+	// The span of chat, which is ended when the stream is done.
+	ctx, span := startSpan(ctx, "chat", withSpanKind(spanKindClient))
+
+	turn, err := prepareChatTurn(ctx, v.conf, rid, stage, robot, contextLength, v.aiConfig.OpenAIConfig(), v.embeddingAIConfig)
+	if err != nil {
+		return span.End(errors.Wrapf(err, "prepare"))
+	}
+	v.sources = turn.sources
+	span.SetAttributes("provider", "ollama", "model", turn.model, "messages", len(turn.messages))
+
+	if _, ok := options["temperature"]; !ok {
+		options["temperature"] = turn.temperature
+	}
+	if _, ok := options["num_predict"]; !ok {
+		options["num_predict"] = turn.maxTokens
+	}
+
+	type ollamaMessage struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	var messages []ollamaMessage
+	for _, message := range turn.messages {
+		messages = append(messages, ollamaMessage{Role: message.Role, Content: message.Content})
+	}
+
+	request := struct {
+		Model     string                 `json:"model"`
+		Messages  []ollamaMessage        `json:"messages"`
+		Stream    bool                   `json:"stream"`
+		Options   map[string]interface{} `json:"options,omitempty"`
+		KeepAlive string                 `json:"keep_alive,omitempty"`
+	}{
+		Model: turn.model, Messages: messages, Stream: true, Options: options, KeepAlive: v.aiConfig.KeepAlive,
+	}
+	b, err := json.Marshal(request)
+	if err != nil {
+		return span.End(errors.Wrapf(err, "marshal request"))
+	}
+
+	logger.Tf(ctx, "robot=%v(%v), OLLAMA_HOST: %v, model: %v, options: %v, window=%v, histories=%v",
+		robot.uuid, robot.label, v.aiConfig.Host, turn.model, options, robot.chatWindow, stage.histories.Len())
+
+	api := fmt.Sprintf("%v/api/chat", v.aiConfig.Host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api, bytes.NewReader(b))
+	if err != nil {
+		return span.End(errors.Wrapf(err, "create request %v", api))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return span.End(errors.Wrapf(err, "request %v", api))
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return span.End(errors.Errorf("request %v status %v, body is %v", api, resp.StatusCode, string(body)))
+	}
+
+	// Never wait for any response, but the turn waits for the stream.
+	tasks := turnTasksFromContext(ctx)
+	tasks.Add()
+	go func() {
+		defer tasks.Done()
+		defer resp.Body.Close()
+		err := v.handle(ctx, stage, robot, rid, resp.Body, turn.model, turn.messages)
+		if err != nil {
+			logger.Ef(ctx, "Handle stream failed, err %+v", err)
+		}
+		span.End(err)
+	}()
+
+	return nil
+}
+
+// Handle the stream of Ollama, which is a JSON object per line. The model and messages of request are used
+// to count the tokens, if the stream is closed without done.
+func (v *ollamaChatService) handle(ctx context.Context, stage *Stage, robot *Robot, rid string, body io.Reader, model string, messages []openai.ChatCompletionMessage) error {
+	stage.SetGenerating(true)
+	defer stage.SetGenerating(false)
+
+	sentencer := newChatSentencer(ctx, stage, robot, rid, v.onFirstResponse)
+	var content strings.Builder
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && ctx.Err() == nil {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var response struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Done            bool   `json:"done"`
+			Error           string `json:"error"`
+			PromptEvalCount int    `json:"prompt_eval_count"`
+			EvalCount       int    `json:"eval_count"`
+		}
+		if err := json.Unmarshal(line, &response); err != nil {
+			return errors.Wrapf(err, "parse %v", string(line))
+		}
+		if response.Error != "" {
+			return errors.Errorf("ollama error %v", response.Error)
+		}
+
+		if response.Done {
+			usageAccount.Record(ctx, stage, robot, rid, &Usage{
+				PromptTokens: response.PromptEvalCount, CompletionTokens: response.EvalCount,
+			})
+		}
+
+		content.WriteString(response.Message.Content)
+		sentencer.Write(response.Message.Content, response.Done)
+		if response.Done {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "recv chat")
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	// The stream is closed without done, for example, Ollama is restarted, so commit the last sentence,
+	// and count the tokens by tokenizer for usage.
+	logger.Wf(ctx, "Ollama: Stream closed without done, content=%v", content.Len())
+	sentencer.Write("", true)
+
+	if tokenizer, err := NewTokenizer(model); err != nil {
+		logger.Wf(ctx, "Usage: Ignore tokenizer err %+v", err)
+	} else {
+		usageAccount.Record(ctx, stage, robot, rid, &Usage{
+			PromptTokens: tokenizer.CountMessages(messages...), CompletionTokens: tokenizer.Count(content.String()),
+		})
+	}
+	return nil
+}
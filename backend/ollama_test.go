@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Handle the stream of Ollama, return the committed sentences and the usage of tenant.
+func handleOllamaChatTest(t *testing.T, stream string) ([]string, *Usage) {
+	prices, err := NewPriceTable(func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("prices, err %v", err)
+	}
+	usageAccount = NewUsageAccount(prices)
+
+	tenant := &Tenant{id: "default"}
+	robot := &Robot{uuid: "default", chatProvider: "ollama", chatModel: "llama3", replyLimit: 30}
+	stage := NewStage(func(stage *Stage) {
+		stage.loggingCtx, stage.tenant, stage.conf = context.Background(), tenant, &Config{StageTimeout: 300 * time.Second}
+		stage.ttsWorker.textOnly = true
+	})
+	defer stage.Close()
+
+	var sentences []string
+	service := &ollamaChatService{onFirstResponse: func(ctx context.Context, text string) {
+		sentences = append(sentences, text)
+	}}
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hello"}}
+	if err := service.handle(context.Background(), stage, robot, "rid", strings.NewReader(stream), "llama3", messages); err != nil {
+		t.Fatalf("handle, err %v", err)
+	}
+
+	total, _, _ := usageAccount.QueryTenant(tenant.id)
+	return sentences, total
+}
+
+func TestOllamaChatDone(t *testing.T) {
+	sentences, usage := handleOllamaChatTest(t, `{"message":{"content":"Hello"}}
+{"message":{"content":" there"}}
+{"message":{"content":""},"done":true,"prompt_eval_count":20,"eval_count":2}
+`)
+	if strings.Join(sentences, "|") != "Hello there" {
+		t.Fatalf("sentences %v", sentences)
+	}
+	if usage.PromptTokens != 20 || usage.CompletionTokens != 2 {
+		t.Fatalf("usage %+v, should be from done", usage)
+	}
+}
+
+// The stream is closed without done, the last sentence should be committed, and the usage counted.
+func TestOllamaChatWithoutDone(t *testing.T) {
+	sentences, usage := handleOllamaChatTest(t, `{"message":{"content":"Hello"}}
+{"message":{"content":" there"}}
+`)
+	if strings.Join(sentences, "|") != "Hello there" {
+		t.Fatalf("sentences %v, should be flushed", sentences)
+	}
+	if usage.Turns != 1 || usage.PromptTokens <= 0 || usage.CompletionTokens != 2 {
+		t.Fatalf("usage %+v, should be counted", usage)
+	}
+}
@@ -1,29 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	errors_std "errors"
 	"fmt"
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
 	"github.com/sashabaranov/go-openai"
 	"io"
-	"os"
-	"os/exec"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
-	"unicode"
-	"unicode/utf8"
 )
 
-var asrAIConfig openai.ClientConfig
-var chatAIConfig openai.ClientConfig
-var ttsAIConfig openai.ClientConfig
+// The default API version of Azure OpenAI, which supports chat, transcriptions and speech.
+const azureDefaultAPIVersion = "2024-02-15-preview"
 
-func openaiInit(ctx context.Context) {
+// The min API version of Azure OpenAI which supports the stream_options, the older versions reject it
+// with 400 error, see https://learn.microsoft.com/en-us/azure/ai-services/openai/reference
+const azureStreamUsageAPIVersion = "2024-09-01-preview"
+
+// Whether the API supports the token usage in stream by stream_options, the API version of Azure is in
+// date format like 2024-09-01-preview, so it's compared by string.
+func streamUsageSupported(aiConfig openai.ClientConfig) bool {
+	if aiConfig.APIType == openai.APITypeAzure || aiConfig.APIType == openai.APITypeAzureAD {
+		return aiConfig.APIVersion >= azureStreamUsageAPIVersion
+	}
+	return true
+}
+
+// Build the OpenAI client configs for ASR, chat, TTS and embedding, by the getenv which read the env of tenant.
+// Each service uses Azure OpenAI if the endpoint of Azure is set, and maps the model to deployment.
+func openaiInit(ctx context.Context, getenv func(key string) string) (asrAIConfig, chatAIConfig, ttsAIConfig, embeddingAIConfig openai.ClientConfig, err error) {
 	filterProxyUrl := func(proxy string) string {
 		var baseURL string
 		if strings.Contains(proxy, "://") {
@@ -39,39 +47,75 @@ func openaiInit(ctx context.Context) {
 	}
 	getFirstEnv := func(envNames ...string) string {
 		for _, envName := range envNames {
-			if v := os.Getenv(envName); v != "" {
+			if v := getenv(envName); v != "" {
 				return v
 			}
 		}
 		return ""
 	}
 
-	asrAPIKey := getFirstEnv("ASR_OPENAI_API_KEY", "OPENAI_API_KEY")
-	asrPorxy := getFirstEnv("ASR_OPENAI_PROXY", "OPENAI_PROXY")
-	asrAIConfig = openai.DefaultConfig(asrAPIKey)
-	asrAIConfig.BaseURL = filterProxyUrl(asrPorxy)
-	asrAIConfig.OrgID = os.Getenv("OPENAI_ORGANIZATION")
-
-	chatAPIKey := getFirstEnv("CHAT_OPENAI_API_KEY", "OPENAI_API_KEY")
-	chatPorxy := getFirstEnv("CHAT_OPENAI_PROXY", "OPENAI_PROXY")
-	chatAIConfig = openai.DefaultConfig(chatAPIKey)
-	chatAIConfig.BaseURL = filterProxyUrl(chatPorxy)
-	chatAIConfig.OrgID = os.Getenv("OPENAI_ORGANIZATION")
-
-	ttsAPIKey := getFirstEnv("TTS_OPENAI_API_KEY", "OPENAI_API_KEY")
-	ttsPorxy := getFirstEnv("TTS_OPENAI_PROXY", "OPENAI_PROXY")
-	ttsAIConfig = openai.DefaultConfig(ttsAPIKey)
-	ttsAIConfig.BaseURL = filterProxyUrl(ttsPorxy)
-	ttsAIConfig.OrgID = os.Getenv("OPENAI_ORGANIZATION")
-
-	logger.Tf(ctx, "OpenAI config, asr<key=%vB, proxy=%v, base=%v, org=%v>, chat=<key=%vB, proxy=%v, base=%v, org=%v>, tts=<key=%vB, proxy=%v, base=%v, org=%v>",
-		len(asrAPIKey), asrPorxy, asrAIConfig.BaseURL, asrAIConfig.OrgID,
-		len(chatAPIKey), chatPorxy, chatAIConfig.BaseURL, chatAIConfig.OrgID,
-		len(ttsAPIKey), ttsPorxy, ttsAIConfig.BaseURL, ttsAIConfig.OrgID,
-	)
+	// The Azure deployments, map model to deployment name, for example, gpt-4-turbo-preview=my-gpt4.
+	deployments := make(map[string]string)
+	for _, item := range strings.Split(getenv("AZURE_OPENAI_DEPLOYMENTS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		model, deployment, ok := strings.Cut(item, "=")
+		if !ok || model == "" || deployment == "" {
+			err = errors.Errorf("invalid AZURE_OPENAI_DEPLOYMENTS %v", item)
+			return
+		}
+		deployments[strings.TrimSpace(model)] = strings.TrimSpace(deployment)
+	}
+
+	// Build the config of service by prefix, such as ASR, and return the description for logging.
+	buildConfig := func(prefix string) (openai.ClientConfig, string) {
+		if endpoint := getFirstEnv(prefix+"_AZURE_OPENAI_ENDPOINT", "AZURE_OPENAI_ENDPOINT"); endpoint != "" {
+			apiKey := getFirstEnv(prefix+"_AZURE_OPENAI_API_KEY", "AZURE_OPENAI_API_KEY")
+			aiConfig := openai.DefaultAzureConfig(apiKey, strings.TrimSuffix(endpoint, "/"))
+			if version := getFirstEnv(prefix+"_AZURE_OPENAI_API_VERSION", "AZURE_OPENAI_API_VERSION"); version != "" {
+				aiConfig.APIVersion = version
+			} else {
+				aiConfig.APIVersion = azureDefaultAPIVersion
+			}
+
+			defaultMapper := aiConfig.AzureModelMapperFunc
+			aiConfig.AzureModelMapperFunc = func(model string) string {
+				if deployment, ok := deployments[model]; ok {
+					return deployment
+				}
+				return defaultMapper(model)
+			}
+
+			return aiConfig, fmt.Sprintf("<azure, key=%vB, endpoint=%v, version=%v>",
+				len(apiKey), aiConfig.BaseURL, aiConfig.APIVersion)
+		}
+
+		apiKey := getFirstEnv(prefix+"_OPENAI_API_KEY", "OPENAI_API_KEY")
+		proxy := getFirstEnv(prefix+"_OPENAI_PROXY", "OPENAI_PROXY")
+		aiConfig := openai.DefaultConfig(apiKey)
+		aiConfig.BaseURL = filterProxyUrl(proxy)
+		aiConfig.OrgID = getenv("OPENAI_ORGANIZATION")
+		return aiConfig, fmt.Sprintf("<key=%vB, proxy=%v, base=%v, org=%v>",
+			len(apiKey), proxy, aiConfig.BaseURL, aiConfig.OrgID)
+	}
+
+	asrAIConfig, asrDesc := buildConfig("ASR")
+	chatAIConfig, chatDesc := buildConfig("CHAT")
+	ttsAIConfig, ttsDesc := buildConfig("TTS")
+	embeddingAIConfig, embeddingDesc := buildConfig("EMBEDDING")
+
+	logger.Tf(ctx, "OpenAI config, asr=%v, chat=%v, tts=%v, embedding=%v, deployments=%v",
+		asrDesc, chatDesc, ttsDesc, embeddingDesc, deployments)
+	return
 }
 
 type openaiASRService struct {
+	// The OpenAI client config for ASR.
+	aiConfig openai.ClientConfig
+	// The ASR model, for example, whisper-1.
+	model string
 }
 
 func NewOpenAIASRService(opts ...func(service *openaiASRService)) ASRService {
@@ -82,35 +126,29 @@ func NewOpenAIASRService(opts ...func(service *openaiASRService)) ASRService {
 	return v
 }
 
-func (v *openaiASRService) RequestASR(ctx context.Context, inputFile, language, prompt string, onBeforeRequest func()) (*ASRResult, error) {
-	outputFile := fmt.Sprintf("%v.mp4", inputFile)
-	if os.Getenv("AIT_KEEP_FILES") != "true" {
-		defer os.Remove(outputFile)
-	}
-
-	// Transcode input audio in opus or aac, to aac in m4a format.
-	// If need to encode to aac, use:
-	//		"-c:a", "aac", "-ac", "1", "-ar", "16000", "-ab", "30k",
-	if err := exec.CommandContext(ctx, "ffmpeg",
-		"-i", inputFile,
-		"-vn", "-c:a", "copy",
-		outputFile,
-	).Run(); err != nil {
-		return nil, errors.Errorf("Error converting the file")
+func (v *openaiASRService) RequestASR(ctx context.Context, input []byte, language, prompt string, onBeforeRequest func()) (*ASRResult, error) {
+	// Transcode input audio in opus or aac, to FLAC in memory, which is lossless and could be written
+	// to stdout, while the MP4 requires seeking.
+	var flac bytes.Buffer
+	if err := transcodeAudio(ctx, bytes.NewReader(input), &flac,
+		"-c:a", "flac", "-ac", "1", "-ar", "16000", "-f", "flac",
+	); err != nil {
+		return nil, errors.Wrapf(err, "transcode")
 	}
-	logger.Tf(ctx, "Convert audio %v to %v ok", inputFile, outputFile)
+	logger.Tf(ctx, "Convert audio %vB to FLAC %vB ok", len(input), flac.Len())
 
 	if onBeforeRequest != nil {
 		onBeforeRequest()
 	}
 
 	// Request ASR.
-	client := openai.NewClientWithConfig(asrAIConfig)
+	client := openai.NewClientWithConfig(v.aiConfig)
 	resp, err := client.CreateTranscription(
 		ctx,
 		openai.AudioRequest{
-			Model:    os.Getenv("AIT_ASR_MODEL"),
-			FilePath: outputFile,
+			Model:    v.model,
+			Reader:   &flac,
+			FilePath: "input.flac",
 			// Note that must use verbose JSON, to get the duration of file.
 			Format:   openai.AudioResponseFormatVerboseJSON,
 			Language: language,
@@ -124,139 +162,90 @@ func (v *openaiASRService) RequestASR(ctx context.Context, inputFile, language,
 	return &ASRResult{Text: resp.Text, Duration: time.Duration(resp.Duration * float64(time.Second))}, nil
 }
 
-func ffprobeAudio(ctx context.Context, filename string) (duration float64, bitrate int, err error) {
-	args := []string{
-		"-show_error", "-show_private_data", "-v", "quiet", "-find_stream_info", "-print_format", "json",
-		"-show_format",
-	}
-	args = append(args, "-i", filename)
-
-	stdout, err := exec.CommandContext(ctx, "ffprobe", args...).Output()
-	if err != nil {
-		err = errors.Wrapf(err, "probe %v", filename)
-		return
-	}
-
-	type VLiveFileFormat struct {
-		Starttime string `json:"start_time"`
-		Duration  string `json:"duration"`
-		Bitrate   string `json:"bit_rate"`
-		Streams   int32  `json:"nb_streams"`
-		Score     int32  `json:"probe_score"`
-		HasVideo  bool   `json:"has_video"`
-		HasAudio  bool   `json:"has_audio"`
-	}
-
-	format := struct {
-		Format VLiveFileFormat `json:"format"`
-	}{}
-	if err = json.Unmarshal([]byte(stdout), &format); err != nil {
-		err = errors.Wrapf(err, "parse format %v", stdout)
-		return
-	}
-
-	var fv float64
-	if fv, err = strconv.ParseFloat(format.Format.Duration, 64); err != nil {
-		err = errors.Wrapf(err, "parse duration %v", format.Format.Duration)
-		return
-	} else {
-		duration = fv
-	}
+type openaiChatService struct {
+	// The config of server, for the max tokens, temperature and summary.
+	conf *Config
+	// The OpenAI client config for chat.
+	aiConfig        openai.ClientConfig
+	onFirstResponse func(ctx context.Context, text string)
+	// The OpenAI client config for embedding, to search the knowledge base of robot.
+	embeddingAIConfig openai.ClientConfig
+	// The matched documents of knowledge base, the source references of answer.
+	sources []*KnowledgeMatch
+	// The chat request, to continue the chat after tool calls.
+	request openai.ChatCompletionRequest
+}
 
-	var iv int64
-	if iv, err = strconv.ParseInt(format.Format.Bitrate, 10, 64); err != nil {
-		err = errors.Wrapf(err, "parse bitrate %v", format.Format.Bitrate)
-		return
-	} else {
-		bitrate = int(iv)
+func NewOpenAIChatService(opts ...func(service *openaiChatService)) ChatService {
+	v := &openaiChatService{}
+	for _, opt := range opts {
+		opt(v)
 	}
-
-	logger.Tf(ctx, "FFprobe input=%v, duration=%v, bitrate=%v", filename, duration, bitrate)
-	return
+	return v
 }
 
-type openaiChatService struct {
-	onFirstResponse func(ctx context.Context, text string)
+// The max rounds of tool calls for each chat, to avoid infinite loop. After that, the tool calls are
+// dropped, and the chat is requested without tools for the final answer.
+const maxToolCallRounds = 3
+
+func (v *openaiChatService) Sources() []*KnowledgeMatch {
+	return v.sources
 }
 
 func (v *openaiChatService) RequestChat(ctx context.Context, rid string, stage *Stage, robot *Robot) error {
-	if stage.previousUser != "" && stage.previousAssitant != "" {
-		stage.histories = append(stage.histories, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: stage.previousUser,
-		}, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleAssistant,
-			Content: stage.previousAssitant,
-		})
+	// The span of chat, which is ended when the stream is done.
+	ctx, span := startSpan(ctx, "chat", withSpanKind(spanKindClient))
 
-		for len(stage.histories) > robot.chatWindow*2 {
-			stage.histories = stage.histories[1:]
-		}
+	turn, err := prepareChatTurn(ctx, v.conf, rid, stage, robot, 0, v.aiConfig, v.embeddingAIConfig)
+	if err != nil {
+		return span.End(errors.Wrapf(err, "prepare"))
 	}
+	v.sources = turn.sources
+	span.SetAttributes("provider", "openai", "model", turn.model, "messages", len(turn.messages))
 
-	stage.previousUser = stage.previousAsrText
-	stage.previousAssitant = ""
-
-	system := robot.prompt
-	system += fmt.Sprintf(" Keep your reply neat, limiting the reply to %v words.", robot.replyLimit)
-	logger.Tf(ctx, "AI system prompt: %v", system)
-	messages := []openai.ChatCompletionMessage{
-		{Role: openai.ChatMessageRoleSystem, Content: system},
+	logger.Tf(ctx, "robot=%v(%v), OPENAI_PROXY: %v, AIT_CHAT_MODEL: %v, AIT_MAX_TOKENS: %v, AIT_TEMPERATURE: %v, window=%v, histories=%v",
+		robot.uuid, robot.label, v.aiConfig.BaseURL, turn.model, turn.maxTokens, turn.temperature, robot.chatWindow, stage.histories.Len())
+
+	v.request = openai.ChatCompletionRequest{
+		Model:       turn.model,
+		Messages:    turn.messages,
+		Stream:      true,
+		Temperature: turn.temperature,
+		MaxTokens:   turn.maxTokens,
 	}
-
-	messages = append(messages, stage.histories...)
-	messages = append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: stage.previousAsrText,
-	})
-
-	model := robot.chatModel
-	var maxTokens int
-	if v, err := strconv.ParseInt(os.Getenv("AIT_MAX_TOKENS"), 10, 64); err != nil {
-		return errors.Wrapf(err, "parse AIT_MAX_TOKENS %v", os.Getenv("AIT_MAX_TOKENS"))
-	} else {
-		maxTokens = int(v)
+	// Request the token usage in the last chunk for usage accounting, if supported, or count by tokenizer.
+	if streamUsageSupported(v.aiConfig) {
+		v.request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
 	}
-
-	var temperature float32
-	if v, err := strconv.ParseFloat(os.Getenv("AIT_TEMPERATURE"), 64); err != nil {
-		return errors.Wrapf(err, "parse AIT_TEMPERATURE %v", os.Getenv("AIT_TEMPERATURE"))
-	} else {
-		temperature = float32(v)
+	for _, name := range robot.tools {
+		v.request.Tools = append(v.request.Tools, chatTools[name].Definition())
 	}
-	logger.Tf(ctx, "robot=%v(%v), OPENAI_PROXY: %v, AIT_CHAT_MODEL: %v, AIT_MAX_TOKENS: %v, AIT_TEMPERATURE: %v, window=%v, histories=%v",
-		robot.uuid, robot.label, chatAIConfig.BaseURL, model, maxTokens, temperature, robot.chatWindow, len(stage.histories))
-
-	client := openai.NewClientWithConfig(chatAIConfig)
-	gptChatStream, err := client.CreateChatCompletionStream(
-		ctx, openai.ChatCompletionRequest{
-			Model:       model,
-			Messages:    messages,
-			Stream:      true,
-			Temperature: temperature,
-			MaxTokens:   maxTokens,
-		},
-	)
+
+	client := openai.NewClientWithConfig(v.aiConfig)
+	gptChatStream, err := client.CreateChatCompletionStream(ctx, v.request)
 	if err != nil {
-		return errors.Wrapf(err, "create chat")
+		return span.End(errors.Wrapf(err, "create chat"))
 	}
 
-	// Never wait for any response.
+	// Never wait for any response, but the turn waits for the stream.
+	tasks := turnTasksFromContext(ctx)
+	tasks.Add()
 	go func() {
+		defer tasks.Done()
 		defer gptChatStream.Close()
-		if err := v.handle(ctx, stage, robot, rid, gptChatStream); err != nil {
+		err := v.handle(ctx, stage, robot, rid, gptChatStream)
+		if err != nil {
 			logger.Ef(ctx, "Handle stream failed, err %+v", err)
 		}
+		span.End(err)
 	}()
 
 	return nil
 }
 
 func (v *openaiChatService) handle(ctx context.Context, stage *Stage, robot *Robot, rid string, gptChatStream *openai.ChatCompletionStream) error {
-	stage.generating = true
-	defer func() {
-		stage.generating = false
-	}()
+	stage.SetGenerating(true)
+	defer stage.SetGenerating(false)
 
 	filterAIResponse := func(response *openai.ChatCompletionStreamResponse, err error) (bool, string, error) {
 		finished := errors_std.Is(err, io.EOF)
@@ -268,154 +257,156 @@ func (v *openaiChatService) handle(ctx context.Context, stage *Stage, robot *Rob
 			return finished, "", nil
 		}
 
-		choice := response.Choices[0]
-		dc := choice.Delta.Content
-		if dc == "" {
-			return finished, "", nil
-		}
+		return finished, response.Choices[0].Delta.Content, nil
+	}
 
-		filteredStencese := strings.ReplaceAll(dc, "\n\n", "\n")
-		filteredStencese = strings.ReplaceAll(filteredStencese, "\n", " ")
+	// Call the tools, then continue the chat with the tool results in a new stream. The content is the
+	// text of assistant in the same round with the tool calls, if any.
+	callTools := func(content string, toolCalls []openai.ToolCall) (*openai.ChatCompletionStream, error) {
+		v.request.Messages = append(v.request.Messages, openai.ChatCompletionMessage{
+			Role: openai.ChatMessageRoleAssistant, Content: content, ToolCalls: toolCalls,
+		})
+		for _, toolCall := range toolCalls {
+			v.request.Messages = append(v.request.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    callChatTool(ctx, toolCall.Function.Name, toolCall.Function.Arguments),
+				ToolCallID: toolCall.ID,
+			})
+		}
 
-		return finished, filteredStencese, nil
+		client := openai.NewClientWithConfig(v.aiConfig)
+		return client.CreateChatCompletionStream(ctx, v.request)
 	}
 
-	gotNewSentence := func(sentence, lastWords string, firstSentense bool) bool {
-		newSentence := false
-
-		isEnglish := func(s string) bool {
-			for _, r := range s {
-				if r > unicode.MaxASCII {
-					return false
-				}
+	// Record the usage of round, count the tokens of request and response by tokenizer, if no usage in
+	// stream, for example, the old API version of Azure.
+	recordUsage := func(usage *openai.Usage, content string, toolCalls []openai.ToolCall) {
+		if usage == nil {
+			tokenizer, err := NewTokenizer(v.request.Model)
+			if err != nil {
+				logger.Wf(ctx, "Usage: Ignore tokenizer err %+v", err)
+				return
 			}
-			return true
-		}
 
-		// Ignore empty.
-		if sentence == "" {
-			return newSentence
+			usage = &openai.Usage{PromptTokens: tokenizer.CountMessages(v.request.Messages...)}
+			usage.CompletionTokens = tokenizer.Count(content)
+			for _, toolCall := range toolCalls {
+				usage.CompletionTokens += tokenizer.Count(toolCall.Function.Name) + tokenizer.Count(toolCall.Function.Arguments)
+			}
 		}
 
-		// Any ASCII character to split sentence.
-		if strings.ContainsAny(lastWords, ",.?!\n") {
-			newSentence = true
-		}
+		usageAccount.Record(ctx, stage, robot, rid, &Usage{
+			PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens,
+		})
+	}
 
-		// Any Chinese character to split sentence.
-		if strings.ContainsRune(lastWords, '。') ||
-			strings.ContainsRune(lastWords, '？') ||
-			strings.ContainsRune(lastWords, '！') ||
-			strings.ContainsRune(lastWords, '，') {
-			newSentence = true
-		}
+	sentencer := newChatSentencer(ctx, stage, robot, rid, v.onFirstResponse)
 
-		// Badcase, for number such as 1.3, or 1,300,000.
-		var badcase bool
-		if match, _ := regexp.MatchString(`\d+(\.|,)\d*$`, sentence); match {
-			badcase, newSentence = true, false
+	// The tool calls, the content and the usage of current round.
+	var toolCalls []openai.ToolCall
+	var content strings.Builder
+	var usage *openai.Usage
+	isFinished, toolCallRounds := false, 0
+	for !isFinished && ctx.Err() == nil {
+		response, err := gptChatStream.Recv()
+		if err == nil && response.Usage != nil {
+			usage = response.Usage
 		}
 
-		// Determine whether new sentence by length.
-		if isEnglish(sentence) {
-			maxWords, minWords := 30, 3
-			if !firstSentense || badcase {
-				maxWords, minWords = 50, 5
-			}
-
-			if nn := strings.Count(sentence, " "); nn >= maxWords {
-				newSentence = true
-			} else if nn < minWords {
-				newSentence = false
-			}
-		} else {
-			maxWords, minWords := 50, 3
-			if !firstSentense || badcase {
-				maxWords, minWords = 100, 5
-			}
+		// Merge the tool calls in stream, by the index of tool call.
+		if err == nil && len(response.Choices) > 0 {
+			for _, delta := range response.Choices[0].Delta.ToolCalls {
+				index := len(toolCalls)
+				if delta.Index != nil {
+					index = *delta.Index
+				}
+				for len(toolCalls) <= index {
+					toolCalls = append(toolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+				}
 
-			if nn := utf8.RuneCount([]byte(sentence)); nn >= maxWords {
-				newSentence = true
-			} else if nn < minWords {
-				newSentence = false
+				if delta.ID != "" {
+					toolCalls[index].ID = delta.ID
+				}
+				toolCalls[index].Function.Name += delta.Function.Name
+				toolCalls[index].Function.Arguments += delta.Function.Arguments
 			}
 		}
 
-		return newSentence
-	}
-
-	commitAISentence := func(sentence string, firstSentense bool) {
-		filteredSentence := sentence
-		if strings.TrimSpace(sentence) == "" {
-			return
+		finished, words, err := filterAIResponse(&response, err)
+		if err != nil {
+			return errors.Wrapf(err, "filter")
 		}
-
-		if firstSentense {
-			if robot.prefix != "" {
-				filteredSentence = fmt.Sprintf("%v %v", robot.prefix, filteredSentence)
-			}
-			if v.onFirstResponse != nil {
-				v.onFirstResponse(ctx, filteredSentence)
-			}
+		isFinished = finished
+		content.WriteString(words)
+		if isFinished {
+			recordUsage(usage, content.String(), toolCalls)
 		}
 
-		segment := NewAnswerSegment(func(segment *AnswerSegment) {
-			segment.rid = rid
-			segment.text = filteredSentence
-			segment.first = firstSentense
-		})
-		stage.ttsWorker.SubmitSegment(ctx, stage, segment)
+		// When finished with tool calls, call the tools and continue the chat in new stream.
+		if isFinished && len(toolCalls) > 0 && toolCallRounds < maxToolCallRounds {
+			sentencer.Write(words, false)
 
-		logger.Tf(ctx, "TTS: Commit segment rid=%v, asid=%v, first=%v, sentence is %v",
-			rid, segment.asid, firstSentense, filteredSentence)
-		return
-	}
+			logger.Tf(ctx, "Tools: Round %v, calls=%v", toolCallRounds, len(toolCalls))
+			if gptChatStream, err = callTools(content.String(), toolCalls); err != nil {
+				return errors.Wrapf(err, "create chat for tools")
+			}
+			defer gptChatStream.Close()
 
-	var sentence, lastWords string
-	isFinished, firstSentense := false, true
-	for !isFinished && ctx.Err() == nil {
-		response, err := gptChatStream.Recv()
-		if finished, words, err := filterAIResponse(&response, err); err != nil {
-			return errors.Wrapf(err, "filter")
-		} else {
-			isFinished, sentence, lastWords = finished, sentence+words, words
+			isFinished, toolCalls, usage, toolCallRounds = false, nil, nil, toolCallRounds+1
+			content.Reset()
+			continue
 		}
-		//logger.Tf(ctx, "AI response: text=%v plus %v", lastWords, sentence)
 
-		newSentence := gotNewSentence(sentence, lastWords, firstSentense)
-		if !isFinished && !newSentence {
+		// When reach the max rounds, drop the tool calls, and request again without tools for the answer.
+		if isFinished && len(toolCalls) > 0 && len(v.request.Tools) > 0 {
+			sentencer.Write(words, false)
+
+			logger.Wf(ctx, "Tools: Reach max rounds %v, drop calls=%v, request without tools",
+				maxToolCallRounds, len(toolCalls))
+			v.request.Tools = nil
+			client := openai.NewClientWithConfig(v.aiConfig)
+			if gptChatStream, err = client.CreateChatCompletionStream(ctx, v.request); err != nil {
+				return errors.Wrapf(err, "create chat without tools")
+			}
+			defer gptChatStream.Close()
+
+			isFinished, toolCalls, usage = false, nil, nil
+			content.Reset()
 			continue
 		}
 
-		// Use the sentence for prompt and logging.
-		stage.previousAssitant += sentence + " "
-		// We utilize user ASR and AI responses as prompts for the subsequent ASR, given that this is
-		// a chat-based scenario where the user converses with the AI, and the following audio should pertain to both user and AI text.
-		stage.previousAsrText += " " + sentence
-		// Commit the sentense to TTS worker and callbacks.
-		commitAISentence(sentence, firstSentense)
-		// Reset the sentence, because we have committed it.
-		sentence, firstSentense = "", false
+		sentencer.Write(words, isFinished)
 	}
 
 	return nil
 }
 
 type openaiTTSService struct {
+	// The OpenAI client config for TTS.
+	aiConfig openai.ClientConfig
+	// The TTS model, and the default voice if robot not set.
+	model string
+	voice string
 }
 
-func NewOpenAITTSService() TTSService {
-	return &openaiTTSService{}
+func NewOpenAITTSService(opts ...func(service *openaiTTSService)) TTSService {
+	v := &openaiTTSService{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
 }
 
-func (v *openaiTTSService) RequestTTS(ctx context.Context, buildFilepath func(ext string) string, text string) error {
-	ttsFile := buildFilepath("aac")
+func (v *openaiTTSService) RequestTTS(ctx context.Context, buildOutput func(ext string) io.Writer, text, voice string) error {
+	if voice == "" {
+		voice = v.voice
+	}
 
-	client := openai.NewClientWithConfig(ttsAIConfig)
+	client := openai.NewClientWithConfig(v.aiConfig)
 	resp, err := client.CreateSpeech(ctx, openai.CreateSpeechRequest{
-		Model:          openai.SpeechModel(os.Getenv("AIT_TTS_MODEL")),
+		Model:          openai.SpeechModel(v.model),
 		Input:          text,
-		Voice:          openai.SpeechVoice(os.Getenv("AIT_TTS_VOICE")),
+		Voice:          openai.SpeechVoice(voice),
 		ResponseFormat: openai.SpeechResponseFormatAac,
 	})
 	if err != nil {
@@ -423,14 +414,8 @@ func (v *openaiTTSService) RequestTTS(ctx context.Context, buildFilepath func(ex
 	}
 	defer resp.Close()
 
-	out, err := os.Create(ttsFile)
-	if err != nil {
-		return errors.Errorf("Unable to create the file %v for writing", ttsFile)
-	}
-	defer out.Close()
-
-	if _, err = io.Copy(out, resp); err != nil {
-		return errors.Errorf("Error writing the file")
+	if _, err = io.Copy(buildOutput("aac"), resp); err != nil {
+		return errors.Wrapf(err, "copy speech")
 	}
 
 	return nil
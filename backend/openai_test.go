@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestStreamUsageSupported(t *testing.T) {
+	azure := func(version string) openai.ClientConfig {
+		aiConfig := openai.DefaultAzureConfig("key", "https://example.openai.azure.com")
+		aiConfig.APIVersion = version
+		return aiConfig
+	}
+
+	for _, c := range []struct {
+		name     string
+		aiConfig openai.ClientConfig
+		expect   bool
+	}{
+		{"openai", openai.DefaultConfig("key"), true},
+		{"azure default", azure(azureDefaultAPIVersion), false},
+		{"azure preview", azure("2024-09-01-preview"), true},
+		{"azure ga", azure("2024-10-21"), true},
+	} {
+		if v := streamUsageSupported(c.aiConfig); v != c.expect {
+			t.Errorf("%v: supported %v, should be %v", c.name, v, c.expect)
+		}
+	}
+}
+
+// The stream of chat, which responses the content in chunks, with usage if requested by stream_options.
+func newOpenAIChatTestServer(t *testing.T, content string, requests *[]map[string]interface{}) *httptest.Server {
+	var lock sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &request); err != nil {
+			t.Errorf("parse request %v, err %v", string(b), err)
+		}
+		lock.Lock()
+		*requests = append(*requests, request)
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		send := func(v interface{}) {
+			b, _ := json.Marshal(v)
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		}
+		for _, word := range strings.SplitAfter(content, " ") {
+			send(openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{
+				{Delta: openai.ChatCompletionStreamChoiceDelta{Content: word}},
+			}})
+		}
+		if _, ok := request["stream_options"]; ok {
+			send(openai.ChatCompletionStreamResponse{Usage: &openai.Usage{PromptTokens: 100, CompletionTokens: 10}})
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+	}))
+}
+
+// Request the chat, return the usage of tenant when the chat is done.
+func requestOpenAIChatTest(t *testing.T, aiConfig openai.ClientConfig, robot *Robot) *Usage {
+	prices, err := NewPriceTable(func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("prices, err %v", err)
+	}
+	usageAccount = NewUsageAccount(prices)
+
+	conf := &Config{MaxTokens: 100, Temperature: 0.5, StageTimeout: 300 * time.Second}
+	tenant := &Tenant{id: "default"}
+	stage := NewStage(func(stage *Stage) {
+		stage.loggingCtx, stage.tenant, stage.conf = context.Background(), tenant, conf
+		stage.ttsWorker.textOnly = true
+	})
+	defer stage.Close()
+	stage.OnASR("Hello", time.Second)
+
+	service := NewOpenAIChatService(func(service *openaiChatService) {
+		service.conf, service.aiConfig = conf, aiConfig
+		service.onFirstResponse = func(ctx context.Context, text string) {}
+	})
+
+	tasks := &turnTasks{}
+	if err := service.RequestChat(withTurnTasks(context.Background(), tasks), "rid", stage, robot); err != nil {
+		t.Fatalf("chat, err %v", err)
+	}
+	tasks.Wait()
+
+	total, _, _ := usageAccount.QueryTenant(tenant.id)
+	return total
+}
+
+func TestOpenAIChatUsage(t *testing.T) {
+	var requests []map[string]interface{}
+	server := newOpenAIChatTestServer(t, "Hello, how can I help you?", &requests)
+	defer server.Close()
+
+	aiConfig := openai.DefaultConfig("key")
+	aiConfig.BaseURL = server.URL
+	usage := requestOpenAIChatTest(t, aiConfig, &Robot{uuid: "default", chatModel: "gpt-4", replyLimit: 30, chatWindow: 5})
+
+	if _, ok := requests[0]["stream_options"]; !ok {
+		t.Fatalf("stream_options should be requested, %v", requests[0])
+	}
+	if usage.PromptTokens != 100 || usage.CompletionTokens != 10 {
+		t.Fatalf("usage %+v, should be from stream", usage)
+	}
+}
+
+func TestOpenAIChatUsageByTokenizer(t *testing.T) {
+	var requests []map[string]interface{}
+	content := "Hello, how can I help you?"
+	server := newOpenAIChatTestServer(t, content, &requests)
+	defer server.Close()
+
+	aiConfig := openai.DefaultAzureConfig("key", server.URL)
+	aiConfig.APIVersion = azureDefaultAPIVersion
+	usage := requestOpenAIChatTest(t, aiConfig, &Robot{uuid: "default", chatModel: "gpt-4", replyLimit: 30, chatWindow: 5})
+
+	if _, ok := requests[0]["stream_options"]; ok {
+		t.Fatalf("stream_options should not be requested for %v, %v", azureDefaultAPIVersion, requests[0])
+	}
+
+	tokenizer, err := NewTokenizer("gpt-4")
+	if err != nil {
+		t.Fatalf("tokenizer, err %v", err)
+	}
+	if expect := tokenizer.Count(content); usage.CompletionTokens != expect {
+		t.Fatalf("completion tokens %v, should be %v", usage.CompletionTokens, expect)
+	}
+	if usage.PromptTokens <= 0 {
+		t.Fatalf("prompt tokens %v, should be counted", usage.PromptTokens)
+	}
+}
+
+// The chat always calls the calculator if tools are requested, which should be dropped after the max rounds,
+// and requested again without tools for the answer.
+func TestOpenAIChatMaxToolCallRounds(t *testing.T) {
+	if err := toolsInit(context.Background(), &Config{}); err != nil {
+		t.Fatalf("tools, err %v", err)
+	}
+
+	var lock sync.Mutex
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("parse request, err %v", err)
+		}
+		lock.Lock()
+		requests = append(requests, request)
+		lock.Unlock()
+
+		var delta openai.ChatCompletionStreamChoiceDelta
+		if len(request.Tools) > 0 {
+			delta.ToolCalls = []openai.ToolCall{{
+				ID: fmt.Sprintf("call-%v", len(requests)), Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: "calculator", Arguments: `{"expression":"6*7"}`},
+			}}
+		} else {
+			delta.Content = "The answer is 42."
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		b, _ := json.Marshal(openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{{Delta: delta}}})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", b)
+	}))
+	defer server.Close()
+
+	aiConfig := openai.DefaultConfig("key")
+	aiConfig.BaseURL = server.URL
+	robot := &Robot{uuid: "default", chatModel: "gpt-4", replyLimit: 30, chatWindow: 5, tools: []string{"calculator"}}
+	requestOpenAIChatTest(t, aiConfig, robot)
+
+	if len(requests) != maxToolCallRounds+2 {
+		t.Fatalf("requests %v, should be %v", len(requests), maxToolCallRounds+2)
+	}
+	last := requests[len(requests)-1]
+	if len(last.Tools) != 0 {
+		t.Fatalf("last request should be without tools, %v", last.Tools)
+	}
+
+	var results int
+	for _, message := range last.Messages {
+		if message.Role == openai.ChatMessageRoleTool {
+			results++
+		}
+	}
+	if results != maxToolCallRounds {
+		t.Fatalf("tool results %v, should be %v", results, maxToolCallRounds)
+	}
+}
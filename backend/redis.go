@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The shared state of stages in Redis, nil if not enabled, then the stages are process-local.
+var stageStore *redisStageStore
+
+// Initialize the shared state by AIT_REDIS, for multiple replicas behind a load balancer.
+func redisInit(ctx context.Context, conf *Config) error {
+	addr := conf.Redis
+	if addr == "" {
+		return nil
+	}
+
+	// The TTS audio must be fetched by any replica, so it should be in shared storage.
+	if !audioStorage.Shared() {
+		return errors.New("AIT_REDIS requires shared storage, please set AIT_STORAGE=s3")
+	}
+
+	client, err := NewRedisClient(func(client *redisClient) error {
+		return client.parse(addr)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "redis %v", addr)
+	}
+
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		return errors.Wrapf(err, "ping redis %v", client.addr)
+	}
+
+	stageStore = NewRedisStageStore(func(store *redisStageStore) {
+		store.client, store.conf = client, conf
+	})
+	logger.Tf(ctx, "Redis: Use shared stages, addr=%v, db=%v, password=%vB", client.addr, client.db, len(client.password))
+	return nil
+}
+
+// The redisError is the error reply of Redis.
+type redisError string
+
+func (v redisError) Error() string {
+	return string(v)
+}
+
+// The redisClient is a simple Redis client in RESP protocol, see https://redis.io/docs/reference/protocol-spec/
+type redisClient struct {
+	// The address, for example, 127.0.0.1:6379
+	addr string
+	// The password, empty for no AUTH.
+	password string
+	// The database.
+	db int
+	// The idle connections.
+	conns chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisClient(opts ...func(client *redisClient) error) (*redisClient, error) {
+	v := &redisClient{conns: make(chan *redisConn, 16)}
+	for _, opt := range opts {
+		if err := opt(v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Parse the address, host:port, or redis://:password@host:port/db
+func (v *redisClient) parse(addr string) error {
+	if !strings.Contains(addr, "://") {
+		v.addr = addr
+		return nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", addr)
+	}
+
+	v.addr = u.Host
+	if !strings.Contains(v.addr, ":") {
+		v.addr = fmt.Sprintf("%v:6379", v.addr)
+	}
+	if u.User != nil {
+		v.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if v.db, err = strconv.Atoi(db); err != nil {
+			return errors.Wrapf(err, "parse db %v", db)
+		}
+	}
+	return nil
+}
+
+// Get an idle connection, or dial a new one.
+func (v *redisClient) connect(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-v.conns:
+		return conn, nil
+	default:
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", v.addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial %v", v.addr)
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if v.password != "" {
+		if _, err := v.do(ctx, c, "AUTH", v.password); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "auth")
+		}
+	}
+	if v.db != 0 {
+		if _, err := v.do(ctx, c, "SELECT", strconv.Itoa(v.db)); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "select %v", v.db)
+		}
+	}
+	return c, nil
+}
+
+// Do the command, the reply is string, int64, []interface{}, or nil.
+func (v *redisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := v.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := v.do(ctx, conn, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.conn.Close()
+		return nil, errors.Wrapf(err, "redis %v", args[0])
+	}
+
+	// Reuse the connection, or close it if too many idle connections.
+	select {
+	case v.conns <- conn:
+	default:
+		conn.conn.Close()
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "redis %v", args[0])
+	}
+	return reply, nil
+}
+
+func (v *redisClient) do(ctx context.Context, conn *redisConn, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(3 * time.Second)
+	}
+	if err := conn.conn.SetDeadline(deadline); err != nil {
+		return nil, errors.Wrapf(err, "set deadline")
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("*%v\r\n", len(args)))
+	for _, arg := range args {
+		sb.WriteString(fmt.Sprintf("$%v\r\n%v\r\n", len(arg), arg))
+	}
+	if _, err := io.WriteString(conn.conn, sb.String()); err != nil {
+		return nil, errors.Wrapf(err, "write")
+	}
+
+	return readRedisReply(conn.reader)
+}
+
+// Read the reply in RESP, the error reply is returned as redisError.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, errors.Wrapf(err, "read")
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		iv, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse integer %v", line)
+		}
+		return iv, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse bulk %v", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, errors.Wrapf(err, "read bulk")
+		}
+		return string(b[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse array %v", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		// Read all elements, even some is error, to keep the protocol in sync.
+		var first error
+		elems := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			elem, err := readRedisReply(reader)
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			} else if err != nil && first == nil {
+				first = err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, first
+	default:
+		return nil, errors.Errorf("invalid reply %v", line)
+	}
+}
+
+// The redisStageRecord is the shared state of stage, for any replica to serve the stage.
+type redisStageRecord struct {
+	SID    string `json:"sid"`
+	Token  string `json:"token"`
+	Tenant string `json:"tenant"`
+	// The principal, nil for anonymous.
+	Subject *string  `json:"subject,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	// The state of turns, to continue the chat on any replica.
+	PreviousUser      string      `json:"previousUser"`
+	PreviousAssistant string      `json:"previousAssistant"`
+	PreviousAsrText   string      `json:"previousAsrText"`
+	Histories         [][2]string `json:"histories,omitempty"`
+	Summary           string      `json:"summary,omitempty"`
+}
+
+// The redisSegmentRecord is the shared state of answer segment.
+type redisSegmentRecord struct {
+	RID   string `json:"rid"`
+	ASID  string `json:"asid"`
+	Text  string `json:"text"`
+	Robot string `json:"robot,omitempty"`
+	Dummy bool   `json:"dummy,omitempty"`
+	First bool   `json:"first,omitempty"`
+	Ready bool   `json:"ready,omitempty"`
+	Err   string `json:"err,omitempty"`
+	// The TTS audio in shared storage.
+	Key string `json:"key,omitempty"`
+	Ext string `json:"ext,omitempty"`
+	// The order of segments, the created time in nanoseconds.
+	Seq int64 `json:"seq"`
+}
+
+// The redisStageStore stores the stages, the segments index and the generating state in Redis, the
+// keys expire with the stage.
+type redisStageStore struct {
+	client *redisClient
+	// The config for the loaded stages.
+	conf *Config
+}
+
+func NewRedisStageStore(opts ...func(store *redisStageStore)) *redisStageStore {
+	v := &redisStageStore{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *redisStageStore) stageKey(sid string) string {
+	return fmt.Sprintf("ait:stage:%v", sid)
+}
+
+func (v *redisStageStore) segmentsKey(sid string) string {
+	return fmt.Sprintf("ait:stage:%v:segments", sid)
+}
+
+func (v *redisStageStore) generatingKey(sid string) string {
+	return fmt.Sprintf("ait:stage:%v:generating", sid)
+}
+
+// The TTL of keys in seconds, expire with the stage, and the extra for segments which are removed
+// in 300s after TTS.
+func (v *redisStageStore) ttl(stage *Stage, extra time.Duration) string {
+	ttl := time.Until(stage.ExpireAt()) + extra
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return strconv.Itoa(int(ttl / time.Second))
+}
+
+// Save the stage and the state of turns.
+func (v *redisStageStore) SaveStage(ctx context.Context, stage *Stage) error {
+	if v == nil {
+		return nil
+	}
+
+	r0 := &redisStageRecord{SID: stage.sid, Token: stage.token, Tenant: stage.tenant.id}
+	if stage.principal != nil {
+		r0.Subject, r0.Groups = &stage.principal.subject, stage.principal.groups
+	}
+	r0.PreviousUser, r0.PreviousAssistant, r0.PreviousAsrText, r0.Histories = stage.TurnState()
+	r0.Summary = stage.summary.Summary()
+
+	b, err := json.Marshal(r0)
+	if err != nil {
+		return errors.Wrapf(err, "marshal")
+	}
+
+	if _, err := v.client.Do(ctx, "SET", v.stageKey(stage.sid), string(b), "EX", v.ttl(stage, 0)); err != nil {
+		return errors.Wrapf(err, "save stage %v", stage.sid)
+	}
+	return nil
+}
+
+func (v *redisStageStore) loadRecord(ctx context.Context, sid string) (*redisStageRecord, error) {
+	reply, err := v.client.Do(ctx, "GET", v.stageKey(sid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load stage %v", sid)
+	}
+	if reply == nil {
+		return nil, nil
+	}
+
+	var r0 redisStageRecord
+	if err := json.Unmarshal([]byte(reply.(string)), &r0); err != nil {
+		return nil, errors.Wrapf(err, "parse %v", reply)
+	}
+	return &r0, nil
+}
+
+// Load the stage created by other replica, nil if not exists.
+func (v *redisStageStore) LoadStage(ctx context.Context, sid string) (*Stage, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	r0, err := v.loadRecord(ctx, sid)
+	if err != nil || r0 == nil {
+		return nil, err
+	}
+
+	tenant := tenantByID(r0.Tenant)
+	if tenant == nil {
+		return nil, errors.Errorf("no tenant %v for stage %v", r0.Tenant, sid)
+	}
+
+	stage := NewStage(func(stage *Stage) {
+		stage.sid, stage.token, stage.tenant, stage.conf = r0.SID, r0.Token, tenant, v.conf
+		if r0.Subject != nil {
+			stage.principal = &Principal{subject: *r0.Subject, groups: r0.Groups}
+		}
+		stage.loggingCtx = withLogFields(logger.WithContext(ctx), "sid", r0.SID)
+	})
+	stage.SetTurnState(r0.PreviousUser, r0.PreviousAssistant, r0.PreviousAsrText, r0.Histories)
+	stage.summary.SetSummary(r0.Summary)
+	return stage, nil
+}
+
+// Load the state of turns, which might be updated by other replica.
+func (v *redisStageStore) LoadTurn(ctx context.Context, stage *Stage) error {
+	if v == nil {
+		return nil
+	}
+
+	r0, err := v.loadRecord(ctx, stage.sid)
+	if err != nil || r0 == nil {
+		return err
+	}
+
+	stage.SetTurnState(r0.PreviousUser, r0.PreviousAssistant, r0.PreviousAsrText, r0.Histories)
+	stage.summary.SetSummary(r0.Summary)
+	return nil
+}
+
+// Keep alive the stage, refresh the TTL of keys.
+func (v *redisStageStore) Touch(ctx context.Context, stage *Stage) error {
+	if v == nil {
+		return nil
+	}
+
+	if _, err := v.client.Do(ctx, "EXPIRE", v.stageKey(stage.sid), v.ttl(stage, 0)); err != nil {
+		return errors.Wrapf(err, "touch %v", stage.sid)
+	}
+	if _, err := v.client.Do(ctx, "EXPIRE", v.segmentsKey(stage.sid), v.ttl(stage, 300*time.Second)); err != nil {
+		return errors.Wrapf(err, "touch segments %v", stage.sid)
+	}
+	return nil
+}
+
+// Whether the stage is alive, which might be kept alive by other replica.
+func (v *redisStageStore) Alive(ctx context.Context, sid string) bool {
+	if v == nil {
+		return false
+	}
+
+	reply, err := v.client.Do(ctx, "EXISTS", v.stageKey(sid))
+	if err != nil {
+		logger.Wf(ctx, "Redis: Check stage %v failed, err %v", sid, err)
+		return false
+	}
+	return reply == int64(1)
+}
+
+func (v *redisStageStore) SetGenerating(ctx context.Context, stage *Stage, generating bool) error {
+	if v == nil {
+		return nil
+	}
+
+	var err error
+	if generating {
+		_, err = v.client.Do(ctx, "SET", v.generatingKey(stage.sid), "1", "EX", v.ttl(stage, 0))
+	} else {
+		_, err = v.client.Do(ctx, "DEL", v.generatingKey(stage.sid))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "generating %v", stage.sid)
+	}
+	return nil
+}
+
+func (v *redisStageStore) Generating(ctx context.Context, sid string) bool {
+	if v == nil {
+		return false
+	}
+
+	reply, err := v.client.Do(ctx, "EXISTS", v.generatingKey(sid))
+	if err != nil {
+		logger.Wf(ctx, "Redis: Check generating %v failed, err %v", sid, err)
+		return false
+	}
+	return reply == int64(1)
+}
+
+// Save the segment in index, with the TTS audio if ready.
+func (v *redisStageStore) SaveSegment(ctx context.Context, stage *Stage, segment *AnswerSegment) error {
+	if v == nil {
+		return nil
+	}
+
+	r0 := &redisSegmentRecord{
+		RID: segment.rid, ASID: segment.asid, Text: segment.text, Dummy: segment.dummy, First: segment.first,
+		Seq: segment.created.UnixNano(),
+	}
+	if segment.robot != nil {
+		r0.Robot = segment.robot.uuid
+	}
+	if tts := segment.TTS(); tts != nil {
+		r0.Ready, r0.Key, r0.Ext = true, tts.key, tts.ext
+	}
+	if err := segment.Err(); err != nil {
+		r0.Err = err.Error()
+	}
+
+	b, err := json.Marshal(r0)
+	if err != nil {
+		return errors.Wrapf(err, "marshal")
+	}
+
+	key := v.segmentsKey(stage.sid)
+	if _, err := v.client.Do(ctx, "HSET", key, segment.asid, string(b)); err != nil {
+		return errors.Wrapf(err, "save segment %v", segment.asid)
+	}
+	if _, err := v.client.Do(ctx, "EXPIRE", key, v.ttl(stage, 300*time.Second)); err != nil {
+		return errors.Wrapf(err, "expire %v", key)
+	}
+	return nil
+}
+
+func (v *redisStageStore) RemoveSegment(ctx context.Context, sid, asid string) error {
+	if v == nil {
+		return nil
+	}
+
+	if _, err := v.client.Do(ctx, "HDEL", v.segmentsKey(sid), asid); err != nil {
+		return errors.Wrapf(err, "remove segment %v", asid)
+	}
+	return nil
+}
+
+// Build the segment from record, the TTS audio is in shared storage.
+func (v *redisStageStore) buildSegment(stage *Stage, r0 *redisSegmentRecord) *AnswerSegment {
+	segment := NewAnswerSegment(func(segment *AnswerSegment) {
+		segment.rid, segment.asid, segment.text = r0.RID, r0.ASID, r0.Text
+		segment.dummy, segment.first, segment.remote = r0.Dummy, r0.First, true
+		segment.robot = stage.tenant.GetRobot(r0.Robot)
+	})
+
+	if r0.Ready {
+		segment.Finish(NewAudioBuffer(withAudioConfig(stage.conf), func(buffer *AudioBuffer) {
+			buffer.ext, buffer.key, buffer.stored = r0.Ext, r0.Key, true
+		}), nil)
+	} else if r0.Err != "" {
+		segment.Finish(nil, errors.New(r0.Err))
+	}
+	return segment
+}
+
+// Query the segment of request, nil if not exists.
+func (v *redisStageStore) QuerySegment(ctx context.Context, stage *Stage, rid, asid string) (*AnswerSegment, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	reply, err := v.client.Do(ctx, "HGET", v.segmentsKey(stage.sid), asid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query segment %v", asid)
+	}
+	if reply == nil {
+		return nil, nil
+	}
+
+	var r0 redisSegmentRecord
+	if err := json.Unmarshal([]byte(reply.(string)), &r0); err != nil {
+		return nil, errors.Wrapf(err, "parse %v", reply)
+	}
+	if r0.RID != rid {
+		return nil, nil
+	}
+	return v.buildSegment(stage, &r0), nil
+}
+
+// Query the first segment of request, nil if not exists.
+func (v *redisStageStore) FirstSegment(ctx context.Context, stage *Stage, rid string) (*AnswerSegment, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	reply, err := v.client.Do(ctx, "HGETALL", v.segmentsKey(stage.sid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "query segments %v", stage.sid)
+	}
+
+	// The reply is field and value in pairs.
+	elems, _ := reply.([]interface{})
+	var records []*redisSegmentRecord
+	for i := 1; i < len(elems); i += 2 {
+		var r0 redisSegmentRecord
+		if err := json.Unmarshal([]byte(elems[i].(string)), &r0); err != nil {
+			return nil, errors.Wrapf(err, "parse %v", elems[i])
+		}
+		if r0.RID == rid {
+			records = append(records, &r0)
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	return v.buildSegment(stage, records[0]), nil
+}
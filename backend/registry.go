@@ -0,0 +1,286 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The stageEntry is a stage in the registry, which is indexed by map, ordered by LRU list for eviction,
+// and ordered by expiry heap for the expiry scheduler.
+type stageEntry struct {
+	stage *Stage
+	// The element in LRU list, the front is the most recently used.
+	element *list.Element
+	// The index in expiry heap.
+	index int
+	// The time to check whether expired, the stage might be kept alive after this.
+	expireAt time.Time
+}
+
+// The stageHeap is a min heap of stages by expireAt, see container/heap.
+type stageHeap []*stageEntry
+
+func (v stageHeap) Len() int {
+	return len(v)
+}
+
+func (v stageHeap) Less(i, j int) bool {
+	return v[i].expireAt.Before(v[j].expireAt)
+}
+
+func (v stageHeap) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+	v[i].index, v[j].index = i, j
+}
+
+func (v *stageHeap) Push(x interface{}) {
+	entry := x.(*stageEntry)
+	entry.index = len(*v)
+	*v = append(*v, entry)
+}
+
+func (v *stageHeap) Pop() interface{} {
+	old := *v
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*v = old[:len(old)-1]
+	return entry
+}
+
+// The StageRegistry manages the live stages, lookup by sid in constant time, expire the stages by one
+// scheduler, and evict the least recently used stage if exceed the max stages.
+type StageRegistry struct {
+	// The max live stages, 0 for unlimited.
+	maxStages int
+
+	// The stages, map sid to entry.
+	stages map[string]*stageEntry
+	// The LRU list of entries.
+	lru *list.List
+	// The expiry heap of entries.
+	expiry stageHeap
+	// Signal the scheduler to check the expiry heap, when the earliest stage changed.
+	wakeup chan bool
+	// The goroutines to cleanup the removed stages.
+	cleanups sync.WaitGroup
+
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+func NewStageRegistry(opts ...func(registry *StageRegistry)) *StageRegistry {
+	v := &StageRegistry{
+		stages: make(map[string]*stageEntry),
+		lru:    list.New(),
+		wakeup: make(chan bool, 1),
+	}
+
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// The overloadError is an error when exceed the max live stages and all stages are busy, which response
+// with HTTP 503.
+type overloadError struct {
+	msg string
+}
+
+func newOverloadError(format string, a ...interface{}) error {
+	return errors.WithStack(&overloadError{msg: fmt.Sprintf(format, a...)})
+}
+
+func (v *overloadError) Error() string {
+	return v.msg
+}
+
+func (v *overloadError) Status() int {
+	return http.StatusServiceUnavailable
+}
+
+// Add the stage, evict the least recently used stage if exceed the max stages. The busy stages in a turn
+// are never evicted, and fail if all stages are busy.
+func (v *StageRegistry) Add(stage *Stage) error {
+	var evicted *Stage
+	if err := func() error {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if v.maxStages > 0 && len(v.stages) >= v.maxStages {
+			for element := v.lru.Back(); element != nil; element = element.Prev() {
+				if candidate := element.Value.(*stageEntry).stage; !candidate.Busy() {
+					evicted = candidate
+					break
+				}
+			}
+			if evicted == nil {
+				return newOverloadError("exceed max live stages %v, all are busy", v.maxStages)
+			}
+			v.remove(evicted)
+		}
+
+		entry := &stageEntry{stage: stage, expireAt: stage.ExpireAt()}
+		entry.element = v.lru.PushFront(entry)
+		heap.Push(&v.expiry, entry)
+		v.stages[stage.sid] = entry
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	if evicted != nil {
+		v.cleanup(evicted, "evicted")
+	}
+
+	select {
+	case v.wakeup <- true:
+	default:
+	}
+	return nil
+}
+
+func (v *StageRegistry) remove(stage *Stage) {
+	entry, ok := v.stages[stage.sid]
+	if !ok || entry.stage != stage {
+		return
+	}
+
+	delete(v.stages, stage.sid)
+	v.lru.Remove(entry.element)
+	if entry.index >= 0 {
+		heap.Remove(&v.expiry, entry.index)
+	}
+}
+
+// Query the stage by sid, which is marked as the most recently used.
+func (v *StageRegistry) Query(sid string) *Stage {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if entry, ok := v.stages[sid]; ok {
+		v.lru.MoveToFront(entry.element)
+		return entry.stage
+	}
+	return nil
+}
+
+func (v *StageRegistry) Count() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return len(v.stages)
+}
+
+// Get all the stages.
+func (v *StageRegistry) Stages() []*Stage {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	stages := make([]*Stage, 0, len(v.stages))
+	for _, entry := range v.stages {
+		stages = append(stages, entry.stage)
+	}
+	return stages
+}
+
+// Run the expiry scheduler, which sleeps until the earliest stage to check, until ctx is done.
+func (v *StageRegistry) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		var expired []*Stage
+		wait := time.Duration(-1)
+		func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			now := time.Now()
+			for len(v.expiry) > 0 {
+				entry := v.expiry[0]
+				if entry.expireAt.After(now) {
+					wait = entry.expireAt.Sub(now)
+					return
+				}
+
+				// The stage is kept alive, check it again later.
+				if !entry.stage.Expired() {
+					entry.expireAt = entry.stage.ExpireAt()
+					heap.Fix(&v.expiry, 0)
+					continue
+				}
+
+				expired = append(expired, entry.stage)
+				v.remove(entry.stage)
+			}
+		}()
+
+		for _, stage := range expired {
+			v.cleanup(stage, "expired")
+		}
+
+		// Never sleep too long, because the timeout of stage might be changed.
+		if wait < 0 || wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-v.wakeup:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Cleanup the removed stage in a goroutine, because it waits for the TTS worker.
+func (v *StageRegistry) cleanup(stage *Stage, reason string) {
+	ctx := stage.loggingCtx
+	logger.Tf(ctx, "Stage: Remove %v for %v, update=%v", stage.sid, reason, stage.LastUpdate().Format(time.RFC3339))
+
+	usageAccount.RemoveStage(stage.sid)
+
+	v.cleanups.Add(1)
+	go func() {
+		defer v.cleanups.Done()
+
+		// Close the stage to wait for the TTS, then remove files, or the TTS audio written after leaks.
+		if err := stage.Close(); err != nil {
+			logger.Wf(ctx, "Stage: Close %v failed, err %v", stage.sid, err)
+		}
+		stage.RemoveFiles(ctx)
+		stage.tenant.ReleaseStage()
+	}()
+}
+
+// Close all stages and wait for the cleanups, and remove the files of stages.
+func (v *StageRegistry) Close(ctx context.Context) int {
+	var stages []*Stage
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		for _, entry := range v.stages {
+			stages = append(stages, entry.stage)
+		}
+		v.stages = make(map[string]*stageEntry)
+		v.lru.Init()
+		v.expiry = nil
+	}()
+
+	for _, stage := range stages {
+		if err := stage.Close(); err != nil {
+			logger.Wf(ctx, "Shutdown: Close stage %v failed, err %v", stage.sid, err)
+		}
+		stage.RemoveFiles(ctx)
+		stage.tenant.ReleaseStage()
+	}
+
+	v.cleanups.Wait()
+	return len(stages)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Setup the globals for the stages of registry, which are removed in a temporary storage. Only the
+// error logs are printed, to never flood the benchmarks.
+func setupRegistryTest(tb testing.TB) *Config {
+	conf := &Config{StageTimeout: 300 * time.Second, LogLevel: "error", LogFormat: "text"}
+	if err := loggingInit(context.Background(), conf); err != nil {
+		tb.Fatalf("logging, err %v", err)
+	}
+	prices, err := NewPriceTable(func(key string) string { return "" })
+	if err != nil {
+		tb.Fatalf("prices, err %v", err)
+	}
+	usageAccount = NewUsageAccount(prices)
+	audioStorage = NewLocalStorage(func(storage *localStorage) {
+		storage.dir = tb.TempDir()
+	})
+	return conf
+}
+
+// Create a stage, which is updated at the update time.
+func newRegistryTestStage(conf *Config, tenant *Tenant, update time.Time) *Stage {
+	return NewStage(func(stage *Stage) {
+		stage.loggingCtx = context.Background()
+		stage.tenant, stage.conf = tenant, conf
+		stage.update = update
+	})
+}
+
+func TestStageRegistryExpiryOrder(t *testing.T) {
+	conf := setupRegistryTest(t)
+	registry := NewStageRegistry()
+	tenant := &Tenant{id: "default"}
+
+	// Add the stages in random order, the heap should pop them by expiry.
+	now := time.Now()
+	for _, i := range rand.Perm(100) {
+		if err := registry.Add(newRegistryTestStage(conf, tenant, now.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatalf("add stage %v, err %v", i, err)
+		}
+	}
+
+	var previous time.Time
+	for registry.expiry.Len() > 0 {
+		entry := heap.Pop(&registry.expiry).(*stageEntry)
+		if entry.expireAt.Before(previous) {
+			t.Fatalf("expire at %v before %v", entry.expireAt, previous)
+		}
+		previous = entry.expireAt
+	}
+}
+
+func TestStageRegistryExpire(t *testing.T) {
+	conf := setupRegistryTest(t)
+	registry := NewStageRegistry()
+	tenant := &Tenant{id: "default", stages: 3}
+
+	now := time.Now()
+	expired := newRegistryTestStage(conf, tenant, now.Add(-time.Hour))
+	alive := newRegistryTestStage(conf, tenant, now)
+	// The stage which is kept alive after added, should be checked again later.
+	kept := newRegistryTestStage(conf, tenant, now.Add(-time.Hour))
+	for _, stage := range []*Stage{expired, alive, kept} {
+		if err := registry.Add(stage); err != nil {
+			t.Fatalf("add stage, err %v", err)
+		}
+	}
+	kept.KeepAlive()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		registry.Run(ctx)
+	}()
+
+	for deadline := time.Now().Add(3 * time.Second); registry.Count() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("stages %v, should be 2", registry.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	registry.cleanups.Wait()
+
+	if registry.Query(expired.sid) != nil {
+		t.Fatalf("stage %v should be expired", expired.sid)
+	}
+	if registry.Query(alive.sid) == nil || registry.Query(kept.sid) == nil {
+		t.Fatalf("stages %v and %v should be alive", alive.sid, kept.sid)
+	}
+	if registry.expiry[0].stage != alive || !registry.expiry[0].expireAt.Equal(alive.ExpireAt()) {
+		t.Fatalf("the earliest stage should be %v", alive.sid)
+	}
+	if tenant.stages != 2 {
+		t.Fatalf("tenant stages %v, should be 2", tenant.stages)
+	}
+}
+
+func TestStageRegistryEvictLRU(t *testing.T) {
+	conf := setupRegistryTest(t)
+	registry := NewStageRegistry(func(registry *StageRegistry) {
+		registry.maxStages = 3
+	})
+	tenant := &Tenant{id: "default", stages: 4}
+
+	var stages []*Stage
+	for i := 0; i < 3; i++ {
+		stage := newRegistryTestStage(conf, tenant, time.Now())
+		if err := registry.Add(stage); err != nil {
+			t.Fatalf("add stage %v, err %v", i, err)
+		}
+		stages = append(stages, stage)
+	}
+
+	// The first stage is used, so the second is the least recently used.
+	registry.Query(stages[0].sid)
+	if err := registry.Add(newRegistryTestStage(conf, tenant, time.Now())); err != nil {
+		t.Fatalf("add stage, err %v", err)
+	}
+	registry.cleanups.Wait()
+
+	if registry.Count() != 3 {
+		t.Fatalf("stages %v, should be 3", registry.Count())
+	}
+	if registry.Query(stages[1].sid) != nil {
+		t.Fatalf("stage %v should be evicted", stages[1].sid)
+	}
+	if registry.Query(stages[0].sid) == nil || registry.Query(stages[2].sid) == nil {
+		t.Fatalf("stages %v and %v should not be evicted", stages[0].sid, stages[2].sid)
+	}
+	if tenant.stages != 3 {
+		t.Fatalf("tenant stages %v, should be 3", tenant.stages)
+	}
+}
+
+func TestStageRegistryEvictBusy(t *testing.T) {
+	conf := setupRegistryTest(t)
+	registry := NewStageRegistry(func(registry *StageRegistry) {
+		registry.maxStages = 2
+	})
+	tenant := &Tenant{id: "default", stages: 4}
+
+	busy := newRegistryTestStage(conf, tenant, time.Now())
+	idle := newRegistryTestStage(conf, tenant, time.Now())
+	for _, stage := range []*Stage{busy, idle} {
+		if err := registry.Add(stage); err != nil {
+			t.Fatalf("add stage, err %v", err)
+		}
+	}
+
+	// The busy stage is the least recently used, but never evicted.
+	busy.SetGenerating(true)
+	if err := registry.Add(newRegistryTestStage(conf, tenant, time.Now())); err != nil {
+		t.Fatalf("add stage, err %v", err)
+	}
+	registry.cleanups.Wait()
+	if registry.Query(busy.sid) == nil || registry.Query(idle.sid) != nil {
+		t.Fatalf("stage %v should be evicted rather than %v", idle.sid, busy.sid)
+	}
+
+	// Fail if all stages are busy.
+	for _, stage := range registry.Stages() {
+		stage.SetGenerating(true)
+	}
+	err := registry.Add(newRegistryTestStage(conf, tenant, time.Now()))
+	if err == nil {
+		t.Fatalf("add stage should fail when all stages are busy")
+	}
+	if status := httpErrorStatus(err); status != http.StatusServiceUnavailable {
+		t.Fatalf("status %v, should be %v", status, http.StatusServiceUnavailable)
+	}
+}
+
+// The stages of benchmarks, to show the lookup and add is constant time.
+var registryBenchmarkStages = []int{1000, 10000, 50000}
+
+// Create a registry with n stages, which are unlimited and never expire during benchmark.
+func newRegistryBenchmark(b *testing.B, n int) (*StageRegistry, []*Stage) {
+	conf := setupRegistryTest(b)
+	registry := NewStageRegistry()
+	tenant := &Tenant{id: "default"}
+
+	stages := make([]*Stage, n)
+	for i := range stages {
+		stages[i] = newRegistryTestStage(conf, tenant, time.Now())
+		if err := registry.Add(stages[i]); err != nil {
+			b.Fatalf("add stage %v, err %v", i, err)
+		}
+	}
+	return registry, stages
+}
+
+func BenchmarkStageRegistryQuery(b *testing.B) {
+	for _, n := range registryBenchmarkStages {
+		b.Run(fmt.Sprintf("stages=%v", n), func(b *testing.B) {
+			registry, stages := newRegistryBenchmark(b, n)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if registry.Query(stages[i%n].sid) == nil {
+					b.Fatalf("no stage %v", stages[i%n].sid)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStageRegistryAdd(b *testing.B) {
+	for _, n := range registryBenchmarkStages {
+		b.Run(fmt.Sprintf("stages=%v", n), func(b *testing.B) {
+			// Limit the max stages to n, so that each add evicts the least recently used stage.
+			registry, existing := newRegistryBenchmark(b, n)
+			registry.maxStages = n
+			tenant := &Tenant{id: "default"}
+
+			stages := make([]*Stage, b.N)
+			for i := range stages {
+				stages[i] = newRegistryTestStage(existing[0].conf, tenant, time.Now())
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := registry.Add(stages[i]); err != nil {
+					b.Fatalf("add stage %v, err %v", i, err)
+				}
+			}
+
+			b.StopTimer()
+			registry.cleanups.Wait()
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The fakeTTSService writes the text as audio, after a random delay like the TTS of providers.
+type fakeTTSService struct{}
+
+func (v *fakeTTSService) RequestTTS(ctx context.Context, buildOutput func(ext string) io.Writer, text, voice string) error {
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	_, err := buildOutput("aac").Write([]byte(fmt.Sprintf("audio of %v", text)))
+	return err
+}
+
+// Setup the globals for the stage, the audio always spills to the temporary work dir, and is stored in
+// the temporary storage, so that all the files should be removed.
+func setupStageTest(t *testing.T) (*Config, string) {
+	conf := setupRegistryTest(t)
+	workDir = t.TempDir()
+
+	dir := t.TempDir()
+	audioStorage = NewLocalStorage(func(storage *localStorage) {
+		storage.dir = dir
+	})
+	return conf, dir
+}
+
+// Get the files in dir, recursively.
+func stageTestFiles(t *testing.T, dir string) []string {
+	var files []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("walk %v, err %v", dir, err)
+	}
+	return files
+}
+
+// Run the turns of stage, the upload, chat and TTS, query and remove run concurrently like the handlers,
+// while the expiry scheduler and other handlers check the stage.
+func TestStageConcurrentTurns(t *testing.T) {
+	conf, dir := setupStageTest(t)
+	tenant := &Tenant{id: "default", ttsService: &fakeTTSService{}, stages: 3}
+	robot := &Robot{uuid: "default", chatModel: "gpt-4"}
+
+	stage := newRegistryTestStage(conf, tenant, time.Now())
+	registry := NewStageRegistry()
+	if err := registry.Add(stage); err != nil {
+		t.Fatalf("add stage, err %v", err)
+	}
+
+	// The expired stages are removed by scheduler, while the turns of stage are running.
+	for i := 0; i < 2; i++ {
+		if err := registry.Add(newRegistryTestStage(conf, tenant, time.Now().Add(-time.Hour))); err != nil {
+			t.Fatalf("add stage, err %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		registry.Run(ctx)
+	}()
+
+	// Check the stage like the expiry scheduler and other handlers.
+	go func() {
+		defer background.Done()
+		for ctx.Err() == nil {
+			stage.KeepAlive()
+			stage.Expired()
+			stage.Busy()
+			stage.TurnState()
+			registry.Query(stage.sid)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const turns, sentences = 5, 5
+	for turn := 0; turn < turns; turn++ {
+		rid := fmt.Sprintf("rid-%v", turn)
+
+		// Upload the question, insert the dummy sentence, then chat in goroutine.
+		stage.OnUploadAudio()
+		stage.OnExtractAudio()
+		stage.OnASR(fmt.Sprintf("question %v", turn), time.Second)
+		stage.ttsWorker.SubmitSegment(ctx, stage, NewAnswerSegment(func(segment *AnswerSegment) {
+			segment.rid = rid
+			segment.dummy = true
+		}))
+		stage.SetGenerating(true)
+
+		var chat sync.WaitGroup
+		chat.Add(1)
+		go func() {
+			defer chat.Done()
+			defer stage.SetGenerating(false)
+
+			stage.BeginChatTurn()
+			for i := 0; i < sentences; i++ {
+				text := fmt.Sprintf("sentence %v of turn %v.", i, turn)
+				if i == 0 {
+					stage.OnFirstChat(text)
+				}
+				stage.OnAssistantSentence(text)
+				stage.ttsWorker.SubmitSegment(ctx, stage, NewAnswerSegment(func(segment *AnswerSegment) {
+					segment.rid, segment.text, segment.robot, segment.first = rid, text, robot, i == 0
+				}))
+				time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			}
+		}()
+
+		// Another client polls the same segments, like the retry of query.
+		chat.Add(1)
+		go func() {
+			defer chat.Done()
+			for stage.Generating() {
+				if s := stage.ttsWorker.query(rid); s != nil {
+					stage.ttsWorker.QuerySegment(ctx, stage, rid, s.asid)
+					s.Processing()
+					s.TTS()
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		// Query, download and remove the sentences in order.
+		var texts []string
+		for {
+			segment := stage.ttsWorker.QueryAnyReadySegment(ctx, stage, rid)
+			if segment == nil {
+				break
+			}
+			if err := segment.Err(); err != nil {
+				t.Fatalf("segment %v, err %v", segment.asid, err)
+			}
+
+			reader, err := segment.TTS().Open(ctx)
+			if err != nil {
+				t.Fatalf("open %v, err %v", segment.asid, err)
+			}
+			b, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("read %v, err %v", segment.asid, err)
+			}
+			if string(b) != fmt.Sprintf("audio of %v", segment.text) {
+				t.Fatalf("audio %v of %v", string(b), segment.text)
+			}
+			if segment.first {
+				stage.OnFirstDownload()
+			}
+			texts = append(texts, segment.text)
+
+			stage.ttsWorker.RemoveSegment(ctx, stage, segment.asid)
+			select {
+			case segment.removeSignal <- true:
+			default:
+			}
+		}
+		chat.Wait()
+
+		if len(texts) != sentences {
+			t.Fatalf("turn %v got %v sentences %v", turn, len(texts), texts)
+		}
+		for i, text := range texts {
+			if text != fmt.Sprintf("sentence %v of turn %v.", i, turn) {
+				t.Fatalf("turn %v sentence %v is %v", turn, i, text)
+			}
+		}
+	}
+
+	cancel()
+	background.Wait()
+	if err := stage.Close(); err != nil {
+		t.Fatalf("close, err %v", err)
+	}
+	registry.cleanups.Wait()
+
+	if registry.Count() != 1 {
+		t.Fatalf("stages %v, should be 1", registry.Count())
+	}
+	if files := stageTestFiles(t, dir); len(files) != 0 {
+		t.Fatalf("files %v should be removed", files)
+	}
+}
+
+// Close the stage when the TTS is in flight, the TTS audio should be removed with the stage.
+func TestStageCloseWhileTTS(t *testing.T) {
+	conf, dir := setupStageTest(t)
+	tenant := &Tenant{id: "default", ttsService: &fakeTTSService{}, stages: 1}
+	robot := &Robot{uuid: "default", chatModel: "gpt-4"}
+
+	stage := newRegistryTestStage(conf, tenant, time.Now().Add(-time.Hour))
+	registry := NewStageRegistry()
+	if err := registry.Add(stage); err != nil {
+		t.Fatalf("add stage, err %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Submit the sentences while the stage is expired and closed.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			stage.ttsWorker.SubmitSegment(ctx, stage, NewAnswerSegment(func(segment *AnswerSegment) {
+				segment.rid, segment.text, segment.robot = "rid", fmt.Sprintf("sentence %v.", i), robot
+			}))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// Cancel the ctx to quit the goroutines of segments, like the shutdown.
+	time.Sleep(5 * time.Millisecond)
+	go registry.Run(ctx)
+	for deadline := time.Now().Add(3 * time.Second); registry.Count() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("stage %v should be expired", stage.sid)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	wg.Wait()
+	registry.cleanups.Wait()
+
+	if files := stageTestFiles(t, dir); len(files) != 0 {
+		t.Fatalf("files %v should be removed", files)
+	}
+	if tenant.stages != 0 {
+		t.Fatalf("tenant stages %v, should be 0", tenant.stages)
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The storage for audio artifacts, such as the TTS and input audio.
+var audioStorage Storage
+
+// The Storage is where to store the audio artifacts, the local disk or S3 compatible object storage
+// such as MinIO, which is shared by the replicas behind a load balancer.
+type Storage interface {
+	// Put the object of key, the size is the bytes of reader.
+	Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error
+	// Get the object of key, the caller should close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Remove the object of key.
+	Remove(ctx context.Context, key string) error
+	// Remove all objects with prefix, for example, all files of a stage.
+	RemoveAll(ctx context.Context, prefix string) error
+	// Get the pre-signed URL to download the object, empty if not supported or disabled.
+	PresignURL(ctx context.Context, key string) (string, error)
+	// Whether shared by replicas, then we should always store the audio, never keep it in memory.
+	Shared() bool
+	// Remove the leftover objects of all stages, which are left when process crashed, return the number
+	// of removed stages. It's no-op for shared storage, because the stages might be alive on other
+	// replicas, please expire the objects by the lifecycle rule of bucket.
+	Sweep(ctx context.Context) (int, error)
+}
+
+// The detachedContext keeps the values of parent, such as the logging context, but never cancelled,
+// for example, to remove the files after the request is done.
+type detachedContext struct {
+	context.Context
+}
+
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (v detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (v detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (v detachedContext) Err() error {
+	return nil
+}
+
+// Initialize the storage by AIT_STORAGE, default to local disk.
+func storageInit(ctx context.Context, conf *Config) error {
+	switch provider := conf.Storage; provider {
+	case "", "local":
+		dir := conf.StorageDir
+		if dir == "" {
+			dir = workDir
+		}
+
+		audioStorage = NewLocalStorage(func(storage *localStorage) {
+			storage.dir = path.Join(dir, conf.StoragePrefix)
+			storage.quota = conf.StorageQuota
+		})
+		logger.Tf(ctx, "Storage: Use local dir=%v, prefix=%v, quota=%v",
+			dir, conf.StoragePrefix, conf.StorageQuota)
+	case "s3":
+		s3Storage, err := NewS3Storage(func(storage *s3Storage) error {
+			storage.endpoint = strings.TrimSuffix(conf.S3Endpoint, "/")
+			storage.region = conf.S3Region
+			storage.bucket = conf.S3Bucket
+			storage.accessKey = conf.S3AccessKey
+			storage.secretKey = conf.S3SecretKey
+			storage.prefix = conf.StoragePrefix
+			storage.pathStyle = conf.S3PathStyle
+			storage.presignExpires = conf.StoragePresign
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "s3")
+		}
+
+		audioStorage = s3Storage
+		logger.Tf(ctx, "Storage: Use s3 endpoint=%v, region=%v, bucket=%v, prefix=%v, pathStyle=%v, presign=%v",
+			s3Storage.endpoint, s3Storage.region, s3Storage.bucket, s3Storage.prefix, s3Storage.pathStyle,
+			s3Storage.presignExpires)
+	default:
+		return errors.Errorf("invalid AIT_STORAGE %v", provider)
+	}
+	return nil
+}
+
+// The localStorage stores the objects in local disk, the key is the relative path to dir.
+type localStorage struct {
+	// The directory to store files.
+	dir string
+	// The max bytes of files stored by this process, 0 for unlimited.
+	quota int64
+
+	// The bytes of files stored by this process.
+	used int64
+	// The size of files, to update the used bytes when remove.
+	sizes map[string]int64
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+func NewLocalStorage(opts ...func(storage *localStorage)) *localStorage {
+	v := &localStorage{sizes: make(map[string]int64)}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Get the file path of key, which must be in the dir.
+func (v *localStorage) filepath(key string) (string, error) {
+	file := filepath.Join(v.dir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(v.dir, file); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", errors.Errorf("invalid key %v", key)
+	}
+	return file, nil
+}
+
+func (v *localStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	file, err := v.filepath(key)
+	if err != nil {
+		return err
+	}
+
+	// Reserve the quota before writing, to avoid exceeding by concurrent writing.
+	if err := func() error {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if v.quota > 0 && v.used-v.sizes[key]+size > v.quota {
+			return errors.Errorf("exceed quota %v, used=%v, size=%v", v.quota, v.used, size)
+		}
+		v.used += size - v.sizes[key]
+		v.sizes[key] = size
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	if err := func() error {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return errors.Wrapf(err, "mkdir %v", filepath.Dir(file))
+		}
+
+		f, err := os.Create(file)
+		if err != nil {
+			return errors.Wrapf(err, "create %v", file)
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(f, reader); err != nil {
+			return errors.Wrapf(err, "write %v", file)
+		}
+		return nil
+	}(); err != nil {
+		v.release(key)
+		os.Remove(file)
+		return err
+	}
+	return nil
+}
+
+func (v *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := v.filepath(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+func (v *localStorage) Remove(ctx context.Context, key string) error {
+	file, err := v.filepath(key)
+	if err != nil {
+		return err
+	}
+
+	v.release(key)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %v", file)
+	}
+	return nil
+}
+
+func (v *localStorage) RemoveAll(ctx context.Context, prefix string) error {
+	dir, err := v.filepath(prefix)
+	if err != nil {
+		return err
+	}
+
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		for key, size := range v.sizes {
+			if strings.HasPrefix(key, prefix) {
+				v.used -= size
+				delete(v.sizes, key)
+			}
+		}
+	}()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "remove %v", dir)
+	}
+	return nil
+}
+
+// Release the quota of key.
+func (v *localStorage) release(key string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.used -= v.sizes[key]
+	delete(v.sizes, key)
+}
+
+func (v *localStorage) PresignURL(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+func (v *localStorage) Shared() bool {
+	return false
+}
+
+// Remove the directories of stages, which are named by the sid in UUID, the other files in dir, for
+// example, the work dir, are never removed.
+func (v *localStorage) Sweep(ctx context.Context) (int, error) {
+	entries, err := os.ReadDir(v.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "read dir %v", v.dir)
+	}
+
+	var nn int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if sid, err := uuid.Parse(entry.Name()); err != nil || sid.String() != entry.Name() {
+			continue
+		}
+
+		if err := v.RemoveAll(ctx, fmt.Sprintf("%v/", entry.Name())); err != nil {
+			return nn, errors.Wrapf(err, "sweep %v", entry.Name())
+		}
+		nn++
+	}
+	return nn, nil
+}
+
+// The s3Storage stores the objects in S3 compatible object storage, such as AWS S3 or MinIO, which
+// signs the requests by AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+type s3Storage struct {
+	// The endpoint, for example, http://127.0.0.1:9000 for MinIO, or https://s3.us-east-1.amazonaws.com
+	endpoint string
+	// The region, default to us-east-1.
+	region string
+	// The bucket.
+	bucket string
+	// The credentials.
+	accessKey, secretKey string
+	// The prefix of all keys.
+	prefix string
+	// Whether use path style URL, like endpoint/bucket/key, which is required by MinIO. Or use
+	// virtual hosted style URL, like bucket.endpoint/key.
+	pathStyle bool
+	// The expires of pre-signed URL, 0 to disable.
+	presignExpires time.Duration
+
+	// The HTTP client, with its own transport, so the requests of storage are never recorded or replayed
+	// by cassette, which replaces the default transport for providers.
+	client *http.Client
+
+	// The parsed endpoint.
+	endpointURL *url.URL
+}
+
+func NewS3Storage(opts ...func(storage *s3Storage) error) (*s3Storage, error) {
+	v := &s3Storage{}
+	for _, opt := range opts {
+		if err := opt(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.region == "" {
+		v.region = "us-east-1"
+	}
+	if v.client == nil {
+		// Note that the storage is initialized before cassette, so the default transport is not replaced.
+		v.client = &http.Client{Transport: http.DefaultTransport}
+		if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+			v.client.Transport = transport.Clone()
+		}
+	}
+	if v.endpoint == "" {
+		v.endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", v.region)
+	}
+	if v.bucket == "" {
+		return nil, errors.New("AIT_S3_BUCKET is required")
+	}
+	if v.accessKey == "" || v.secretKey == "" {
+		return nil, errors.New("AIT_S3_ACCESS_KEY and AIT_S3_SECRET_KEY are required")
+	}
+
+	var err error
+	if v.endpointURL, err = url.Parse(v.endpoint); err != nil {
+		return nil, errors.Wrapf(err, "parse endpoint %v", v.endpoint)
+	}
+	return v, nil
+}
+
+// Build the URL of key, the key is empty for bucket.
+func (v *s3Storage) buildURL(key string, query url.Values) *url.URL {
+	u := *v.endpointURL
+	if v.pathStyle {
+		u.Path = fmt.Sprintf("/%v/%v", v.bucket, key)
+	} else {
+		u.Host = fmt.Sprintf("%v.%v", v.bucket, u.Host)
+		u.Path = fmt.Sprintf("/%v", key)
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3EscapeQuery(query)
+	return &u
+}
+
+// Sign the request by AWS Signature Version 4 in header.
+func (v *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%v\nx-amz-content-sha256:%v\nx-amz-date:%v\n",
+		req.URL.Host, payloadHash, amzDate)
+	signature, credential := v.signature(req.Method, req.URL, canonicalHeaders, signedHeaders, payloadHash, now)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v, SignedHeaders=%v, Signature=%v",
+		credential, signedHeaders, signature))
+}
+
+// Build the signature and credential of request.
+func (v *s3Storage) signature(method string, u *url.URL, canonicalHeaders, signedHeaders, payloadHash string, now time.Time) (string, string) {
+	amzDate, day := now.UTC().Format("20060102T150405Z"), now.UTC().Format("20060102")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", day, v.region)
+
+	canonicalRequest := strings.Join([]string{
+		method, u.EscapedPath(), u.RawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, s3Hash([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+v.secretKey), day)
+	key = s3HMAC(key, v.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	return signature, fmt.Sprintf("%v/%v", v.accessKey, scope)
+}
+
+// Do the request, return the response if status is 2xx, or error with the body.
+func (v *s3Storage) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := v.buildURL(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request %v", u)
+	}
+	// Overwrite the URL, to keep the escaped path which is signed.
+	req.URL = u
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+
+	// The payload is not signed, which is allowed by S3, because the body might be large.
+	payloadHash := s3Hash(nil)
+	if body != nil {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	v.sign(req, payloadHash, time.Now())
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v %v", method, u)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return nil, errors.Errorf("%v %v status %v, body is %v", method, u, resp.StatusCode, string(b))
+	}
+	return resp, nil
+}
+
+func (v *s3Storage) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	resp, err := v.do(ctx, http.MethodPut, v.prefix+key, nil, reader, size, header)
+	if err != nil {
+		return errors.Wrapf(err, "put %v", key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (v *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := v.do(ctx, http.MethodGet, v.prefix+key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %v", key)
+	}
+	return resp.Body, nil
+}
+
+func (v *s3Storage) Remove(ctx context.Context, key string) error {
+	resp, err := v.do(ctx, http.MethodDelete, v.prefix+key, nil, nil, 0, nil)
+	if err != nil {
+		return errors.Wrapf(err, "remove %v", key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (v *s3Storage) RemoveAll(ctx context.Context, prefix string) error {
+	var keys []string
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {v.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := v.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return errors.Wrapf(err, "list %v", prefix)
+		}
+
+		var res struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "parse list %v", prefix)
+		}
+
+		for _, object := range res.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, v.prefix))
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+
+	for _, key := range keys {
+		if err := v.Remove(ctx, key); err != nil {
+			return errors.Wrapf(err, "remove all %v", prefix)
+		}
+	}
+	return nil
+}
+
+// Build the pre-signed URL by query parameters, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (v *s3Storage) PresignURL(ctx context.Context, key string) (string, error) {
+	if v.presignExpires <= 0 {
+		return "", nil
+	}
+	return v.presign(key, time.Now()), nil
+}
+
+// Build the pre-signed URL of key, which is signed at now.
+func (v *s3Storage) presign(key string, now time.Time) string {
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", now.UTC().Format("20060102"), v.region)
+	u := v.buildURL(v.prefix+key, url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {fmt.Sprintf("%v/%v", v.accessKey, scope)},
+		"X-Amz-Date":          {now.UTC().Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(v.presignExpires / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	})
+
+	signature, _ := v.signature(http.MethodGet, u, fmt.Sprintf("host:%v\n", u.Host), "host", "UNSIGNED-PAYLOAD", now)
+	u.RawQuery = fmt.Sprintf("%v&X-Amz-Signature=%v", u.RawQuery, signature)
+	return u.String()
+}
+
+func (v *s3Storage) Shared() bool {
+	return true
+}
+
+func (v *s3Storage) Sweep(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func s3Hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escape the string by AWS URI encoding, which only keeps the unreserved characters.
+func s3Escape(s string, keepSlash bool) string {
+	var sb bytes.Buffer
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// Escape the query, sorted by key, which is the canonical query string.
+func s3EscapeQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		for _, value := range query[k] {
+			params = append(params, fmt.Sprintf("%v=%v", s3Escape(k, false), s3Escape(value, false)))
+		}
+	}
+	return strings.Join(params, "&")
+}
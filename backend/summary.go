@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"strings"
+	"sync"
+)
+
+// The max pending pairs to summarize, the oldest pairs are dropped if exceed, for example, the summary
+// request always fails, to never grow the memory and the summary request without limit.
+const maxSummaryPendingPairs = 20
+
+// The ChatSummary is the rolling summary of the turns dropped from the chat history, so that a long
+// conversation never forgets the earlier topics, such as the name of user.
+type ChatSummary struct {
+	// The running summary.
+	summary string
+	// The dropped pairs which are not summarized yet, for example, the summary request failed.
+	pending [][2]openai.ChatCompletionMessage
+	// Whether is summarizing, we only allow one summarizing for each stage.
+	summarizing bool
+
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+func NewChatSummary() *ChatSummary {
+	return &ChatSummary{}
+}
+
+// Get the running summary.
+func (v *ChatSummary) Summary() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.summary
+}
+
+// Set the running summary, for example, the summary is loaded from other replica.
+func (v *ChatSummary) SetSummary(summary string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.summary = summary
+}
+
+// Build the system prompt with the running summary.
+func (v *ChatSummary) BuildSystemPrompt(system string) string {
+	if summary := v.Summary(); summary != "" {
+		return fmt.Sprintf("%v Here is the summary of earlier conversation: %v", system, summary)
+	}
+	return system
+}
+
+// Summarize the dropped pairs into the running summary, in a goroutine and never block the chat. The
+// model is AIT_SUMMARY_MODEL, or the chat model of robot if not set.
+func (v *ChatSummary) Summarize(
+	ctx context.Context, conf *Config, aiConfig openai.ClientConfig, stage *Stage, robot *Robot, rid string,
+	dropped [][2]openai.ChatCompletionMessage,
+) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.pending = append(v.pending, dropped...)
+	v.limitPending(ctx)
+	if v.summarizing || len(v.pending) == 0 {
+		return
+	}
+
+	previous, pending := v.summary, v.pending
+	v.pending, v.summarizing = nil, true
+
+	go func() {
+		summary, err := v.requestSummary(ctx, conf, aiConfig, stage, robot, rid, previous, pending)
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		v.summarizing = false
+		if err != nil {
+			// Retry the pending pairs in next turn.
+			v.pending = append(pending, v.pending...)
+			v.limitPending(ctx)
+			logger.Wf(ctx, "Summary: Ignore err %+v", err)
+			return
+		}
+
+		v.summary = summary
+		logger.Tf(ctx, "Summary: Update pairs=%v, summary is %v", len(pending), summary)
+	}()
+}
+
+// Drop the oldest pending pairs if exceed the max, the lock must be held.
+func (v *ChatSummary) limitPending(ctx context.Context) {
+	if n := len(v.pending) - maxSummaryPendingPairs; n > 0 {
+		v.pending = append([][2]openai.ChatCompletionMessage{}, v.pending[n:]...)
+		logger.Wf(ctx, "Summary: Drop %v oldest pairs, pending=%v", n, len(v.pending))
+	}
+}
+
+func (v *ChatSummary) requestSummary(
+	ctx context.Context, conf *Config, aiConfig openai.ClientConfig, stage *Stage, robot *Robot, rid string,
+	previous string, pairs [][2]openai.ChatCompletionMessage,
+) (string, error) {
+	model, maxTokens := conf.SummaryModel, conf.SummaryMaxTokens
+	if model == "" {
+		model = robot.chatModel
+	}
+
+	var sb strings.Builder
+	if previous != "" {
+		sb.WriteString(fmt.Sprintf("Existing summary: %v\n\n", previous))
+	}
+	sb.WriteString("New messages:\n")
+	for _, pair := range pairs {
+		sb.WriteString(fmt.Sprintf("User: %v\nAssistant: %v\n", pair[0].Content, pair[1].Content))
+	}
+
+	client := openai.NewClientWithConfig(aiConfig)
+	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "Merge the existing summary and the new messages " +
+				"between user and assistant into one concise summary in the language of the conversation. " +
+				"Keep the facts about the user, such as name and preferences, and the topics discussed. " +
+				"Only response the summary."},
+			{Role: openai.ChatMessageRoleUser, Content: sb.String()},
+		},
+		MaxTokens: maxTokens,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "summary by %v", model)
+	}
+
+	usageAccount.Record(ctx, stage, robot, rid, &Usage{
+		PromptTokens: resp.Usage.PromptTokens, CompletionTokens: resp.Usage.CompletionTokens, model: model,
+	})
+
+	if len(resp.Choices) == 0 {
+		return "", errors.Errorf("no summary by %v", model)
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
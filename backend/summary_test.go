@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// The pending pairs are limited when the summary always fails, and the newest pairs are kept.
+func TestChatSummaryLimitPending(t *testing.T) {
+	conf := &Config{StageTimeout: 300 * time.Second}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	aiConfig := openai.DefaultConfig("sk-test")
+	aiConfig.BaseURL = server.URL
+	tenant := &Tenant{id: "default"}
+	robot := &Robot{uuid: "default", chatModel: "gpt-4"}
+	stage := NewStage(func(stage *Stage) {
+		stage.loggingCtx, stage.tenant, stage.conf = context.Background(), tenant, conf
+	})
+	defer stage.Close()
+
+	summary := NewChatSummary()
+	for i := 0; i < maxSummaryPendingPairs*3; i++ {
+		summary.Summarize(context.Background(), conf, aiConfig, stage, robot, "rid", [][2]openai.ChatCompletionMessage{{
+			{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf("question %v", i)},
+			{Role: openai.ChatMessageRoleAssistant, Content: fmt.Sprintf("answer %v", i)},
+		}})
+
+		// Wait for the summary to fail.
+		for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(time.Millisecond) {
+			summary.lock.Lock()
+			summarizing, pending := summary.summarizing, len(summary.pending)
+			summary.lock.Unlock()
+
+			if pending > maxSummaryPendingPairs {
+				t.Fatalf("pending %v exceed %v", pending, maxSummaryPendingPairs)
+			}
+			if !summarizing {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("summary should fail")
+			}
+		}
+	}
+
+	if n := len(summary.pending); n != maxSummaryPendingPairs {
+		t.Fatalf("pending %v, should be %v", n, maxSummaryPendingPairs)
+	}
+	if s := summary.pending[maxSummaryPendingPairs-1][0].Content; s != fmt.Sprintf("question %v", maxSummaryPendingPairs*3-1) {
+		t.Fatalf("the newest pair is %v", s)
+	}
+	if summary.Summary() != "" {
+		t.Fatalf("summary %v should be empty", summary.Summary())
+	}
+}
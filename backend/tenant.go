@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/joho/godotenv"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default tenant, which is configured by the env of process.
+var defaultTenant *Tenant
+
+// The extra tenants, which is configured by the env files in AIT_TENANTS_DIR.
+var tenants []*Tenant
+
+// The env inherited by tenant from process, which are not secret and only the default settings.
+var tenantInheritEnvs = map[string]bool{
+	"OPENAI_PROXY": true, "AIT_SYSTEM_PROMPT": true, "AIT_CHAT_MODEL": true, "AIT_ASR_LANGUAGE": true,
+	"AIT_REPLY_PREFIX": true, "AIT_REPLY_LIMIT": true, "AIT_CHAT_WINDOW": true, "AIT_EMBEDDING_MODEL": true,
+	"AIT_KNOWLEDGE_CHUNK_SIZE": true, "AIT_KNOWLEDGE_TOP_K": true, "AIT_KNOWLEDGE_MIN_SCORE": true,
+	"AIT_ASR_PROVIDER": true, "WHISPER_CPP_BIN": true, "WHISPER_CPP_MODEL": true, "WHISPER_CPP_THREADS": true,
+	"WHISPER_CPP_SERVER": true, "AIT_TTS_PROVIDER": true, "PIPER_BIN": true, "PIPER_MODEL": true, "ESPEAK_BIN": true,
+	"ESPEAK_VOICE": true, "AIT_LOCAL_TTS_FORMAT": true, "AIT_CHAT_PROVIDER": true, "AIT_CHAT_OPTIONS": true,
+	"OLLAMA_HOST": true, "OLLAMA_KEEP_ALIVE": true,
+}
+
+// The Tenant is a group of robots with its own provider credentials, quotas and stats, for example,
+// a school, which is identified by host name or API token.
+type Tenant struct {
+	// The tenant id, default for the default tenant.
+	id string
+	// The host names of tenant.
+	hosts []string
+	// The robots of tenant.
+	robots []*Robot
+	// The API authentication of tenant.
+	auth *authConfig
+
+	// The OpenAI client configs.
+	asrAIConfig, chatAIConfig, ttsAIConfig, embeddingAIConfig openai.ClientConfig
+	// The Tencent speech config.
+	tencentAIConfig tencentConfig
+	// The local whisper.cpp config.
+	whisperAIConfig whisperConfig
+	// The Ollama config.
+	ollamaAIConfig ollamaConfig
+	// The ASR and TTS provider, for price.
+	asrProvider, ttsProvider string
+	// The ASR and TTS services.
+	asrService ASRService
+	ttsService TTSService
+
+	// The max number of alive stages, 0 for unlimited.
+	maxStages int
+	// The max number of conversations per day, 0 for unlimited.
+	maxConversations int
+
+	// Current alive stages.
+	stages int
+	// Total conversations.
+	conversations uint64
+	// Total errors.
+	errors uint64
+	// Total badcases.
+	badcases uint64
+	// The day and conversations of today, for quota.
+	today              string
+	todayConversations int
+
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+// Create tenant by the getenv, which read the env of tenant, and the config of server for the models of
+// providers.
+func NewTenant(ctx context.Context, conf *Config, id string, getenv func(key string) string) (*Tenant, error) {
+	v := &Tenant{id: id}
+
+	for _, host := range strings.Split(getenv("AIT_TENANT_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			v.hosts = append(v.hosts, strings.ToLower(host))
+		}
+	}
+
+	parseQuota := func(key string) (int, error) {
+		if getenv(key) == "" {
+			return 0, nil
+		}
+		if iv, err := strconv.ParseInt(getenv(key), 10, 64); err != nil {
+			return 0, errors.Wrapf(err, "parse %v %v", key, getenv(key))
+		} else {
+			return int(iv), nil
+		}
+	}
+
+	var err error
+	if v.maxStages, err = parseQuota("AIT_MAX_STAGES"); err != nil {
+		return nil, err
+	}
+	if v.maxConversations, err = parseQuota("AIT_MAX_CONVERSATIONS"); err != nil {
+		return nil, err
+	}
+
+	if v.robots, err = loadRobots(ctx, getenv); err != nil {
+		return nil, errors.Wrapf(err, "robots")
+	}
+
+	if v.auth, err = authInit(ctx, getenv); err != nil {
+		return nil, errors.Wrapf(err, "auth")
+	}
+
+	if v.asrAIConfig, v.chatAIConfig, v.ttsAIConfig, v.embeddingAIConfig, err = openaiInit(ctx, getenv); err != nil {
+		return nil, errors.Wrapf(err, "openai")
+	}
+	v.tencentAIConfig = tencentInit(ctx, getenv)
+
+	// The ASR and TTS provider, default to Tencent if configured, or OpenAI.
+	asrProvider, ttsProvider := getenv("AIT_ASR_PROVIDER"), getenv("AIT_TTS_PROVIDER")
+	if asrProvider == "" {
+		asrProvider = "openai"
+		if v.tencentAIConfig.AppID != "" {
+			asrProvider = "tencent"
+		}
+	}
+	if ttsProvider == "" {
+		ttsProvider = "openai"
+		if v.tencentAIConfig.AppID != "" {
+			ttsProvider = "tencent"
+		}
+	}
+
+	// Require the key of OpenAI or Azure only if any service is backed by OpenAI, so that the tenant is
+	// able to run fully on-premise by whisper.cpp, local TTS and Ollama.
+	var openaiServices []string
+	if asrProvider == "openai" {
+		openaiServices = append(openaiServices, "asr")
+	}
+	if ttsProvider == "openai" {
+		openaiServices = append(openaiServices, "tts")
+	}
+	for _, robot := range v.robots {
+		if robot.chatProvider == "openai" {
+			openaiServices = append(openaiServices, fmt.Sprintf("chat of robot %v", robot.uuid))
+		}
+		if robot.knowledge != nil {
+			openaiServices = append(openaiServices, fmt.Sprintf("knowledge of robot %v", robot.uuid))
+		}
+	}
+	if len(openaiServices) > 0 && getenv("OPENAI_API_KEY") == "" && getenv("AZURE_OPENAI_API_KEY") == "" {
+		return nil, errors.Errorf("OPENAI_API_KEY or AZURE_OPENAI_API_KEY is required for %v of tenant %v",
+			strings.Join(openaiServices, ", "), id)
+	}
+
+	for _, robot := range v.robots {
+		if robot.knowledge != nil {
+			if err := robot.knowledge.Load(ctx, v.embeddingAIConfig); err != nil {
+				return nil, errors.Wrapf(err, "knowledge of robot %v", robot.uuid)
+			}
+		}
+	}
+
+	v.whisperAIConfig = whisperInit(ctx, getenv)
+	v.ollamaAIConfig = ollamaInit(ctx, getenv)
+
+	// Check the models of Ollama are present, to fail at startup rather than at the first chat.
+	var ollamaModels []string
+	for _, robot := range v.robots {
+		if robot.chatProvider == "ollama" {
+			ollamaModels = append(ollamaModels, robot.chatModel)
+		}
+	}
+	if len(ollamaModels) > 0 {
+		if err := v.ollamaAIConfig.CheckModels(ctx, ollamaModels); err != nil {
+			return nil, errors.Wrapf(err, "check ollama")
+		}
+	}
+
+	v.asrProvider, v.ttsProvider = asrProvider, ttsProvider
+	switch asrProvider {
+	case "openai":
+		v.asrService = NewOpenAIASRService(func(service *openaiASRService) {
+			service.aiConfig = v.asrAIConfig
+			service.model = conf.ASRModel
+		})
+	case "tencent":
+		v.asrService = NewTencentASRService(func(service *tencentASRService) {
+			service.aiConfig = v.tencentAIConfig
+		})
+	case "whisper":
+		v.asrService = NewWhisperASRService(func(service *whisperASRService) {
+			service.aiConfig = v.whisperAIConfig
+			service.keepFiles = conf.KeepFiles
+		})
+	default:
+		return nil, errors.Errorf("invalid AIT_ASR_PROVIDER %v", asrProvider)
+	}
+
+	switch ttsProvider {
+	case "openai":
+		v.ttsService = NewOpenAITTSService(func(service *openaiTTSService) {
+			service.aiConfig = v.ttsAIConfig
+			service.model, service.voice = conf.TTSModel, conf.TTSVoice
+		})
+	case "tencent":
+		v.ttsService = NewTencentTTSService(func(service *tencentTTSService) {
+			service.aiConfig = v.tencentAIConfig
+		})
+	case "piper", "espeak":
+		localAIConfig, err := localTTSInit(ctx, ttsProvider, getenv)
+		if err != nil {
+			return nil, errors.Wrapf(err, "local tts")
+		}
+		v.ttsService = NewLocalTTSService(func(service *localTTSService) {
+			service.aiConfig = localAIConfig
+		})
+	default:
+		return nil, errors.Errorf("invalid AIT_TTS_PROVIDER %v", ttsProvider)
+	}
+
+	logger.Tf(ctx, "Tenant: Create tenant=%v, hosts=%v, robots=%v, asr=%v, tts=%v, tencent=%v, maxStages=%v, maxConversations=%v",
+		v.id, strings.Join(v.hosts, ","), len(v.robots), asrProvider, ttsProvider, v.tencentAIConfig.AppID != "",
+		v.maxStages, v.maxConversations)
+	return v, nil
+}
+
+func (v *Tenant) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return fmt.Sprintf("%v<stages=%v, chats=%v, errors=%v, badcases=%v>",
+		v.id, v.stages, v.conversations, v.errors, v.badcases)
+}
+
+// Get the robot by uuid.
+func (v *Tenant) GetRobot(uuid string) *Robot {
+	for _, robot := range v.robots {
+		if robot.uuid == uuid {
+			return robot
+		}
+	}
+	return nil
+}
+
+// Acquire a stage, return error if exceed the quota.
+func (v *Tenant) AcquireStage() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.maxStages > 0 && v.stages >= v.maxStages {
+		return errors.Errorf("tenant %v exceed max stages %v", v.id, v.maxStages)
+	}
+
+	v.stages++
+	return nil
+}
+
+func (v *Tenant) ReleaseStage() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.stages--
+}
+
+// Start a conversation, return error if exceed the quota of today.
+func (v *Tenant) NewConversation() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if today := time.Now().Format("2006-01-02"); v.today != today {
+		v.today, v.todayConversations = today, 0
+	}
+
+	if v.maxConversations > 0 && v.todayConversations >= v.maxConversations {
+		return errors.Errorf("tenant %v exceed max conversations %v of %v", v.id, v.maxConversations, v.today)
+	}
+
+	v.todayConversations++
+	v.conversations++
+	return nil
+}
+
+func (v *Tenant) NewBadcase() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.badcases++
+}
+
+func (v *Tenant) NewError() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.errors++
+}
+
+// Load the tenants from the *.env files in dir, the tenant id is the file name.
+func loadTenants(ctx context.Context, conf *Config, dir string) ([]*Tenant, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir %v", dir)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".env") {
+			files = append(files, entry.Name())
+		}
+	}
+	sort.Strings(files)
+
+	var all []*Tenant
+	for _, file := range files {
+		env, err := godotenv.Read(path.Join(dir, file))
+		if err != nil {
+			return nil, errors.Wrapf(err, "load %v", file)
+		}
+
+		// Never inherit the secrets of process, to avoid leaking keys between tenants.
+		getenv := func(key string) string {
+			if v, ok := env[key]; ok {
+				return v
+			}
+			if tenantInheritEnvs[key] {
+				return conf.Getenv(key)
+			}
+			return ""
+		}
+
+		tenant, err := NewTenant(ctx, conf, strings.TrimSuffix(file, ".env"), getenv)
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %v", file)
+		}
+		all = append(all, tenant)
+	}
+
+	return all, nil
+}
+
+// Get the tenant by id, nil if not exists.
+func tenantByID(id string) *Tenant {
+	for _, tenant := range append([]*Tenant{defaultTenant}, tenants...) {
+		if tenant.id == id {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// Get the tenant by host name, nil if not match.
+func tenantByHost(host string) *Tenant {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, tenant := range tenants {
+		for _, h := range tenant.hosts {
+			if h == host {
+				return tenant
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve the tenant of request, by host name, or API token, or JWT signed by the secret of tenant, or
+// default tenant.
+func resolveTenant(r *http.Request) *Tenant {
+	if tenant := tenantByHost(r.Host); tenant != nil {
+		return tenant
+	}
+
+	if token := apiTokenOf(r); token != "" {
+		for _, tenant := range tenants {
+			if _, ok := tenant.auth.lookupToken(token); ok {
+				return tenant
+			}
+		}
+		for _, tenant := range tenants {
+			if tenant.auth.signedJWT(token) {
+				return tenant
+			}
+		}
+	}
+
+	return defaultTenant
+}
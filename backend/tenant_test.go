@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a tenant with the auth config by envs.
+func newTenantTest(t *testing.T, id string, envs map[string]string) *Tenant {
+	auth, err := authInit(context.Background(), func(key string) string { return envs[key] })
+	if err != nil {
+		t.Fatalf("auth of %v, err %v", id, err)
+	}
+	tenant := &Tenant{id: id, auth: auth}
+	for _, host := range strings.Split(envs["AIT_TENANT_HOSTS"], ",") {
+		if host != "" {
+			tenant.hosts = append(tenant.hosts, host)
+		}
+	}
+	return tenant
+}
+
+func TestResolveTenantByJWT(t *testing.T) {
+	defaultTenant = newTenantTest(t, "default", map[string]string{"AIT_JWT_SECRET": "default-secret"})
+	alice := newTenantTest(t, "alice", map[string]string{"AIT_JWT_SECRET": "alice-secret", "AIT_AUTH_REQUIRED": "true"})
+	bob := newTenantTest(t, "bob", map[string]string{
+		"AIT_JWT_SECRET": "bob-secret", "AIT_API_TOKENS": "bot:sk-bob", "AIT_TENANT_HOSTS": "bob.example.com",
+	})
+	tenants = []*Tenant{alice, bob}
+	defer func() {
+		defaultTenant, tenants = nil, nil
+	}()
+
+	sign := func(secret, claims string) string {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims))
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte(payload))
+		return payload + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, c := range []struct {
+		name    string
+		host    string
+		token   string
+		tenant  *Tenant
+		subject string
+		err     string
+	}{
+		{"jwt of tenant", "", sign("alice-secret", fmt.Sprintf(`{"sub":"u1","exp":%v}`, exp)), alice, "u1", ""},
+		{"jwt of other tenant", "", sign("bob-secret", `{"sub":"u2"}`), bob, "u2", ""},
+		{"jwt of default", "", sign("default-secret", `{"sub":"u3"}`), defaultTenant, "u3", ""},
+		{"expired jwt of tenant", "", sign("alice-secret", `{"sub":"u1","exp":1}`), alice, "", "expired"},
+		{"jwt of unknown secret", "", sign("unknown", `{"sub":"u4"}`), defaultTenant, "", "signature"},
+		{"static token", "", "sk-bob", bob, "bot", ""},
+		{"host first", "bob.example.com", sign("alice-secret", `{"sub":"u1"}`), bob, "", "signature"},
+		{"anonymous", "", "", defaultTenant, "", ""},
+	} {
+		r := httptest.NewRequest("POST", "/api/ai-talk/start/", nil)
+		if c.host != "" {
+			r.Host = c.host
+		}
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		tenant := resolveTenant(r)
+		if tenant != c.tenant {
+			t.Fatalf("%v: tenant %v, should be %v", c.name, tenant.id, c.tenant.id)
+		}
+
+		principal, err := tenant.auth.authenticate(r)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%v: err %v, should contain %v", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: err %v", c.name, err)
+		}
+		if c.subject == "" && principal != nil || c.subject != "" && (principal == nil || principal.subject != c.subject) {
+			t.Fatalf("%v: principal %v, should be %v", c.name, principal, c.subject)
+		}
+	}
+}
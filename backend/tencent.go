@@ -5,69 +5,53 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
 	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
 	"github.com/tencentcloud/tencentcloud-speech-sdk-go/asr"
 	"github.com/tencentcloud/tencentcloud-speech-sdk-go/common"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var tencentAIConfig tencentConfig
-
 type tencentConfig struct {
 	AppID, SecretID, SecretKey string
 }
 
-func tencentInit(ctx context.Context) {
-	tencentAIConfig.AppID = os.Getenv("TENCENT_SPEECH_APPID")
-	tencentAIConfig.SecretID = os.Getenv("TENCENT_SECRET_ID")
-	tencentAIConfig.SecretKey = os.Getenv("TENCENT_SECRET_KEY")
+// Build the Tencent speech config, by the getenv which read the env of tenant.
+func tencentInit(ctx context.Context, getenv func(key string) string) (tencentAIConfig tencentConfig) {
+	tencentAIConfig.AppID = getenv("TENCENT_SPEECH_APPID")
+	tencentAIConfig.SecretID = getenv("TENCENT_SECRET_ID")
+	tencentAIConfig.SecretKey = getenv("TENCENT_SECRET_KEY")
 	logger.Tf(ctx, "Tencent config, speech appid=%v, key=%v, secret=%vB",
 		tencentAIConfig.AppID, tencentAIConfig.SecretID, len(tencentAIConfig.SecretKey))
+	return
 }
 
 type tencentASRService struct {
+	// The Tencent speech config for ASR.
+	aiConfig tencentConfig
 }
 
-func NewTencentASRService() ASRService {
-	return &tencentASRService{}
-}
-
-func (v *tencentASRService) RequestASR(ctx context.Context, inputFile, language, prompt string, onBeforeRequest func()) (*ASRResult, error) {
-	outputFile := fmt.Sprintf("%v.wav", inputFile)
-
-	// Transcode input audio in opus or aac, to aac in m4a format.
-	if os.Getenv("AIT_KEEP_FILES") != "true" {
-		defer os.Remove(outputFile)
-	}
-	if true {
-		err := exec.CommandContext(ctx, "ffmpeg",
-			"-i", inputFile,
-			"-vn", "-c:a", "pcm_s16le", "-ac", "1", "-ar", "16000",
-			outputFile,
-		).Run()
-
-		if err != nil {
-			return nil, errors.Errorf("Error converting the file")
-		}
-		logger.Tf(ctx, "Convert audio %v to %v ok", inputFile, outputFile)
+func NewTencentASRService(opts ...func(service *tencentASRService)) ASRService {
+	v := &tencentASRService{}
+	for _, opt := range opts {
+		opt(v)
 	}
+	return v
+}
 
-	duration, _, err := ffprobeAudio(ctx, outputFile)
+func (v *tencentASRService) RequestASR(ctx context.Context, input []byte, language, prompt string, onBeforeRequest func()) (*ASRResult, error) {
+	// Transcode input audio in opus or aac, to PCM in memory.
+	pcm, err := transcodeToPCM(ctx, input)
 	if err != nil {
-		return nil, errors.Wrapf(err, "ffprobe")
+		return nil, errors.Wrapf(err, "transcode")
 	}
 
 	if onBeforeRequest != nil {
@@ -81,14 +65,9 @@ func (v *tencentASRService) RequestASR(ctx context.Context, inputFile, language,
 	}
 
 	recognizer := asr.NewFlashRecognizer(
-		tencentAIConfig.AppID, common.NewCredential(tencentAIConfig.SecretID, tencentAIConfig.SecretKey),
+		v.aiConfig.AppID, common.NewCredential(v.aiConfig.SecretID, v.aiConfig.SecretKey),
 	)
 
-	data, err := ioutil.ReadFile(outputFile)
-	if err != nil {
-		return nil, errors.Wrapf(err, "read wav file %v", outputFile)
-	}
-
 	req := new(asr.FlashRecognitionRequest)
 	req.EngineType = EngineModelType
 	req.VoiceFormat = "wav"
@@ -100,7 +79,7 @@ func (v *tencentASRService) RequestASR(ctx context.Context, inputFile, language,
 	req.FirstChannelOnly = 1
 	req.WordInfo = 0
 
-	resp, err := recognizer.Recognize(req, data)
+	resp, err := recognizer.Recognize(req, pcmToWav(pcm))
 	if err != nil {
 		return nil, errors.Wrapf(err, "recognize error")
 	}
@@ -111,21 +90,36 @@ func (v *tencentASRService) RequestASR(ctx context.Context, inputFile, language,
 		sb.WriteString(" ")
 	}
 
-	return &ASRResult{Text: strings.TrimSpace(sb.String()), Duration: time.Duration(duration * float64(time.Second))}, nil
+	return &ASRResult{Text: strings.TrimSpace(sb.String()), Duration: pcmDuration(pcm)}, nil
 }
 
 type tencentTTSService struct {
+	// The Tencent speech config for TTS.
+	aiConfig tencentConfig
 }
 
-func NewTencentTTSService() TTSService {
-	return &tencentTTSService{}
+func NewTencentTTSService(opts ...func(service *tencentTTSService)) TTSService {
+	v := &tencentTTSService{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
 }
 
-func (v *tencentTTSService) RequestTTS(ctx context.Context, buildFilepath func(ext string) string, text string) error {
-	ttsFile := buildFilepath("wav")
-	appID, err := strconv.ParseInt(tencentAIConfig.AppID, 10, 64)
+func (v *tencentTTSService) RequestTTS(ctx context.Context, buildOutput func(ext string) io.Writer, text, voice string) error {
+	appID, err := strconv.ParseInt(v.aiConfig.AppID, 10, 64)
 	if err != nil {
-		return errors.Wrapf(err, "parse appid %v", tencentAIConfig.AppID)
+		return errors.Wrapf(err, "parse appid %v", v.aiConfig.AppID)
+	}
+
+	// The voice is the VoiceType of Tencent, default to 1009.
+	voiceType := 1009
+	if voice != "" {
+		if iv, err := strconv.ParseInt(voice, 10, 64); err != nil {
+			return errors.Wrapf(err, "parse voice %v", voice)
+		} else {
+			voiceType = int(iv)
+		}
 	}
 
 	requestData := map[string]interface{}{
@@ -137,12 +131,12 @@ func (v *tencentTTSService) RequestTTS(ctx context.Context, buildFilepath func(e
 		"PrimaryLanguage": 1,
 		"ProjectId":       0,
 		"SampleRate":      16000,
-		"SecretId":        tencentAIConfig.SecretID, // replace with your SecretId
+		"SecretId":        v.aiConfig.SecretID, // replace with your SecretId
 		"SessionId":       "12345678",
 		"Speed":           0,
 		"Text":            text,
 		"Timestamp":       time.Now().Unix(),
-		"VoiceType":       1009,
+		"VoiceType":       voiceType,
 		"Volume":          5,
 	}
 
@@ -153,13 +147,13 @@ func (v *tencentTTSService) RequestTTS(ctx context.Context, buildFilepath func(e
 		return errors.Wrapf(err, "marshal json")
 	}
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonData)))
 	if err != nil {
 		return errors.Wrapf(err, "create request")
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	signature := v.authGenerateSign(tencentAIConfig.SecretKey, requestData) // replace with your SecretKey
+	signature := v.authGenerateSign(v.aiConfig.SecretKey, requestData) // replace with your SecretKey
 	req.Header.Set("Authorization", signature)
 
 	client := &http.Client{}
@@ -177,26 +171,13 @@ func (v *tencentTTSService) RequestTTS(ctx context.Context, buildFilepath func(e
 		return errors.Errorf("tts error: %v", string(body))
 	}
 
-	out, err := os.Create(ttsFile)
-	if err != nil {
-		return errors.Wrapf(err, "create file")
-	}
-	defer out.Close()
-
-	// Convert to s16le depth.
-	data := make([]int, len(body)/2)
-	for i := 0; i < len(body); i += 2 {
-		data[i/2] = int(binary.LittleEndian.Uint16(body[i : i+2]))
-	}
-
-	enc := wav.NewEncoder(out, 16000, 16, 1, 1)
-	defer enc.Close()
-
-	ib := &audio.IntBuffer{
-		Data: data, SourceBitDepth: 16,
-		Format: &audio.Format{NumChannels: 1, SampleRate: 16000},
+	// The body is 16kHz mono s16le PCM, write as WAV.
+	body = body[:len(body)/2*2]
+	out := buildOutput("wav")
+	if err := writeWavHeader(out, len(body), 16000, 1, 16); err != nil {
+		return errors.Wrapf(err, "write header")
 	}
-	if err := enc.Write(ib); err != nil {
+	if _, err := out.Write(body); err != nil {
 		return errors.Wrapf(err, "copy body")
 	}
 	return nil
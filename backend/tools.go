@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The max size of tool result, to avoid too many tokens.
+const maxToolResultSize = 4096
+
+// All tools, map name to tool, which are the built-in tools and HTTP tools in AIT_TOOLS_FILE.
+var chatTools map[string]ChatTool
+
+// The ChatTool is a tool which can be called by LLM, see https://platform.openai.com/docs/guides/function-calling
+type ChatTool interface {
+	// The definition of tool for chat request.
+	Definition() openai.Tool
+	// Call the tool with arguments in JSON, return the result.
+	Call(ctx context.Context, arguments string) (string, error)
+}
+
+func toolsInit(ctx context.Context, conf *Config) error {
+	chatTools = make(map[string]ChatTool)
+	for _, tool := range []ChatTool{&currentTimeTool{}, &calculatorTool{}, &unitConversionTool{}} {
+		chatTools[tool.Definition().Function.Name] = tool
+	}
+
+	// Load the HTTP tools from file.
+	if filename := conf.ToolsFile; filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return errors.Wrapf(err, "read %v", filename)
+		}
+
+		var tools []*httpTool
+		if err := json.Unmarshal(b, &tools); err != nil {
+			return errors.Wrapf(err, "parse %v", filename)
+		}
+
+		for _, tool := range tools {
+			if tool.Name == "" || tool.URL == "" {
+				return errors.Errorf("invalid tool name=%v, url=%v", tool.Name, tool.URL)
+			}
+			if _, ok := chatTools[tool.Name]; ok {
+				return errors.Errorf("duplicated tool %v", tool.Name)
+			}
+			chatTools[tool.Name] = tool
+		}
+	}
+
+	var names []string
+	for name := range chatTools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logger.Tf(ctx, "Tools: total=%v, %v", len(names), strings.Join(names, ","))
+	return nil
+}
+
+// Parse the comma separated tool names, and verify the tools exist.
+func parseToolNames(names string) ([]string, error) {
+	var tools []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := chatTools[name]; !ok {
+			return nil, errors.Errorf("no tool %v", name)
+		}
+		tools = append(tools, name)
+	}
+	return tools, nil
+}
+
+// Call the tool by name, the error is also the result for LLM, so that it can handle it.
+func callChatTool(ctx context.Context, name, arguments string) string {
+	tool, ok := chatTools[name]
+	if !ok {
+		return fmt.Sprintf("Error: no tool %v", name)
+	}
+
+	result, err := tool.Call(ctx, arguments)
+	if err != nil {
+		logger.Wf(ctx, "Tools: Call %v with %v err %+v", name, arguments, err)
+		return fmt.Sprintf("Error: %v", err.Error())
+	}
+
+	if len(result) > maxToolResultSize {
+		result = result[:maxToolResultSize]
+	}
+	logger.Tf(ctx, "Tools: Call %v with %v, result is %v", name, arguments, result)
+	return result
+}
+
+// The currentTimeTool response the current time in timezone.
+type currentTimeTool struct {
+}
+
+func (v *currentTimeTool) Definition() openai.Tool {
+	return openai.Tool{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "current_time",
+		Description: "Get the current date and time.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string",` +
+			`"description":"The IANA timezone, for example, Asia/Shanghai, default to UTC."}}}`),
+	}}
+}
+
+func (v *currentTimeTool) Call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", errors.Wrapf(err, "parse %v", arguments)
+		}
+	}
+
+	loc := time.UTC
+	if args.Timezone != "" {
+		if l, err := time.LoadLocation(args.Timezone); err != nil {
+			return "", errors.Wrapf(err, "load timezone %v", args.Timezone)
+		} else {
+			loc = l
+		}
+	}
+
+	now := time.Now().In(loc)
+	return fmt.Sprintf("%v, %v", now.Format(time.RFC3339), now.Weekday()), nil
+}
+
+// The calculatorTool evaluates the arithmetic expression.
+type calculatorTool struct {
+}
+
+func (v *calculatorTool) Definition() openai.Tool {
+	return openai.Tool{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression with + - * / % ^ and parentheses, where % is the remainder of division.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string",` +
+			`"description":"The expression, for example, (1.5+2)*3^2"}},"required":["expression"]}`),
+	}}
+}
+
+func (v *calculatorTool) Call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", errors.Wrapf(err, "parse %v", arguments)
+	}
+
+	r, err := evaluateExpression(args.Expression)
+	if err != nil {
+		return "", errors.Wrapf(err, "evaluate %v", args.Expression)
+	}
+	return strconv.FormatFloat(r, 'g', 12, 64), nil
+}
+
+// Evaluate the arithmetic expression, by recursive descent parser.
+func evaluateExpression(expression string) (float64, error) {
+	p := &expressionParser{s: strings.ReplaceAll(expression, " ", "")}
+	r, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos != len(p.s) {
+		return 0, errors.Errorf("unexpected %v at %v", p.s[p.pos:], p.pos)
+	}
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		return 0, errors.Errorf("invalid result %v", r)
+	}
+	return r, nil
+}
+
+type expressionParser struct {
+	s   string
+	pos int
+}
+
+func (v *expressionParser) peek() byte {
+	if v.pos < len(v.s) {
+		return v.s[v.pos]
+	}
+	return 0
+}
+
+// sum = product { (+|-) product }
+func (v *expressionParser) parseSum() (float64, error) {
+	r, err := v.parseProduct()
+	for err == nil && (v.peek() == '+' || v.peek() == '-') {
+		op := v.peek()
+		v.pos++
+
+		var n float64
+		if n, err = v.parseProduct(); op == '+' {
+			r += n
+		} else {
+			r -= n
+		}
+	}
+	return r, err
+}
+
+// product = unary { (*|/|%) unary }
+func (v *expressionParser) parseProduct() (float64, error) {
+	r, err := v.parseUnary()
+	for err == nil && (v.peek() == '*' || v.peek() == '/' || v.peek() == '%') {
+		op := v.peek()
+		v.pos++
+
+		var n float64
+		if n, err = v.parseUnary(); err != nil {
+			break
+		}
+		if op == '*' {
+			r *= n
+		} else if n == 0 {
+			return 0, errors.New("divide by zero")
+		} else if op == '/' {
+			r /= n
+		} else {
+			r = math.Mod(r, n)
+		}
+	}
+	return r, err
+}
+
+// unary = (-|+) unary | power
+func (v *expressionParser) parseUnary() (float64, error) {
+	if c := v.peek(); c == '-' || c == '+' {
+		v.pos++
+		r, err := v.parseUnary()
+		if c == '-' {
+			r = -r
+		}
+		return r, err
+	}
+	return v.parsePower()
+}
+
+// power = primary [ ^ unary ]
+func (v *expressionParser) parsePower() (float64, error) {
+	r, err := v.parsePrimary()
+	if err == nil && v.peek() == '^' {
+		v.pos++
+
+		var n float64
+		if n, err = v.parseUnary(); err == nil {
+			r = math.Pow(r, n)
+		}
+	}
+	return r, err
+}
+
+// primary = ( sum ) | number
+func (v *expressionParser) parsePrimary() (float64, error) {
+	if v.peek() == '(' {
+		v.pos++
+		r, err := v.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if v.peek() != ')' {
+			return 0, errors.Errorf("expect ) at %v", v.pos)
+		}
+		v.pos++
+		return r, nil
+	}
+
+	start := v.pos
+	for v.pos < len(v.s) && (unicode.IsDigit(rune(v.s[v.pos])) || v.s[v.pos] == '.') {
+		v.pos++
+	}
+	if start == v.pos {
+		return 0, errors.Errorf("expect number at %v", start)
+	}
+	return strconv.ParseFloat(v.s[start:v.pos], 64)
+}
+
+// The unitConversionTool converts value between units of length, mass, volume or temperature.
+type unitConversionTool struct {
+}
+
+// The factor to the base unit of each category, the base unit of length is m, mass is kg, volume is l.
+var unitFactors = map[string]map[string]float64{
+	"length": {
+		"m": 1, "km": 1000, "cm": 0.01, "mm": 0.001, "mi": 1609.344, "yd": 0.9144, "ft": 0.3048, "in": 0.0254,
+	},
+	"mass": {
+		"kg": 1, "g": 0.001, "mg": 0.000001, "t": 1000, "lb": 0.45359237, "oz": 0.028349523125,
+	},
+	"volume": {
+		"l": 1, "ml": 0.001, "gal": 3.785411784, "qt": 0.946352946, "pt": 0.473176473, "cup": 0.2365882365,
+	},
+}
+
+func (v *unitConversionTool) Definition() openai.Tool {
+	return openai.Tool{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "unit_conversion",
+		Description: "Convert a value between units of length (m,km,cm,mm,mi,yd,ft,in), mass (kg,g,mg,t,lb,oz), volume (l,ml,gal,qt,pt,cup) or temperature (c,f,k).",
+		Parameters: json.RawMessage(`{"type":"object","properties":{` +
+			`"value":{"type":"number","description":"The value to convert."},` +
+			`"from":{"type":"string","description":"The unit of value, for example, km."},` +
+			`"to":{"type":"string","description":"The unit to convert to, for example, mi."}` +
+			`},"required":["value","from","to"]}`),
+	}}
+}
+
+func (v *unitConversionTool) Call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Value float64 `json:"value"`
+		From  string  `json:"from"`
+		To    string  `json:"to"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", errors.Wrapf(err, "parse %v", arguments)
+	}
+
+	from, to := strings.ToLower(args.From), strings.ToLower(args.To)
+	r, err := convertUnit(args.Value, from, to)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v %v = %v %v", args.Value, from, strconv.FormatFloat(r, 'g', 10, 64), to), nil
+}
+
+func convertUnit(value float64, from, to string) (float64, error) {
+	// Convert temperature by the Celsius.
+	temperatures := map[string]bool{"c": true, "f": true, "k": true}
+	if temperatures[from] && temperatures[to] {
+		c := value
+		if from == "f" {
+			c = (value - 32) * 5 / 9
+		} else if from == "k" {
+			c = value - 273.15
+		}
+
+		if to == "f" {
+			return c*9/5 + 32, nil
+		} else if to == "k" {
+			return c + 273.15, nil
+		}
+		return c, nil
+	}
+
+	for _, factors := range unitFactors {
+		f0, ok0 := factors[from]
+		f1, ok1 := factors[to]
+		if ok0 && ok1 {
+			return value * f0 / f1, nil
+		}
+	}
+	return 0, errors.Errorf("can't convert %v to %v", from, to)
+}
+
+// The httpTool is a tool which is served by an HTTP endpoint, configured in AIT_TOOLS_FILE. For POST
+// method, the arguments is sent as JSON body, while for GET, as query parameters.
+type httpTool struct {
+	// The tool name.
+	Name string `json:"name"`
+	// The description for LLM.
+	Description string `json:"description"`
+	// The JSON schema of parameters.
+	Parameters json.RawMessage `json:"parameters"`
+	// The HTTP endpoint.
+	URL string `json:"url"`
+	// The HTTP method, GET or POST, default to POST.
+	Method string `json:"method"`
+	// The extra HTTP headers, for example, Authorization.
+	Headers map[string]string `json:"headers"`
+}
+
+func (v *httpTool) Definition() openai.Tool {
+	parameters := v.Parameters
+	if len(parameters) == 0 {
+		parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	return openai.Tool{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name: v.Name, Description: v.Description, Parameters: parameters,
+	}}
+}
+
+func (v *httpTool) Call(ctx context.Context, arguments string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var req *http.Request
+	if strings.ToUpper(v.Method) == http.MethodGet {
+		var args map[string]interface{}
+		if arguments != "" {
+			if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+				return "", errors.Wrapf(err, "parse %v", arguments)
+			}
+		}
+
+		u, err := url.Parse(v.URL)
+		if err != nil {
+			return "", errors.Wrapf(err, "parse url %v", v.URL)
+		}
+		q := u.Query()
+		for k, arg := range args {
+			q.Set(k, fmt.Sprintf("%v", arg))
+		}
+		u.RawQuery = q.Encode()
+
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+			return "", errors.Wrapf(err, "create request")
+		}
+	} else {
+		var err error
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, v.URL, bytes.NewReader([]byte(arguments)))
+		if err != nil {
+			return "", errors.Wrapf(err, "create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for k, h := range v.Headers {
+		req.Header.Set(k, h)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "request %v", v.URL)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxToolResultSize))
+	if err != nil {
+		return "", errors.Wrapf(err, "read body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("status %v, body is %v", resp.StatusCode, string(b))
+	}
+	return string(b), nil
+}
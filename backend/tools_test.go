@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	for _, c := range []struct {
+		expression string
+		expect     float64
+		err        string
+	}{
+		{"1+2*3", 7, ""},
+		{"(1+2)*3", 9, ""},
+		{"10-4-3", 3, ""},
+		{"8/4/2", 1, ""},
+		{"2*3^2", 18, ""},
+		{"2^3^2", 512, ""},
+		{"-2^2", -4, ""},
+		{"(1.5+2) * 3^2", 31.5, ""},
+		{"7%3", 1, ""},
+		{"1+7%3*2", 3, ""},
+		{"-7%3", -1, ""},
+		{"1/0", 0, "divide by zero"},
+		{"5%(2-2)", 0, "divide by zero"},
+		{"(1+2", 0, "expect )"},
+		{"1+", 0, "expect number"},
+		{"2(3)", 0, "unexpected"},
+		{"abc", 0, "expect number"},
+		{"10^400", 0, "invalid result"},
+	} {
+		r, err := evaluateExpression(c.expression)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: err %v, should contain %v", c.expression, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: err %v", c.expression, err)
+		} else if math.Abs(r-c.expect) > 1e-9 {
+			t.Errorf("%v: result %v, should be %v", c.expression, r, c.expect)
+		}
+	}
+}
+
+func TestConvertUnit(t *testing.T) {
+	for _, c := range []struct {
+		value    float64
+		from, to string
+		expect   float64
+		err      bool
+	}{
+		{1, "km", "m", 1000, false},
+		{1, "mi", "km", 1.609344, false},
+		{12, "in", "ft", 1, false},
+		{1, "lb", "g", 453.59237, false},
+		{1, "gal", "l", 3.785411784, false},
+		{100, "c", "f", 212, false},
+		{32, "f", "c", 0, false},
+		{0, "k", "c", -273.15, false},
+		{1, "m", "m", 1, false},
+		{1, "km", "kg", 0, true},
+		{1, "c", "m", 0, true},
+		{1, "furlong", "m", 0, true},
+		{1, "m", "", 0, true},
+	} {
+		r, err := convertUnit(c.value, c.from, c.to)
+		if c.err {
+			if err == nil {
+				t.Errorf("%v %v to %v should fail, got %v", c.value, c.from, c.to, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %v to %v: err %v", c.value, c.from, c.to, err)
+		} else if math.Abs(r-c.expect) > 1e-9 {
+			t.Errorf("%v %v to %v: result %v, should be %v", c.value, c.from, c.to, r, c.expect)
+		}
+	}
+}
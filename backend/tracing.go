@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tracer exports the spans to OpenTelemetry collector, nil if not enabled, then the spans are nil
+// and all methods of span are no-op.
+var tracer *otlpExporter
+
+// Initialize the tracer by the OpenTelemetry env, such as OTEL_EXPORTER_OTLP_ENDPOINT, see
+// https://opentelemetry.io/docs/specs/otel/protocol/exporter/
+func tracingInit(ctx context.Context, conf *Config) error {
+	endpoint := conf.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := conf.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = fmt.Sprintf("%v/v1/traces", strings.TrimSuffix(base, "/"))
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+
+	service := conf.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "ai-talk"
+	}
+
+	// The headers in key=value pairs separated by comma, for example, the API key of collector.
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(conf.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	tracer = NewOTLPExporter(func(v *otlpExporter) {
+		v.endpoint, v.service, v.headers = endpoint, service, headers
+	})
+	logger.Tf(ctx, "Tracing: Export to %v, service=%v, headers=%v", endpoint, service, len(headers))
+	return nil
+}
+
+// The kinds of span, see https://opentelemetry.io/docs/specs/otel/trace/api/#spankind
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// The Span is a step of turn, for example, the ASR request. All methods are no-op for nil span.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	// The attributes in key and value pairs.
+	attributes []interface{}
+	// The error of span, nil for OK.
+	err error
+	// Whether ended, the span is exported only once.
+	ended bool
+
+	// The lock to protect the attributes and end.
+	lock sync.Mutex
+}
+
+type spanKey struct{}
+
+// Start a span as the child of the span in ctx, return the ctx with the new span. Return nil span if
+// tracing is disabled. For example:
+//
+//	ctx, span := startSpan(ctx, "asr", withSpanKind(spanKindClient))
+//	defer span.End(nil)
+func startSpan(ctx context.Context, name string, opts ...func(*Span)) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	v := &Span{name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(v.spanID[:])
+	if parent := spanFromContext(ctx); parent != nil {
+		v.traceID, v.parentID = parent.traceID, parent.spanID
+	}
+
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	// Start a new trace if no parent.
+	if v.traceID == [16]byte{} {
+		rand.Read(v.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, v), v
+}
+
+// Get the span of ctx, nil if not exists.
+func spanFromContext(ctx context.Context) *Span {
+	v, _ := ctx.Value(spanKey{}).(*Span)
+	return v
+}
+
+func withSpanKind(kind int) func(*Span) {
+	return func(v *Span) {
+		v.kind = kind
+	}
+}
+
+// Start the span at the time, for example, the time when chat starts.
+func withSpanStart(start time.Time) func(*Span) {
+	return func(v *Span) {
+		v.start = start
+	}
+}
+
+// Use the parent span, which is not in ctx, for example, the chat span of segment for the download span.
+func withParentSpan(parent *Span) func(*Span) {
+	return func(v *Span) {
+		if parent != nil {
+			v.traceID, v.parentID = parent.traceID, parent.spanID
+		}
+	}
+}
+
+// Use the parent in W3C traceparent header, for example, the trace of client, see
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func withTraceParent(traceparent string) func(*Span) {
+	return func(v *Span) {
+		parts := strings.Split(traceparent, "-")
+		if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+			return
+		}
+
+		traceID, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return
+		}
+		parentID, err := hex.DecodeString(parts[2])
+		if err != nil {
+			return
+		}
+		copy(v.traceID[:], traceID)
+		copy(v.parentID[:], parentID)
+	}
+}
+
+// Set the attributes in key and value pairs, the value is string, bool, int, int64 or float64.
+func (v *Span) SetAttributes(kvs ...interface{}) {
+	if v == nil {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.attributes = append(v.attributes, kvs...)
+}
+
+// End the span with the error, nil for OK, and return the error. Only the first end is exported.
+func (v *Span) End(err error) error {
+	if v == nil {
+		return err
+	}
+
+	if ended := func() bool {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if v.ended {
+			return true
+		}
+		v.ended, v.end, v.err = true, time.Now(), err
+		return false
+	}(); !ended {
+		tracer.Export(v)
+	}
+	return err
+}
+
+// Build the span in OTLP JSON, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+func (v *Span) otlp() map[string]interface{} {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(v.traceID[:]),
+		"spanId":            hex.EncodeToString(v.spanID[:]),
+		"name":              v.name,
+		"kind":              v.kind,
+		"startTimeUnixNano": strconv.FormatInt(v.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(v.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(v.attributes...),
+		"status":            map[string]interface{}{"code": 1},
+	}
+	if v.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(v.parentID[:])
+	}
+	if v.err != nil {
+		span["status"] = map[string]interface{}{"code": 2, "message": v.err.Error()}
+	}
+	return span
+}
+
+// Build the attributes in OTLP JSON, from the key and value pairs.
+func otlpAttributes(kvs ...interface{}) []interface{} {
+	attributes := []interface{}{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		var value map[string]interface{}
+		switch v := kvs[i+1].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+		}
+		attributes = append(attributes, map[string]interface{}{"key": fmt.Sprintf("%v", kvs[i]), "value": value})
+	}
+	return attributes
+}
+
+// The otlpExporter exports the ended spans in batch, to the OTLP/HTTP endpoint in JSON.
+type otlpExporter struct {
+	// The endpoint, for example, http://127.0.0.1:4318/v1/traces
+	endpoint string
+	// The service name of resource.
+	service string
+	// The headers of request.
+	headers map[string]string
+	// The max spans in a batch.
+	batchSize int
+	// The interval to export the batch.
+	interval time.Duration
+
+	// The ended spans to export.
+	spans chan *Span
+	// The dropped spans, because the queue is full.
+	dropped uint64
+	// Closed when the exporter goroutine quit.
+	done chan bool
+	// The lock to protect the dropped.
+	lock sync.Mutex
+}
+
+func NewOTLPExporter(opts ...func(*otlpExporter)) *otlpExporter {
+	v := &otlpExporter{
+		batchSize: 512,
+		interval:  5 * time.Second,
+		spans:     make(chan *Span, 4096),
+		done:      make(chan bool),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Queue the ended span to export, drop it if the queue is full, never block the turn.
+func (v *otlpExporter) Export(span *Span) {
+	select {
+	case v.spans <- span:
+	default:
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.dropped++
+	}
+}
+
+// Run the exporter, which exports the spans in batch, until ctx is done.
+func (v *otlpExporter) Run(ctx context.Context) {
+	defer close(v.done)
+
+	// Never abort the exporting batch when ctx is done, which is limited by timeout.
+	exportCtx := withoutCancel(ctx)
+
+	var batch []*Span
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case span := <-v.spans:
+			if batch = append(batch, span); len(batch) >= v.batchSize {
+				v.flush(exportCtx, batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			v.flush(exportCtx, batch)
+			batch = nil
+		}
+	}
+
+	// Return the spans to queue, which are exported by Close.
+	for _, span := range batch {
+		v.Export(span)
+	}
+}
+
+// Export all queued spans, after the exporter goroutine quit.
+func (v *otlpExporter) Close(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-v.done:
+	}
+
+	var batch []*Span
+	for len(v.spans) > 0 {
+		batch = append(batch, <-v.spans)
+	}
+	v.flush(ctx, batch)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	logger.Tf(ctx, "Shutdown: Close tracer ok, spans=%v, dropped=%v", len(batch), v.dropped)
+}
+
+func (v *otlpExporter) flush(ctx context.Context, batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := v.post(ctx, batch); err != nil {
+		logger.Wf(ctx, "Tracing: Export %v spans failed, err %v", len(batch), err)
+	}
+}
+
+func (v *otlpExporter) post(ctx context.Context, batch []*Span) error {
+	spans := make([]interface{}, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, span.otlp())
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes("service.name", v.service),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "ai-talk"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "marshal")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "create request %v", v.endpoint)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, hv := range v.headers {
+		req.Header.Set(k, hv)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request %v", v.endpoint)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.Errorf("request %v status %v, body is %v", v.endpoint, resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The ttsFormat is the audio format of TTS requested by client, which is transcoded by FFmpeg.
+type ttsFormat struct {
+	// The file extension.
+	ext string
+	// The Content-Type of response.
+	contentType string
+	// The native extension of TTS provider, which could be served without transcoding.
+	native string
+	// The FFmpeg codec args.
+	args []string
+}
+
+// The TTS formats, the low variants are for mobile networks.
+var ttsFormats = map[string]*ttsFormat{
+	"opus":     {ext: "webm", contentType: "audio/webm", args: []string{"-c:a", "libopus", "-b:a", "32k", "-f", "webm"}},
+	"opus-low": {ext: "webm", contentType: "audio/webm", args: []string{"-c:a", "libopus", "-b:a", "16k", "-f", "webm"}},
+	"webm":     {ext: "webm", contentType: "audio/webm", args: []string{"-c:a", "libopus", "-b:a", "32k", "-f", "webm"}},
+	"ogg":      {ext: "ogg", contentType: "audio/ogg", args: []string{"-c:a", "libopus", "-b:a", "32k", "-f", "ogg"}},
+	"mp3":      {ext: "mp3", contentType: "audio/mpeg", args: []string{"-c:a", "libmp3lame", "-b:a", "64k", "-f", "mp3"}},
+	"mp3-low":  {ext: "mp3", contentType: "audio/mpeg", args: []string{"-c:a", "libmp3lame", "-ac", "1", "-b:a", "24k", "-f", "mp3"}},
+	"aac": {ext: "aac", contentType: "audio/aac", native: "aac",
+		args: []string{"-c:a", "aac", "-b:a", "64k", "-f", "adts"}},
+	"aac-low": {ext: "aac", contentType: "audio/aac", args: []string{"-c:a", "aac", "-ac", "1", "-b:a", "24k", "-f", "adts"}},
+	"wav": {ext: "wav", contentType: "audio/wav", native: "wav",
+		args: []string{"-c:a", "pcm_s16le", "-f", "wav"}},
+}
+
+// Get the Content-Type of TTS audio, by the extension.
+func ttsContentType(ext string) string {
+	switch ext {
+	case "wav":
+		return "audio/wav"
+	case "mp3":
+		return "audio/mpeg"
+	case "webm":
+		return "audio/webm"
+	case "ogg":
+		return "audio/ogg"
+	default:
+		return "audio/aac"
+	}
+}
+
+// Get the TTS audio in format, transcode by FFmpeg pipes if the native format of provider differs, and cache
+// the transcoded audio for the following requests, such as the range requests of browser. Empty format to
+// use the native format. Return the audio and its Content-Type.
+func (v *AnswerSegment) TTSAudioOf(ctx context.Context, format string) (*AudioBuffer, string, error) {
+	tts := v.TTS()
+	if tts == nil {
+		return nil, "", errors.Errorf("no tts audio for %v", v.asid)
+	}
+
+	if format == "" {
+		return tts, ttsContentType(tts.ext), nil
+	}
+
+	f, ok := ttsFormats[format]
+	if !ok {
+		return nil, "", errors.Errorf("invalid format %v", format)
+	}
+
+	if f.native != "" && tts.ext == f.native {
+		return tts, f.contentType, nil
+	}
+
+	v.transcodeLock.Lock()
+	defer v.transcodeLock.Unlock()
+
+	if audio, ok := v.transcoded[format]; ok {
+		return audio, f.contentType, nil
+	}
+
+	input, err := tts.Open(ctx)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "open %v", tts)
+	}
+	defer input.Close()
+
+	audio := NewAudioBuffer(func(buffer *AudioBuffer) {
+		buffer.limit, buffer.keepFiles = tts.limit, tts.keepFiles
+		buffer.ext = f.ext
+		buffer.key = fmt.Sprintf("%v.%v.%v", tts.key, format, f.ext)
+	})
+	err = transcodeAudio(ctx, input, audio, f.args...)
+	if r0 := audio.Close(ctx); r0 != nil && err == nil {
+		err = r0
+	}
+	if err != nil {
+		audio.Remove(ctx)
+		return nil, "", errors.Wrapf(err, "transcode %v to %v", tts, format)
+	}
+
+	if v.transcoded == nil {
+		v.transcoded = make(map[string]*AudioBuffer)
+	}
+	v.transcoded[format] = audio
+
+	logger.Tf(ctx, "TTS: Transcode %v to %v ok", tts, audio)
+	return audio, f.contentType, nil
+}
+
+// Get the transcoded audios, to remove with the TTS audio.
+func (v *AnswerSegment) TranscodedAudios() []*AudioBuffer {
+	v.transcodeLock.Lock()
+	defer v.transcodeLock.Unlock()
+
+	var audios []*AudioBuffer
+	for _, audio := range v.transcoded {
+		audios = append(audios, audio)
+	}
+	return audios
+}
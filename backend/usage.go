@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var usageAccount *UsageAccount
+
+// The Usage is the usage and cost of provider, for a turn, stage, robot, day or tenant.
+type Usage struct {
+	// The number of turns, or conversations.
+	Turns int `json:"turns"`
+	// The ASR speech duration in seconds.
+	ASRSeconds float64 `json:"asr_seconds"`
+	// The chat prompt tokens.
+	PromptTokens int `json:"prompt_tokens"`
+	// The chat completion tokens.
+	CompletionTokens int `json:"completion_tokens"`
+	// The TTS characters.
+	TTSChars int `json:"tts_chars"`
+	// The cost in USD, by the price table.
+	Cost float64 `json:"cost"`
+
+	// The chat model for price, default to the chat model of robot.
+	model string
+	// The ASR and TTS provider for price, default to the provider of tenant.
+	asrProvider, ttsProvider string
+}
+
+func (v *Usage) Add(u *Usage) {
+	v.Turns += u.Turns
+	v.ASRSeconds += u.ASRSeconds
+	v.PromptTokens += u.PromptTokens
+	v.CompletionTokens += u.CompletionTokens
+	v.TTSChars += u.TTSChars
+	v.Cost += u.Cost
+}
+
+func (v *Usage) String() string {
+	return fmt.Sprintf("turns=%v, asr=%.1fs, prompt=%v, completion=%v, tts=%v, cost=$%.6f",
+		v.Turns, v.ASRSeconds, v.PromptTokens, v.CompletionTokens, v.TTSChars, v.Cost)
+}
+
+// The max days of usage kept for each tenant, the oldest days are removed.
+const maxUsageDays = 90
+
+// The PriceTable is the price of providers in USD.
+type PriceTable struct {
+	// The price of ASR per minute, map provider to price.
+	asr map[string]float64
+	// The price of TTS per 1K characters, map provider to price.
+	tts map[string]float64
+	// The price of chat per 1K tokens, map model to prompt and completion price.
+	chat map[string][2]float64
+}
+
+// Build the price table, the default price is the price of OpenAI and Tencent, and zero for the local
+// providers. The ASR and TTS price is configured by AIT_PRICE_ASR and AIT_PRICE_TTS in provider=price,
+// or a single price for OpenAI, and the chat price is configured by AIT_PRICE_CHAT in
+// model=prompt/completion, for example, gpt-4-1106-preview=0.01/0.03
+func NewPriceTable(getenv func(key string) string) (*PriceTable, error) {
+	v := &PriceTable{
+		asr: map[string]float64{"openai": 0.006, "tencent": 0.0072, "whisper": 0},
+		tts: map[string]float64{"openai": 0.015, "tencent": 0.028, "piper": 0, "espeak": 0},
+		chat: map[string][2]float64{
+			"gpt-4-1106-preview": {0.01, 0.03}, "gpt-4-turbo-preview": {0.01, 0.03},
+			"gpt-4": {0.03, 0.06}, "gpt-3.5-turbo-1106": {0.001, 0.002}, "gpt-3.5-turbo": {0.0005, 0.0015},
+			"text-embedding-3-small": {0.00002, 0}, "text-embedding-3-large": {0.00013, 0},
+			"text-embedding-ada-002": {0.0001, 0},
+		},
+	}
+
+	// Parse the price of providers, the item without provider is the price of OpenAI.
+	parseProviderPrices := func(key string, prices map[string]float64) error {
+		for _, item := range strings.Split(getenv(key), ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+
+			provider, price, ok := strings.Cut(item, "=")
+			if !ok {
+				provider, price = "openai", item
+			}
+			if _, ok := prices[provider]; !ok {
+				return errors.Errorf("invalid provider of %v %v", key, item)
+			}
+
+			fv, err := strconv.ParseFloat(price, 64)
+			if err != nil {
+				return errors.Wrapf(err, "parse %v %v", key, item)
+			}
+			prices[provider] = fv
+		}
+		return nil
+	}
+
+	if err := parseProviderPrices("AIT_PRICE_ASR", v.asr); err != nil {
+		return nil, err
+	}
+	if err := parseProviderPrices("AIT_PRICE_TTS", v.tts); err != nil {
+		return nil, err
+	}
+
+	for _, item := range strings.Split(getenv("AIT_PRICE_CHAT"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		model, prices, ok := strings.Cut(item, "=")
+		prompt, completion, ok2 := strings.Cut(prices, "/")
+		if !ok || !ok2 {
+			return nil, errors.Errorf("invalid AIT_PRICE_CHAT %v", item)
+		}
+
+		pv, err := strconv.ParseFloat(prompt, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse prompt price %v", item)
+		}
+		cv, err := strconv.ParseFloat(completion, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse completion price %v", item)
+		}
+		v.chat[model] = [2]float64{pv, cv}
+	}
+
+	return v, nil
+}
+
+// Calculate the cost of usage.
+func (v *PriceTable) Cost(model string, u *Usage) float64 {
+	cost := u.ASRSeconds / 60 * v.asr[u.asrProvider]
+	cost += float64(u.TTSChars) / 1000 * v.tts[u.ttsProvider]
+	if price, ok := v.chat[model]; ok {
+		cost += float64(u.PromptTokens)/1000*price[0] + float64(u.CompletionTokens)/1000*price[1]
+	}
+	return cost
+}
+
+// The UsageAccount aggregates the usage per stage, robot, day and tenant.
+type UsageAccount struct {
+	// The price table.
+	prices *PriceTable
+
+	// The usage of each turn of stage, map sid to rid to usage.
+	turns map[string]map[string]*Usage
+	// The usage of stages, map sid to usage.
+	stages map[string]*Usage
+	// The usage of robots, map tenant to robot uuid to usage.
+	robots map[string]map[string]*Usage
+	// The usage of days, map tenant to day to usage.
+	days map[string]map[string]*Usage
+	// The usage of tenants, map tenant to usage.
+	tenants map[string]*Usage
+
+	// The lock to protect fields.
+	lock sync.Mutex
+}
+
+func NewUsageAccount(prices *PriceTable) *UsageAccount {
+	return &UsageAccount{
+		prices: prices,
+		turns:  make(map[string]map[string]*Usage), stages: make(map[string]*Usage),
+		robots: make(map[string]map[string]*Usage), days: make(map[string]map[string]*Usage),
+		tenants: make(map[string]*Usage),
+	}
+}
+
+// Record the usage of a turn, identified by rid, of stage and robot.
+func (v *UsageAccount) Record(ctx context.Context, stage *Stage, robot *Robot, rid string, u *Usage) {
+	model := u.model
+	if model == "" {
+		model = robot.chatModel
+	}
+	if u.asrProvider == "" {
+		u.asrProvider = stage.tenant.asrProvider
+	}
+	if u.ttsProvider == "" {
+		u.ttsProvider = stage.tenant.ttsProvider
+	}
+	u.Cost = v.prices.Cost(model, u)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	tenant, day := stage.tenant.id, time.Now().Format("2006-01-02")
+	ensure := func(m map[string]map[string]*Usage, k0, k1 string) *Usage {
+		if _, ok := m[k0]; !ok {
+			m[k0] = make(map[string]*Usage)
+		}
+		if _, ok := m[k0][k1]; !ok {
+			m[k0][k1] = &Usage{}
+		}
+		return m[k0][k1]
+	}
+
+	// Count the turn only for the first usage of request.
+	if _, ok := v.turns[stage.sid][rid]; !ok {
+		u.Turns = 1
+	}
+
+	ensure(v.turns, stage.sid, rid).Add(u)
+	ensure(v.robots, tenant, robot.uuid).Add(u)
+	ensure(v.days, tenant, day).Add(u)
+	v.pruneDays(tenant)
+
+	if _, ok := v.stages[stage.sid]; !ok {
+		v.stages[stage.sid] = &Usage{}
+	}
+	v.stages[stage.sid].Add(u)
+
+	if _, ok := v.tenants[tenant]; !ok {
+		v.tenants[tenant] = &Usage{}
+	}
+	v.tenants[tenant].Add(u)
+
+	logger.Tf(ctx, "Usage: Record sid=%v, rid=%v, robot=%v, %v, stage is %v",
+		stage.sid, rid, robot.uuid, u.String(), v.stages[stage.sid].String())
+}
+
+// Remove the oldest days of tenant, to keep at most maxUsageDays days.
+func (v *UsageAccount) pruneDays(tenant string) {
+	days := v.days[tenant]
+	if len(days) <= maxUsageDays {
+		return
+	}
+
+	// The day is in YYYY-MM-DD, so the oldest day is the smallest string.
+	var keys []string
+	for day := range days {
+		keys = append(keys, day)
+	}
+	sort.Strings(keys)
+	for _, day := range keys[:len(keys)-maxUsageDays] {
+		delete(days, day)
+	}
+}
+
+// Remove the usage of stage, when stage is removed. Note that the usage of robot, day and tenant is kept.
+func (v *UsageAccount) RemoveStage(sid string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.turns, sid)
+	delete(v.stages, sid)
+}
+
+// Get the usage of stage, and the usage of each turn.
+func (v *UsageAccount) QueryStage(sid string) (*Usage, map[string]Usage) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	total := Usage{}
+	if u, ok := v.stages[sid]; ok {
+		total = *u
+	}
+
+	turns := make(map[string]Usage)
+	for rid, u := range v.turns[sid] {
+		turns[rid] = *u
+	}
+	return &total, turns
+}
+
+// Get the usage of tenant, and the usage of each robot and day.
+func (v *UsageAccount) QueryTenant(tenant string) (*Usage, map[string]Usage, map[string]Usage) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	total := Usage{}
+	if u, ok := v.tenants[tenant]; ok {
+		total = *u
+	}
+
+	robots := make(map[string]Usage)
+	for uuid, u := range v.robots[tenant] {
+		robots[uuid] = *u
+	}
+
+	days := make(map[string]Usage)
+	for day, u := range v.days[tenant] {
+		days[day] = *u
+	}
+	return &total, robots, days
+}
+
+func usageInit(ctx context.Context, conf *Config) error {
+	prices, err := NewPriceTable(conf.Getenv)
+	if err != nil {
+		return errors.Wrapf(err, "price")
+	}
+	usageAccount = NewUsageAccount(prices)
+
+	formatPrices := func(prices map[string]float64) string {
+		var items []string
+		for provider, price := range prices {
+			items = append(items, fmt.Sprintf("%v=%v", provider, price))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+
+	var models []string
+	for model, price := range prices.chat {
+		models = append(models, fmt.Sprintf("%v=%v/%v", model, price[0], price[1]))
+	}
+	sort.Strings(models)
+	logger.Tf(ctx, "Usage: Price asr=%v/min, tts=%v/1K chars, chat=%v, days=%v",
+		formatPrices(prices.asr), formatPrices(prices.tts), strings.Join(models, ","), maxUsageDays)
+	return nil
+}
+
+// Query the usage. For the stage, with sid and stoken, response the usage of stage and turns. For
+// the tenant, response the usage of tenant, robots and days, and requires API token if auth enabled.
+func handleQueryUsage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if sid := q.Get("sid"); sid != "" {
+		stage := talkServer.QueryStage(ctx, sid)
+		if stage == nil {
+			return errors.Errorf("invalid sid %v", sid)
+		}
+
+		// Verify the stage access token.
+		if err := stage.Authorize(r); err != nil {
+			return errors.Wrapf(err, "auth")
+		}
+
+		total, turns := usageAccount.QueryStage(sid)
+		ohttp.WriteData(ctx, w, r, struct {
+			Stage *Usage           `json:"stage"`
+			Turns map[string]Usage `json:"turns"`
+		}{
+			Stage: total, Turns: turns,
+		})
+		return nil
+	}
+
+	tenant := resolveTenant(r)
+	if principal, err := tenant.auth.authenticate(r); err != nil {
+		return errors.Wrapf(err, "auth")
+	} else if principal == nil && tenant.auth.Enabled() {
+		return newAuthError("no auth token for usage of tenant %v", tenant.id)
+	}
+
+	total, robots, days := usageAccount.QueryTenant(tenant.id)
+	ohttp.WriteData(ctx, w, r, struct {
+		Tenant string           `json:"tenant"`
+		Total  *Usage           `json:"total"`
+		Robots map[string]Usage `json:"robots"`
+		Days   map[string]Usage `json:"days"`
+	}{
+		Tenant: tenant.id, Total: total, Robots: robots, Days: days,
+	})
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPriceTableCost(t *testing.T) {
+	prices, err := NewPriceTable(func(key string) string {
+		return map[string]string{"AIT_PRICE_ASR": "0.01,tencent=0.02", "AIT_PRICE_TTS": "tencent=0.03"}[key]
+	})
+	if err != nil {
+		t.Fatalf("prices, err %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		u    *Usage
+		cost float64
+	}{
+		{"openai asr", &Usage{ASRSeconds: 120, asrProvider: "openai"}, 0.02},
+		{"tencent asr", &Usage{ASRSeconds: 120, asrProvider: "tencent"}, 0.04},
+		{"whisper asr", &Usage{ASRSeconds: 120, asrProvider: "whisper"}, 0},
+		{"openai tts", &Usage{TTSChars: 2000, ttsProvider: "openai"}, 0.03},
+		{"tencent tts", &Usage{TTSChars: 2000, ttsProvider: "tencent"}, 0.06},
+		{"piper tts", &Usage{TTSChars: 2000, ttsProvider: "piper"}, 0},
+		{"espeak tts", &Usage{TTSChars: 2000, ttsProvider: "espeak"}, 0},
+		{"chat", &Usage{PromptTokens: 1000, CompletionTokens: 2000}, 0.0005 + 0.003},
+	} {
+		if cost := prices.Cost("gpt-3.5-turbo", c.u); math.Abs(cost-c.cost) > 1e-9 {
+			t.Fatalf("%v: cost %v, should be %v", c.name, cost, c.cost)
+		}
+	}
+
+	for _, envs := range []map[string]string{
+		{"AIT_PRICE_ASR": "piper=0.01"}, {"AIT_PRICE_TTS": "openai=free"}, {"AIT_PRICE_CHAT": "gpt-4=0.01"},
+	} {
+		if _, err := NewPriceTable(func(key string) string { return envs[key] }); err == nil {
+			t.Fatalf("price %v should fail", envs)
+		}
+	}
+}
+
+func TestUsageAccountProvider(t *testing.T) {
+	prices, err := NewPriceTable(func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("prices, err %v", err)
+	}
+	account := NewUsageAccount(prices)
+
+	robot := &Robot{uuid: "robot", chatModel: "gpt-3.5-turbo"}
+	for _, c := range []struct {
+		asrProvider, ttsProvider string
+		cost                     float64
+	}{
+		{"openai", "openai", 0.006 + 0.015}, {"tencent", "tencent", 0.0072 + 0.028}, {"whisper", "piper", 0},
+	} {
+		tenant := &Tenant{id: c.asrProvider, asrProvider: c.asrProvider, ttsProvider: c.ttsProvider}
+		stage := &Stage{sid: c.asrProvider, tenant: tenant}
+		account.Record(context.Background(), stage, robot, "rid", &Usage{ASRSeconds: 60})
+		account.Record(context.Background(), stage, robot, "rid", &Usage{TTSChars: 1000})
+
+		if total, _, _ := account.QueryTenant(tenant.id); math.Abs(total.Cost-c.cost) > 1e-9 {
+			t.Fatalf("%v/%v: cost %v, should be %v", c.asrProvider, c.ttsProvider, total.Cost, c.cost)
+		}
+	}
+}
+
+func TestUsageAccountDays(t *testing.T) {
+	prices, err := NewPriceTable(func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("prices, err %v", err)
+	}
+	account := NewUsageAccount(prices)
+
+	// Fill the days before today, the oldest is removed when today is recorded.
+	today := time.Now()
+	account.days["default"] = make(map[string]*Usage)
+	for i := 1; i <= maxUsageDays; i++ {
+		account.days["default"][today.AddDate(0, 0, -i).Format("2006-01-02")] = &Usage{Turns: i}
+	}
+
+	stage := &Stage{sid: "sid", tenant: &Tenant{id: "default"}}
+	account.Record(context.Background(), stage, &Robot{uuid: "robot"}, "rid", &Usage{PromptTokens: 10})
+
+	_, _, days := account.QueryTenant("default")
+	if len(days) != maxUsageDays {
+		t.Fatalf("days %v, should be %v", len(days), maxUsageDays)
+	}
+	if _, ok := days[today.Format("2006-01-02")]; !ok {
+		t.Fatalf("no today in days")
+	}
+	if oldest := today.AddDate(0, 0, -maxUsageDays).Format("2006-01-02"); days[oldest].Turns != 0 {
+		t.Fatalf("oldest day %v should be removed", oldest)
+	}
+	if day := today.AddDate(0, 0, 1-maxUsageDays).Format("2006-01-02"); days[day].Turns != maxUsageDays-1 {
+		t.Fatalf("day %v should be kept, got %v", day, fmt.Sprint(days[day]))
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type whisperConfig struct {
+	// The whisper.cpp binary, such as whisper-cli or main of whisper.cpp.
+	Binary string
+	// The ggml model file for binary.
+	Model string
+	// The threads for binary, empty to use the default of whisper.cpp.
+	Threads string
+	// The whisper.cpp server, such as http://127.0.0.1:8080, use server instead of binary if set.
+	Server string
+}
+
+// Build the whisper.cpp config, by the getenv which read the env of tenant.
+func whisperInit(ctx context.Context, getenv func(key string) string) (whisperAIConfig whisperConfig) {
+	whisperAIConfig.Binary = getenv("WHISPER_CPP_BIN")
+	if whisperAIConfig.Binary == "" {
+		whisperAIConfig.Binary = "whisper-cli"
+	}
+	whisperAIConfig.Model = getenv("WHISPER_CPP_MODEL")
+	whisperAIConfig.Threads = getenv("WHISPER_CPP_THREADS")
+	whisperAIConfig.Server = strings.TrimSuffix(getenv("WHISPER_CPP_SERVER"), "/")
+	logger.Tf(ctx, "Whisper config, bin=%v, model=%v, threads=%v, server=%v",
+		whisperAIConfig.Binary, whisperAIConfig.Model, whisperAIConfig.Threads, whisperAIConfig.Server)
+	return
+}
+
+type whisperASRService struct {
+	// The whisper.cpp config for ASR.
+	aiConfig whisperConfig
+	// Whether keep the temporary files for debugging.
+	keepFiles bool
+}
+
+func NewWhisperASRService(opts ...func(service *whisperASRService)) ASRService {
+	v := &whisperASRService{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// The segment of whisper.cpp output, the offsets are in milliseconds.
+type whisperSegment struct {
+	Offsets struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	} `json:"offsets"`
+	Text string `json:"text"`
+}
+
+func (v *whisperASRService) RequestASR(ctx context.Context, input []byte, language, prompt string, onBeforeRequest func()) (*ASRResult, error) {
+	// Transcode input audio in opus or aac, to PCM in memory.
+	pcm, err := transcodeToPCM(ctx, input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "transcode")
+	}
+
+	if onBeforeRequest != nil {
+		onBeforeRequest()
+	}
+
+	var text string
+	var duration float64
+	if v.aiConfig.Server != "" {
+		text, duration, err = v.requestServer(ctx, pcmToWav(pcm), language, prompt)
+	} else {
+		text, duration, err = v.requestBinary(ctx, pcmToWav(pcm), language, prompt)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "whisper")
+	}
+
+	// Use the duration of PCM, if whisper.cpp doesn't response it, for example, no speech.
+	if duration <= 0 {
+		duration = pcmDuration(pcm).Seconds()
+	}
+
+	return &ASRResult{Text: strings.TrimSpace(text), Duration: time.Duration(duration * float64(time.Second))}, nil
+}
+
+// Run the whisper.cpp binary, which requires the WAV file, and writes the JSON output to the file of prefix.
+func (v *whisperASRService) requestBinary(ctx context.Context, wav []byte, language, prompt string) (string, float64, error) {
+	if v.aiConfig.Model == "" {
+		return "", 0, errors.New("WHISPER_CPP_MODEL is required")
+	}
+
+	f, err := os.CreateTemp(workDir, "assistant-*-input.wav")
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "create temp")
+	}
+	wavFile := f.Name()
+	_, err = f.Write(wav)
+	f.Close()
+	if !v.keepFiles {
+		defer os.Remove(wavFile)
+	}
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "write %v", wavFile)
+	}
+
+	prefix := fmt.Sprintf("%v.whisper", wavFile)
+	jsonFile := fmt.Sprintf("%v.json", prefix)
+	if !v.keepFiles {
+		defer os.Remove(jsonFile)
+	}
+
+	args := []string{"-m", v.aiConfig.Model, "-f", wavFile, "-oj", "-of", prefix, "-nt", "-np"}
+	if language != "" {
+		args = append(args, "-l", language)
+	}
+	if prompt != "" {
+		args = append(args, "--prompt", prompt)
+	}
+	if v.aiConfig.Threads != "" {
+		args = append(args, "-t", v.aiConfig.Threads)
+	}
+
+	if b, err := exec.CommandContext(ctx, v.aiConfig.Binary, args...).CombinedOutput(); err != nil {
+		return "", 0, errors.Wrapf(err, "run %v, output is %v", v.aiConfig.Binary, string(b))
+	}
+
+	b, err := os.ReadFile(jsonFile)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "read %v", jsonFile)
+	}
+
+	var res struct {
+		Transcription []whisperSegment `json:"transcription"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return "", 0, errors.Wrapf(err, "parse %v", string(b))
+	}
+
+	var sb strings.Builder
+	var duration float64
+	for _, segment := range res.Transcription {
+		sb.WriteString(segment.Text)
+		duration = float64(segment.Offsets.To) / 1000
+	}
+	return sb.String(), duration, nil
+}
+
+// Request the whisper.cpp server, by the /inference API in verbose JSON.
+func (v *whisperASRService) requestServer(ctx context.Context, wav []byte, language, prompt string) (string, float64, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	if err := func() error {
+		fw, err := mw.CreateFormFile("file", "input.wav")
+		if err != nil {
+			return errors.Wrapf(err, "create form file")
+		}
+
+		if _, err := fw.Write(wav); err != nil {
+			return errors.Wrapf(err, "write wav")
+		}
+
+		fields := map[string]string{"response_format": "verbose_json", "language": language, "prompt": prompt}
+		for k, fv := range fields {
+			if fv == "" {
+				continue
+			}
+			if err := mw.WriteField(k, fv); err != nil {
+				return errors.Wrapf(err, "write field %v", k)
+			}
+		}
+		return mw.Close()
+	}(); err != nil {
+		return "", 0, errors.Wrapf(err, "build form")
+	}
+
+	api := fmt.Sprintf("%v/inference", v.aiConfig.Server)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api, &body)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "create request %v", api)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "request %v", api)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "read body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, errors.Errorf("request %v status %v, body is %v", api, resp.StatusCode, string(b))
+	}
+
+	var res struct {
+		Text     string  `json:"text"`
+		Duration float64 `json:"duration"`
+		Error    string  `json:"error"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return "", 0, errors.Wrapf(err, "parse %v", string(b))
+	}
+	if res.Error != "" {
+		return "", 0, errors.Errorf("whisper server error %v", res.Error)
+	}
+	return res.Text, res.Duration, nil
+}
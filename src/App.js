@@ -13,16 +13,16 @@ function App() {
   // The log and debug panel.
   const [info, verbose, showVerboseLogs, logPanel] = useDebugPanel(playerRef);
   // The robot initialize and select UI.
-  const [robot, stageUUID, robotReady, robotPanel] = useRobotInitiator(info, verbose, playerRef);
+  const [robot, stageUUID, stageToken, robotReady, robotPanel] = useRobotInitiator(info, verbose, playerRef);
 
   return <>
     <div><audio ref={playerRef} controls={true} hidden={!showVerboseLogs} /></div>
     {robot ? logPanel : robotPanel}
-    {robot && <AppImpl {...{info, verbose, robot, robotReady, stageUUID, playerRef}}/>}
+    {robot && <AppImpl {...{info, verbose, robot, robotReady, stageUUID, stageToken, playerRef}}/>}
   </>;
 }
 
-function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
+function AppImpl({info, verbose, robot, robotReady, stageUUID, stageToken, playerRef}) {
   const isOssrsNet = useIsOssrsNet();
   const isMobile = useIsMobile();
   const [statLink, setStatLink] = React.useState(null);
@@ -100,7 +100,7 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
     const processUserInput = async(userMayInput) => {
       // End conversation, for stat the elapsed time cost accurately.
       await new Promise((resolve, reject) => {
-        fetch(`/api/ai-talk/conversation/?sid=${stageUUID}&robot=${robot.uuid}&umi=${userMayInput}`, {
+        fetch(`/api/ai-talk/conversation/?sid=${stageUUID}&stoken=${stageToken}&robot=${robot.uuid}&umi=${userMayInput}`, {
           method: 'POST',
         }).then(response => {
           return response.json();
@@ -120,7 +120,7 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
         const formData = new FormData();
         formData.append('file', audioBlob, 'input.audio');
 
-        fetch(`/api/ai-talk/upload/?sid=${stageUUID}&robot=${robot.uuid}&umi=${userMayInput}`, {
+        fetch(`/api/ai-talk/upload/?sid=${stageUUID}&stoken=${stageToken}&robot=${robot.uuid}&umi=${userMayInput}`, {
           method: 'POST',
           body: formData,
         }).then(response => {
@@ -128,6 +128,9 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
         }).then((data) => {
           verbose(`ASR: Upload success: ${data.data.rid} ${data.data.asr}`);
           info('user', `${data.data.asr}`);
+          if (data.data.sources) {
+            verbose(`ASR: Sources ${data.data.sources.map(e => `${e.source}#${e.chunk}`).join(', ')}`);
+          }
           resolve(data.data.rid);
         }).catch((error) => reject(error));
       });
@@ -138,7 +141,7 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
         let audioSegmentUUID = null;
         while (!audioSegmentUUID) {
           const resp = await new Promise((resolve, reject) => {
-            fetch(`/api/ai-talk/query/?sid=${stageUUID}&rid=${requestUUID}`, {
+            fetch(`/api/ai-talk/query/?sid=${stageUUID}&stoken=${stageToken}&rid=${requestUUID}`, {
               method: 'POST',
             }).then(response => {
               return response.json();
@@ -172,7 +175,9 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
 
         // Play the AI generated audio.
         await new Promise(resolve => {
-          const url = `/api/ai-talk/tts/?sid=${stageUUID}&rid=${requestUUID}&asid=${audioSegmentUUID}`;
+          // The optional TTS format, for example, https://your-server/?format=opus
+          const format = new URLSearchParams(window.location.search).get('format');
+          const url = `/api/ai-talk/tts/?sid=${stageUUID}&stoken=${stageToken}&rid=${requestUUID}&asid=${audioSegmentUUID}${format ? `&format=${encodeURIComponent(format)}` : ''}`;
           verbose(`TTS: Playing ${url}`);
 
           const listener = () => {
@@ -191,7 +196,7 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
 
         // Remove the AI generated audio.
         await new Promise((resolve, reject) => {
-          fetch(`/api/ai-talk/remove/?sid=${stageUUID}&rid=${requestUUID}&asid=${audioSegmentUUID}`, {
+          fetch(`/api/ai-talk/remove/?sid=${stageUUID}&stoken=${stageToken}&rid=${requestUUID}&asid=${audioSegmentUUID}`, {
             method: 'POST',
           }).then(response => {
             return response.json();
@@ -264,7 +269,7 @@ function AppImpl({info, verbose, robot, robotReady, stageUUID, playerRef}) {
     ref.current.stopHandler = setTimeout(() => {
       stopRecordingImpl();
     }, timeoutWaitForLastVoice);
-  }, [info, verbose, playerRef, stageUUID, robot, robotReady, ref, setProcessing, setTalking, setMicWorking]);
+  }, [info, verbose, playerRef, stageUUID, stageToken, robot, robotReady, ref, setProcessing, setTalking, setMicWorking]);
 
   // Setup the keyboard event, for PC browser.
   React.useEffect(() => {
@@ -11,6 +11,8 @@ export function useRobotInitiator(info, verbose, playerRef) {
   // The uuid and robot in stage, which is unchanged after stage started.
   const [stageRobot, setStageRobot] = React.useState(null);
   const [stageUUID, setStageUUID] = React.useState(null);
+  // The access token of stage, required by all requests of this stage.
+  const [stageToken, setStageToken] = React.useState(null);
   // Whether robot is ready, user're allowd to talk with AI.
   const [robotReady, setRobotReady] = React.useState(false);
 
@@ -76,13 +78,16 @@ export function useRobotInitiator(info, verbose, playerRef) {
 
     verbose(`Start: Create a new stage`);
 
-    fetch('/api/ai-talk/start/', {
+    // The optional API auth token, for example, https://your-server/?auth=xxx
+    const auth = new URLSearchParams(window.location.search).get('auth');
+    fetch(`/api/ai-talk/start/${auth ? `?auth=${encodeURIComponent(auth)}` : ''}`, {
       method: 'POST',
     }).then(response => {
       return response.json();
     }).then((data) => {
       verbose(`Start: Create stage success: ${data.data.sid}, ${data.data.robots.length} robots`);
       setStageUUID(data.data.sid);
+      setStageToken(data.data.stoken);
       setAvailableRobots(data.data.robots);
       setLoading(false);
 
@@ -96,7 +101,7 @@ export function useRobotInitiator(info, verbose, playerRef) {
         }
       }
     }).catch((error) => alert(`Create stage error: ${error}`));
-  }, [setLoading, setAvailableRobots, setPreviewRobot, allowed, setStageUUID]);
+  }, [setLoading, setAvailableRobots, setPreviewRobot, allowed, setStageUUID, setStageToken]);
 
   // User start a stage.
   const onStartStage = React.useCallback(() => {
@@ -132,7 +137,7 @@ export function useRobotInitiator(info, verbose, playerRef) {
     verbose(`Change to robot ${robot.label} ${robot.uuid}`);
   }, [info, verbose, availableRobots, setPreviewRobot]);
 
-  return [stageRobot, stageUUID, robotReady, <div className='SelectRobotDiv'>
+  return [stageRobot, stageUUID, stageToken, robotReady, <div className='SelectRobotDiv'>
     {!booting && !allowed && <p style={{color: "red"}}>
       Error: Only allow localhost or https to access microphone.
     </p>}